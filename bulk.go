@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	bulkRunning   = "running"
+	bulkPaused    = "paused"
+	bulkCompleted = "completed"
+	bulkCancelled = "cancelled"
+
+	recipientPending   = "pending"
+	recipientSending   = "sending"
+	recipientSent      = "sent"
+	recipientFailed    = "failed"
+	recipientSkipped   = "skipped"
+	recipientCancelled = "cancelled"
+
+	// Recipients loaded, and checked on WhatsApp, at a time
+	bulkBatchSize = 50
+
+	bulkSessionPollInterval = 5 * time.Second
+)
+
+// Message types a bulk job can send, and the endpoint sending each
+var bulkMessageTypes = map[string]string{
+	"text":     "/chat/send/text",
+	"image":    "/chat/send/image",
+	"audio":    "/chat/send/audio",
+	"document": "/chat/send/document",
+	"video":    "/chat/send/video",
+	"sticker":  "/chat/send/sticker",
+	"location": "/chat/send/location",
+	"contact":  "/chat/send/contact",
+}
+
+// Matches {{name}} placeholders in message templates
+var bulkPlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+// BulkJob sends one message template to a list of recipients
+type BulkJob struct {
+	ID           string          `db:"id" json:"id"`
+	UserID       string          `db:"user_id" json:"-"`
+	Type         string          `db:"type" json:"type"`
+	RawTemplate  string          `db:"template" json:"-"`
+	Template     json.RawMessage `db:"-" json:"message"`
+	CheckNumbers bool            `db:"check_numbers" json:"checkNumbers"`
+	Status       string          `db:"status" json:"status"`
+	CreatedAt    int64           `db:"created_at" json:"createdAt"`
+	FinishedAt   int64           `db:"finished_at" json:"finishedAt,omitempty"`
+	Progress     map[string]int  `db:"-" json:"progress"`
+}
+
+const bulkJobColumns = "id, user_id, type, template, check_numbers, status, created_at, finished_at"
+
+// BulkRecipient is the delivery report of one recipient of a bulk job
+type BulkRecipient struct {
+	JobID        string            `db:"job_id" json:"-"`
+	Position     int               `db:"position" json:"position"`
+	Phone        string            `db:"phone" json:"phone"`
+	JID          string            `db:"jid" json:"jid,omitempty"`
+	RawVariables string            `db:"variables" json:"-"`
+	Variables    map[string]string `db:"-" json:"variables,omitempty"`
+	Status       string            `db:"status" json:"status"`
+	MessageID    string            `db:"message_id" json:"messageId,omitempty"`
+	Error        string            `db:"error" json:"error,omitempty"`
+	SentAt       int64             `db:"sent_at" json:"sentAt,omitempty"`
+}
+
+const bulkRecipientColumns = "job_id, position, phone, jid, variables, status, message_id, error, sent_at"
+
+var errBulkJobNotFound = errors.New("bulk job not found")
+var errBulkJobState = errors.New("bulk job cannot change to that status")
+
+// renderTemplate replaces the placeholders of every string in a message
+// template with the variables of a recipient
+func renderTemplate(template interface{}, vars map[string]string) (interface{}, error) {
+	switch v := template.(type) {
+	case string:
+		var missing string
+		out := bulkPlaceholder.ReplaceAllStringFunc(v, func(match string) string {
+			name := bulkPlaceholder.FindStringSubmatch(match)[1]
+			value, ok := vars[name]
+			if !ok && missing == "" {
+				missing = name
+			}
+			return value
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("missing variable %s", missing)
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			rendered, err := renderTemplate(value, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = rendered
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			rendered, err := renderTemplate(value, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = rendered
+		}
+		return out, nil
+	}
+	return template, nil
+}
+
+// recipientVariables returns the variables available to the template of a recipient
+func recipientVariables(phone string, vars map[string]string) map[string]string {
+	all := map[string]string{"phone": phone}
+	for name, value := range vars {
+		all[name] = value
+	}
+	return all
+}
+
+// digitsOnly reduces a phone number to its digits so numbers written
+// differently can be compared
+func digitsOnly(phone string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+}
+
+func getBulkJob(db *sqlx.DB, userID string, id string) (BulkJob, error) {
+	var job BulkJob
+	err := db.Get(&job, "SELECT "+bulkJobColumns+" FROM bulk_jobs WHERE user_id=$1 AND id=$2", userID, id)
+	if err != nil {
+		return job, err
+	}
+	job.Template = json.RawMessage(job.RawTemplate)
+	job.Progress, err = bulkJobProgress(db, id)
+	return job, err
+}
+
+func listBulkJobs(db *sqlx.DB, userID string) ([]BulkJob, error) {
+	jobs := []BulkJob{}
+	if err := db.Select(&jobs, "SELECT "+bulkJobColumns+" FROM bulk_jobs WHERE user_id=$1 ORDER BY created_at DESC", userID); err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		jobs[i].Template = json.RawMessage(jobs[i].RawTemplate)
+		progress, err := bulkJobProgress(db, jobs[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		jobs[i].Progress = progress
+	}
+	return jobs, nil
+}
+
+// bulkJobProgress counts the recipients of a job by status
+func bulkJobProgress(db *sqlx.DB, jobID string) (map[string]int, error) {
+	rows := []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+	}{}
+	if err := db.Select(&rows, "SELECT status, COUNT(*) AS count FROM bulk_job_recipients WHERE job_id=$1 GROUP BY status", jobID); err != nil {
+		return nil, err
+	}
+	progress := map[string]int{
+		"total":            0,
+		recipientPending:   0,
+		recipientSent:      0,
+		recipientFailed:    0,
+		recipientSkipped:   0,
+		recipientCancelled: 0,
+	}
+	for _, row := range rows {
+		// A recipient being sent is still pending for the caller
+		status := row.Status
+		if status == recipientSending {
+			status = recipientPending
+		}
+		progress[status] += row.Count
+		progress["total"] += row.Count
+	}
+	return progress, nil
+}
+
+func listBulkRecipients(db *sqlx.DB, jobID string, status string) ([]BulkRecipient, error) {
+	recipients := []BulkRecipient{}
+	query := "SELECT " + bulkRecipientColumns + " FROM bulk_job_recipients WHERE job_id=$1"
+	args := []interface{}{jobID}
+	if status != "" {
+		query += " AND status=$2"
+		args = append(args, status)
+	}
+	if err := db.Select(&recipients, query+" ORDER BY position", args...); err != nil {
+		return nil, err
+	}
+	for i := range recipients {
+		json.Unmarshal([]byte(recipients[i].RawVariables), &recipients[i].Variables)
+	}
+	return recipients, nil
+}
+
+// setBulkJobStatus moves a job to a new status if it is currently in one of from
+func setBulkJobStatus(db *sqlx.DB, userID string, id string, status string, from ...string) error {
+	query := "UPDATE bulk_jobs SET status=$1, finished_at=$2 WHERE user_id=$3 AND id=$4 AND status IN ("
+	args := []interface{}{status, int64(0), userID, id}
+	if status == bulkCancelled || status == bulkCompleted {
+		args[1] = time.Now().Unix()
+	}
+	for i, s := range from {
+		if i > 0 {
+			query += ", "
+		}
+		args = append(args, s)
+		query += fmt.Sprintf("$%d", len(args))
+	}
+	res, err := db.Exec(query+")", args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	var exists bool
+	if err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM bulk_jobs WHERE user_id=$1 AND id=$2)", userID, id); err != nil {
+		return err
+	}
+	if !exists {
+		return errBulkJobNotFound
+	}
+	return errBulkJobState
+}
+
+// BulkSender runs the bulk jobs, one worker per running job
+type BulkSender struct {
+	s       *server
+	mu      sync.Mutex
+	workers map[string]*bulkWorker
+}
+
+type bulkWorker struct {
+	userID string
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var bulkSender *BulkSender
+
+// StartBulkSender resumes the jobs that were running when the server stopped
+func (s *server) StartBulkSender() {
+	bulkSender = &BulkSender{
+		s:       s,
+		workers: make(map[string]*bulkWorker),
+	}
+
+	// Same as scheduled messages, a send cut by a restart is reported instead of retried
+	if _, err := s.db.Exec("UPDATE bulk_job_recipients SET status=$1, error=$2 WHERE status=$3", recipientFailed, "interrupted by restart", recipientSending); err != nil {
+		log.Error().Err(err).Msg("Failed to recover bulk job recipients")
+	}
+	jobs := []BulkJob{}
+	if err := s.db.Select(&jobs, "SELECT "+bulkJobColumns+" FROM bulk_jobs WHERE status=$1", bulkRunning); err != nil {
+		log.Error().Err(err).Msg("Failed to load running bulk jobs")
+		return
+	}
+	for _, job := range jobs {
+		log.Info().Str("id", job.ID).Str("userID", job.UserID).Msg("Resuming bulk job")
+		bulkSender.Start(job.ID, job.UserID)
+	}
+}
+
+// Start runs a job unless it is already running. A worker still stopping
+// after a pause is waited for, so a job never has two workers
+func (b *BulkSender) Start(jobID string, userID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev := b.workers[jobID]
+	if prev != nil && prev.ctx.Err() == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &bulkWorker{userID: userID, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	b.workers[jobID] = w
+	go func() {
+		if prev != nil {
+			<-prev.done
+		}
+		defer func() {
+			b.mu.Lock()
+			if b.workers[jobID] == w {
+				delete(b.workers, jobID)
+			}
+			b.mu.Unlock()
+			cancel()
+			close(w.done)
+		}()
+		b.run(ctx, jobID, userID)
+	}()
+}
+
+// Stop makes the worker of a job return after the message it is sending
+func (b *BulkSender) Stop(jobID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if w := b.workers[jobID]; w != nil {
+		w.cancel()
+	}
+}
+
+// StopUser stops every job of a user
+func (b *BulkSender) StopUser(userID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, w := range b.workers {
+		if w.userID == userID {
+			w.cancel()
+		}
+	}
+}
+
+func (b *BulkSender) run(ctx context.Context, jobID string, userID string) {
+	db := b.s.db
+	job, err := getBulkJob(db, userID, jobID)
+	if err != nil {
+		log.Error().Err(err).Str("id", jobID).Msg("Failed to load bulk job")
+		return
+	}
+	var token string
+	if err := db.Get(&token, "SELECT token FROM users WHERE id=$1", userID); err != nil {
+		log.Error().Err(err).Str("id", jobID).Msg("Bulk job user not found")
+		return
+	}
+	var template interface{}
+	if err := json.Unmarshal([]byte(job.RawTemplate), &template); err != nil {
+		log.Error().Err(err).Str("id", jobID).Msg("Invalid bulk job template")
+		return
+	}
+	log.Info().Str("id", jobID).Str("userID", userID).Msg("Running bulk job")
+
+	for {
+		recipients := []BulkRecipient{}
+		err := db.Select(&recipients, "SELECT "+bulkRecipientColumns+" FROM bulk_job_recipients WHERE job_id=$1 AND status=$2 ORDER BY position LIMIT $3",
+			jobID, recipientPending, bulkBatchSize)
+		if err != nil {
+			log.Error().Err(err).Str("id", jobID).Msg("Failed to load bulk job recipients")
+			return
+		}
+		if len(recipients) == 0 {
+			break
+		}
+		if !b.waitSession(ctx, userID) {
+			return
+		}
+		if job.CheckNumbers {
+			recipients = b.checkNumbers(jobID, userID, recipients)
+		}
+		for _, rc := range recipients {
+			if !b.waitSession(ctx, userID) || !b.pace(ctx, userID) {
+				return
+			}
+			res, err := db.Exec("UPDATE bulk_job_recipients SET status=$1 WHERE job_id=$2 AND position=$3 AND status=$4", recipientSending, jobID, rc.Position, recipientPending)
+			if err != nil {
+				log.Error().Err(err).Str("id", jobID).Msg("Failed to claim bulk job recipient")
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				continue
+			}
+			b.send(job, token, template, rc)
+		}
+	}
+
+	if err := setBulkJobStatus(db, userID, jobID, bulkCompleted, bulkRunning); err != nil {
+		// Paused or cancelled while sending the last recipient
+		return
+	}
+	progress, _ := bulkJobProgress(db, jobID)
+	log.Info().Str("id", jobID).Interface("progress", progress).Msg("Bulk job completed")
+	sendEventWithWebHook(userEventClient(b.s, userID, token), map[string]interface{}{
+		"type": "BulkJobCompleted",
+		"event": map[string]interface{}{
+			"id":       jobID,
+			"progress": progress,
+		},
+	}, "")
+}
+
+// waitSession holds the job while the session is not logged in, so recipients
+// are not failed one after the other during an outage
+func (b *BulkSender) waitSession(ctx context.Context, userID string) bool {
+	for {
+		if client := clientManager.GetWhatsmeowClient(userID); client != nil && client.IsLoggedIn() {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(bulkSessionPollInterval):
+		}
+	}
+}
+
+// pace waits for the rate limit of the session. Bulk jobs always follow it,
+// whether or not single sends are queued
+func (b *BulkSender) pace(ctx context.Context, userID string) bool {
+	q, err := outboundQueues.Get(userID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to load rate limit settings")
+		return false
+	}
+	wait := q.reserve() + q.Settings().humanDelay()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// checkNumbers looks the recipients up on WhatsApp, skipping those not on it
+// and returning the rest. On lookup errors the recipients are sent unchecked
+func (b *BulkSender) checkNumbers(jobID string, userID string, recipients []BulkRecipient) []BulkRecipient {
+	phones := []string{}
+	for _, rc := range recipients {
+		if rc.JID == "" {
+			phones = append(phones, digitsOnly(rc.Phone))
+		}
+	}
+	if len(phones) == 0 {
+		return recipients
+	}
+	client := clientManager.GetWhatsmeowClient(userID)
+	if client == nil {
+		return recipients
+	}
+	resp, err := client.IsOnWhatsApp(phones)
+	if err != nil {
+		log.Warn().Err(err).Str("id", jobID).Msg("Failed to check bulk job recipients on WhatsApp")
+		return recipients
+	}
+	found := make(map[string]string, len(resp))
+	for _, item := range resp {
+		if item.IsIn {
+			found[digitsOnly(item.Query)] = item.JID.User
+		} else if _, ok := found[digitsOnly(item.Query)]; !ok {
+			found[digitsOnly(item.Query)] = ""
+		}
+	}
+
+	checked := recipients[:0]
+	for _, rc := range recipients {
+		if rc.JID != "" {
+			checked = append(checked, rc)
+			continue
+		}
+		user, ok := found[digitsOnly(rc.Phone)]
+		if !ok {
+			// Not in the answer, send it anyway and let the send report it
+			checked = append(checked, rc)
+			continue
+		}
+		if user == "" {
+			_, err = b.s.db.Exec("UPDATE bulk_job_recipients SET status=$1, error=$2 WHERE job_id=$3 AND position=$4 AND status=$5",
+				recipientSkipped, "not on WhatsApp", jobID, rc.Position, recipientPending)
+		} else {
+			rc.JID = user
+			_, err = b.s.db.Exec("UPDATE bulk_job_recipients SET jid=$1 WHERE job_id=$2 AND position=$3", user, jobID, rc.Position)
+			checked = append(checked, rc)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("id", jobID).Msg("Failed to store bulk job recipient check")
+		}
+	}
+	return checked
+}
+
+// send renders the template for one recipient and sends it through the
+// regular send endpoint of the job's message type
+func (b *BulkSender) send(job BulkJob, token string, template interface{}, rc BulkRecipient) {
+	var vars map[string]string
+	json.Unmarshal([]byte(rc.RawVariables), &vars)
+
+	var messageID string
+	rendered, err := renderTemplate(template, recipientVariables(rc.Phone, vars))
+	if err == nil {
+		payload := rendered.(map[string]interface{})
+		payload["Phone"] = rc.Phone
+		if rc.JID != "" {
+			payload["Phone"] = rc.JID
+		}
+		var body []byte
+		if body, err = json.Marshal(payload); err == nil {
+			var data map[string]interface{}
+			// The job is already paced, skip the outbound queue
+			data, err = b.s.replaySend(token, bulkMessageTypes[job.Type], body, job.ID)
+			if err == nil {
+				messageID, _ = data["Id"].(string)
+			}
+		}
+	}
+
+	status := recipientSent
+	errorText := ""
+	var sentAt int64
+	if err != nil {
+		status = recipientFailed
+		errorText = err.Error()
+		log.Warn().Err(err).Str("id", job.ID).Str("phone", rc.Phone).Msg("Bulk message failed")
+	} else {
+		sentAt = time.Now().Unix()
+	}
+	_, err = b.s.db.Exec("UPDATE bulk_job_recipients SET status=$1, message_id=$2, error=$3, sent_at=$4 WHERE job_id=$5 AND position=$6",
+		status, messageID, errorText, sentAt, job.ID, rc.Position)
+	if err != nil {
+		log.Error().Err(err).Str("id", job.ID).Msg("Failed to update bulk job recipient")
+	}
+}
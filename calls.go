@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// What is done with incoming calls
+const (
+	callPolicyIgnore        = "ignore"
+	callPolicyReject        = "reject"
+	callPolicyRejectMessage = "reject_message"
+)
+
+// Status of a call in the call log
+const (
+	callRinging  = "ringing"
+	callAccepted = "accepted"
+	callRejected = "rejected"
+	callMissed   = "missed"
+	callEnded    = "ended"
+)
+
+var errCallNotFound = errors.New("call not found")
+
+// CallSettings is the call policy of a session
+type CallSettings struct {
+	Policy  string `db:"call_policy" json:"policy"`
+	Message string `db:"call_reject_message" json:"message"`
+}
+
+func (cs CallSettings) validate() error {
+	switch cs.Policy {
+	case callPolicyIgnore, callPolicyReject:
+	case callPolicyRejectMessage:
+		if cs.Message == "" {
+			return errors.New("message is required by the reject_message policy")
+		}
+	default:
+		return fmt.Errorf("policy must be %s, %s or %s", callPolicyIgnore, callPolicyReject, callPolicyRejectMessage)
+	}
+	return nil
+}
+
+func getCallSettings(db *sqlx.DB, userID string) (CallSettings, error) {
+	var settings CallSettings
+	err := db.Get(&settings, "SELECT call_policy, call_reject_message FROM users WHERE id = $1", userID)
+	return settings, err
+}
+
+// CallLogEntry is a call received by a session
+type CallLogEntry struct {
+	CallID    string `db:"call_id" json:"call_id"`
+	From      string `db:"from_jid" json:"from"`
+	GroupJID  string `db:"group_jid" json:"group_jid,omitempty"`
+	IsVideo   bool   `db:"is_video" json:"is_video"`
+	IsGroup   bool   `db:"is_group" json:"is_group"`
+	Status    string `db:"status" json:"status"`
+	Reason    string `db:"reason" json:"reason,omitempty"`
+	StartedAt int64  `db:"started_at" json:"started_at"`
+	EndedAt   int64  `db:"ended_at" json:"ended_at,omitempty"`
+}
+
+// logIncomingCall adds a ringing call to the log. It is false when the call
+// was already logged, as calls can be announced more than once
+func logIncomingCall(db *sqlx.DB, userID string, entry CallLogEntry) (bool, error) {
+	res, err := db.Exec(`
+		INSERT INTO call_log (user_id, call_id, from_jid, group_jid, is_video, is_group, status, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (user_id, call_id) DO NOTHING`,
+		userID, entry.CallID, entry.From, entry.GroupJID, entry.IsVideo, entry.IsGroup, callRinging, entry.StartedAt)
+	if err != nil {
+		return false, err
+	}
+	added, err := res.RowsAffected()
+	return added > 0, err
+}
+
+// setCallStatus moves a logged call to a new status
+func setCallStatus(db *sqlx.DB, userID string, callID string, status string, reason string) error {
+	_, err := db.Exec("UPDATE call_log SET status = $1, reason = $2 WHERE user_id = $3 AND call_id = $4",
+		status, reason, userID, callID)
+	return err
+}
+
+// endCall records the end of a call. Calls nobody answered or rejected were missed
+func endCall(db *sqlx.DB, userID string, callID string, reason string, endedAt time.Time) error {
+	_, err := db.Exec(`
+		UPDATE call_log SET
+			status = CASE status WHEN $1 THEN $2 WHEN $3 THEN $4 ELSE status END,
+			reason = CASE WHEN reason = '' THEN $5 ELSE reason END,
+			ended_at = $6
+		WHERE user_id = $7 AND call_id = $8`,
+		callRinging, callMissed, callAccepted, callEnded, reason, endedAt.Unix(), userID, callID)
+	return err
+}
+
+func getCallLogEntry(db *sqlx.DB, userID string, callID string) (*CallLogEntry, error) {
+	var entry CallLogEntry
+	err := db.Get(&entry, "SELECT call_id, from_jid, group_jid, is_video, is_group, status, reason, started_at, ended_at FROM call_log WHERE user_id = $1 AND call_id = $2", userID, callID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errCallNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// listCallLog returns the latest calls first, optionally only those in a status
+func listCallLog(db *sqlx.DB, userID string, status string, limit int) ([]CallLogEntry, error) {
+	query := "SELECT call_id, from_jid, group_jid, is_video, is_group, status, reason, started_at, ended_at FROM call_log WHERE user_id = $1"
+	args := []interface{}{userID}
+	if status != "" {
+		query += " AND status = $2"
+		args = append(args, status)
+	}
+	query += fmt.Sprintf(" ORDER BY started_at DESC LIMIT %d", limit)
+
+	entries := []CallLogEntry{}
+	if err := db.Select(&entries, query, args...); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// callIsVideo tells from the offer of a call if it has video
+func callIsVideo(data *waBinary.Node) bool {
+	if data == nil {
+		return false
+	}
+	for _, child := range data.GetChildren() {
+		if child.Tag == "video" {
+			return true
+		}
+	}
+	return false
+}
+
+// callEvent is the webhook payload of a call event
+func callEvent(meta types.BasicCallMeta) map[string]interface{} {
+	event := map[string]interface{}{
+		"CallId":      meta.CallID,
+		"From":        meta.From.ToNonAD().String(),
+		"CallCreator": meta.CallCreator.ToNonAD().String(),
+		"Timestamp":   meta.Timestamp.Unix(),
+		"IsGroup":     !meta.GroupJID.IsEmpty(),
+	}
+	if !meta.GroupJID.IsEmpty() {
+		event["GroupJid"] = meta.GroupJID.String()
+	}
+	return event
+}
+
+// handleIncomingCall logs a call and applies the call policy of the session
+// to it. The action taken is returned, empty when the call is left ringing
+func (mycli *MyClient) handleIncomingCall(meta types.BasicCallMeta, isVideo bool) string {
+	added, err := logIncomingCall(mycli.db, mycli.userID, CallLogEntry{
+		CallID:    meta.CallID,
+		From:      meta.From.ToNonAD().String(),
+		GroupJID:  meta.GroupJID.String(),
+		IsVideo:   isVideo,
+		IsGroup:   !meta.GroupJID.IsEmpty(),
+		StartedAt: meta.Timestamp.Unix(),
+	})
+	if err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Str("call", meta.CallID).Msg("Failed to log call")
+	}
+	if !added {
+		return ""
+	}
+
+	settings, err := getCallSettings(mycli.db, mycli.userID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Msg("Failed to load call policy")
+		return ""
+	}
+	if settings.Policy != callPolicyReject && settings.Policy != callPolicyRejectMessage {
+		return ""
+	}
+
+	caller := meta.CallCreator
+	if caller.IsEmpty() {
+		caller = meta.From
+	}
+	if err := mycli.WAClient.RejectCall(caller, meta.CallID); err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Str("call", meta.CallID).Msg("Failed to reject call")
+		return ""
+	}
+	if err := setCallStatus(mycli.db, mycli.userID, meta.CallID, callRejected, "policy"); err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Str("call", meta.CallID).Msg("Failed to update call log")
+	}
+	log.Info().Str("userID", mycli.userID).Str("call", meta.CallID).Str("from", meta.From.String()).Msg("Call rejected by policy")
+
+	if settings.Policy == callPolicyRejectMessage {
+		// Group calls are answered in private, the group did not call
+		go mycli.sendCallReply(caller.ToNonAD(), settings.Message)
+	}
+	return callRejected
+}
+
+// sendCallReply sends the text of the reject_message policy to a caller
+func (mycli *MyClient) sendCallReply(to types.JID, text string) {
+	msg := &waE2E.Message{Conversation: proto.String(text)}
+	resp, err := mycli.WAClient.SendMessage(context.Background(), to, msg)
+	if err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Str("to", to.String()).Msg("Failed to send call reply")
+		return
+	}
+	storeOutgoingMessage(mycli.db, mycli.userID, to, resp.ID, msg, resp.Timestamp)
+}
@@ -12,6 +12,7 @@ type ClientManager struct {
 	whatsmeowClients map[string]*whatsmeow.Client
 	httpClients      map[string]*resty.Client
 	myClients        map[string]*MyClient
+	sessions         map[string]*Session
 }
 
 func NewClientManager() *ClientManager {
@@ -19,6 +20,7 @@ func NewClientManager() *ClientManager {
 		whatsmeowClients: make(map[string]*whatsmeow.Client),
 		httpClients:      make(map[string]*resty.Client),
 		myClients:        make(map[string]*MyClient),
+		sessions:         make(map[string]*Session),
 	}
 }
 
@@ -84,3 +86,41 @@ func (cm *ClientManager) UpdateMyClientSubscriptions(userID string, subscription
 		client.subscriptions = subscriptions
 	}
 }
+
+// StartSession registers a new session for the user. It returns false, with the
+// running session, when one that has not stopped yet already exists
+func (cm *ClientManager) StartSession(userID string) (*Session, bool) {
+	cm.Lock()
+	defer cm.Unlock()
+	var history []SessionTransition
+	if current, exists := cm.sessions[userID]; exists {
+		if current.State() != SessionStopped {
+			return current, false
+		}
+		history = current.History()
+	}
+	session := newSession(userID, history)
+	cm.sessions[userID] = session
+	return session, true
+}
+
+func (cm *ClientManager) GetSession(userID string) *Session {
+	cm.RLock()
+	defer cm.RUnlock()
+	return cm.sessions[userID]
+}
+
+// StopSession asks the running session of the user to stop and returns it
+func (cm *ClientManager) StopSession(userID string, reason string) *Session {
+	session := cm.GetSession(userID)
+	if session != nil {
+		session.Stop(reason)
+	}
+	return session
+}
+
+func (cm *ClientManager) DeleteSession(userID string) {
+	cm.Lock()
+	defer cm.Unlock()
+	delete(cm.sessions, userID)
+}
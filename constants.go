@@ -5,6 +5,14 @@ var supportedEventTypes = []string{
 	// Messages and Communication
 	"Message",
 	"UndecryptableMessage",
+	"ScheduledMessageSent",
+	"ScheduledMessageFailed",
+	"MessageQueued",
+	"MessageSent",
+	"MessageFailed",
+	"BulkJobCompleted",
+	"BulkJobCancelled",
+	"PollVote",
 	"Receipt",
 	"MediaRetry",
 	"ReadReceipt",
@@ -31,6 +39,11 @@ var supportedEventTypes = []string{
 	"PairError",
 	"QR",
 	"QRScannedWithoutMultidevice",
+	"Reconnecting",
+	"ReconnectSucceeded",
+	"ReconnectGaveUp",
+	"UserExpiring",
+	"UserExpired",
 
 	// Privacy and Settings
 	"PrivacySettings",
@@ -41,6 +54,7 @@ var supportedEventTypes = []string{
 	"AppState",
 	"AppStateSyncComplete",
 	"HistorySync",
+	"HistoryBackfill",
 	"OfflineSyncCompleted",
 	"OfflineSyncPreview",
 
@@ -74,6 +88,31 @@ var supportedEventTypes = []string{
 	"All",
 }
 
+// v1 types that differ from the name the event is subscribed with. v1
+// payloads keep them unchanged, v2 payloads use the subscription name
+var legacyEventTypes = map[string]string{
+	"Logged Out": "LoggedOut",
+}
+
+// Subscription names that also receive events of another type. Every
+// receipt is emitted as ReadReceipt, subscribing to Receipt gets them too
+var eventTypeAliases = map[string]string{
+	"Receipt": "ReadReceipt",
+}
+
+// subscribedToEvent reports whether a list of subscriptions covers an event type
+func subscribedToEvent(subscriptions []string, eventType string) bool {
+	if Find(subscriptions, eventType) || Find(subscriptions, "All") {
+		return true
+	}
+	for alias, target := range eventTypeAliases {
+		if target == eventType && Find(subscriptions, alias) {
+			return true
+		}
+	}
+	return false
+}
+
 // Map for quick validation
 var eventTypeMap map[string]bool
 
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// Values of users.expiration_notice, so each notice is only sent once
+const (
+	expirationNoticeNone    = 0
+	expirationNoticeWarned  = 1
+	expirationNoticeExpired = 2
+)
+
+// Users handled per check, the rest are picked up on the next tick
+const expirationCheckBatchSize = 100
+
+// userExpired reports whether an expiration (unix seconds, 0 for never) has passed
+func userExpired(expiration int64) bool {
+	return expiration > 0 && expiration <= time.Now().Unix()
+}
+
+// startExpirationWatcher periodically warns about and disables expiring users
+func (s *server) startExpirationWatcher() {
+	interval := time.Duration(envInt("EXPIRATION_CHECK_SECONDS", 60)) * time.Second
+	warning := time.Duration(envInt("EXPIRATION_WARNING_HOURS", 72)) * time.Hour
+	go func() {
+		s.checkExpirations(warning)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.checkExpirations(warning)
+		}
+	}()
+}
+
+func (s *server) checkExpirations(warning time.Duration) {
+	type expiringUser struct {
+		ID         string `db:"id"`
+		Name       string `db:"name"`
+		Token      string `db:"token"`
+		Expiration int64  `db:"expiration"`
+		Notice     int    `db:"expiration_notice"`
+	}
+
+	now := time.Now()
+	users := []expiringUser{}
+	err := s.db.Select(&users, `
+		SELECT id, name, token, expiration, expiration_notice FROM users
+		WHERE expiration > 0 AND expiration <= $1 AND expiration_notice < $2
+		ORDER BY expiration LIMIT $3`,
+		now.Add(warning).Unix(), expirationNoticeExpired, expirationCheckBatchSize)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not check user expirations")
+		return
+	}
+
+	for _, u := range users {
+		data := map[string]interface{}{
+			"userID":    u.ID,
+			"name":      u.Name,
+			"expiresAt": u.Expiration,
+		}
+		if userExpired(u.Expiration) {
+			log.Warn().Str("userid", u.ID).Str("name", u.Name).Msg("User expired, disconnecting")
+			clientManager.StopSession(u.ID, "user expired")
+			sqlStmt := `UPDATE users SET connected=0, expiration_notice=$1 WHERE id=$2`
+			if _, err := s.db.Exec(sqlStmt, expirationNoticeExpired, u.ID); err != nil {
+				log.Error().Err(err).Msg(sqlStmt)
+				continue
+			}
+			sendAdminEvent(s, "UserExpired", u.ID, u.Token, data)
+		} else if u.Notice < expirationNoticeWarned {
+			sqlStmt := `UPDATE users SET expiration_notice=$1 WHERE id=$2`
+			if _, err := s.db.Exec(sqlStmt, expirationNoticeWarned, u.ID); err != nil {
+				log.Error().Err(err).Msg(sqlStmt)
+				continue
+			}
+			data["remaining"] = u.Expiration - now.Unix()
+			sendAdminEvent(s, "UserExpiring", u.ID, u.Token, data)
+		}
+	}
+}
+
+// setUserExpiration stores a new expiration and resets the notices for it
+func setUserExpiration(db *sqlx.DB, userID string, expiration int64) error {
+	if _, err := db.Exec("UPDATE users SET expiration=$1, expiration_notice=$2 WHERE id=$3", expiration, expirationNoticeNone, userID); err != nil {
+		return err
+	}
+
+	var token string
+	if err := db.Get(&token, "SELECT token FROM users WHERE id=$1", userID); err == nil {
+		if myuserinfo, found := userinfocache.Get(token); found {
+			v := updateUserInfo(myuserinfo, "Expiration", strconv.FormatInt(expiration, 10))
+			userinfocache.Set(token, v, cache.NoExpiration)
+		}
+	}
+	return nil
+}
+
+// sendAdminEvent publishes events about the account itself. They go to the
+// webhooks of the user like any event, and to the global webhook and
+// RabbitMQ even when the user is not subscribed to them, they do not depend
+// on a running session
+func sendAdminEvent(s *server, eventType string, userID string, token string, data map[string]interface{}) {
+	postmap := map[string]interface{}{
+		"type":  eventType,
+		"event": data,
+	}
+	mycli := userEventClient(s, userID, token)
+	sendEventWithWebHook(mycli, postmap, "")
+
+	// Subscribed users already had it sent to the global webhook
+	subscribedEvents, err := updateAndGetUserSubscriptions(mycli)
+	if err == nil && subscribedToEvent(subscribedEvents, eventType) {
+		return
+	}
+	jsonData, err := json.Marshal(postmap)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal admin event")
+		return
+	}
+	sendToGlobalWebHook(jsonData, token, userID)
+	sendToGlobalRabbit(jsonData)
+}
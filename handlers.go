@@ -10,7 +10,6 @@ import (
 	"image"
 	"image/jpeg"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -63,6 +62,9 @@ func (s *server) authalice(next http.Handler) http.Handler {
 		events := ""
 		proxy_url := ""
 		qrcode := ""
+		webhook_omit_token := ""
+		webhook_schema := ""
+		expiration := ""
 
 		// Get token from headers or uri parameters
 		token := r.Header.Get("token")
@@ -74,27 +76,30 @@ func (s *server) authalice(next http.Handler) http.Handler {
 		if !found {
 			log.Info().Msg("Looking for user information in DB")
 			// Checks DB from matching user and store user values in context
-			rows, err := s.db.Query("SELECT id,name,webhook,jid,events,proxy_url,qrcode FROM users WHERE token=$1 LIMIT 1", token)
+			rows, err := s.db.Query("SELECT id,name,webhook,jid,events,proxy_url,qrcode,CASE WHEN webhook_omit_token THEN 'true' ELSE 'false' END,COALESCE(webhook_schema,'v1'),COALESCE(expiration,0) FROM users WHERE token=$1 LIMIT 1", token)
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, err)
 				return
 			}
 			defer rows.Close()
 			for rows.Next() {
-				err = rows.Scan(&txtid, &name, &webhook, &jid, &events, &proxy_url, &qrcode)
+				err = rows.Scan(&txtid, &name, &webhook, &jid, &events, &proxy_url, &qrcode, &webhook_omit_token, &webhook_schema, &expiration)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, err)
 					return
 				}
 				v := Values{map[string]string{
-					"Id":      txtid,
-					"Name":    name,
-					"Jid":     jid,
-					"Webhook": webhook,
-					"Token":   token,
-					"Proxy":   proxy_url,
-					"Events":  events,
-					"Qrcode":  qrcode,
+					"Id":               txtid,
+					"Name":             name,
+					"Jid":              jid,
+					"Webhook":          webhook,
+					"Token":            token,
+					"Proxy":            proxy_url,
+					"Events":           events,
+					"Qrcode":           qrcode,
+					"WebhookOmitToken": webhook_omit_token,
+					"WebhookSchema":    webhook_schema,
+					"Expiration":       expiration,
 				}}
 
 				userinfocache.Set(token, v, cache.NoExpiration)
@@ -105,12 +110,18 @@ func (s *server) authalice(next http.Handler) http.Handler {
 			ctx = context.WithValue(r.Context(), "userinfo", myuserinfo)
 			log.Info().Str("name", myuserinfo.(Values).Get("name")).Msg("User info name from Cache")
 			txtid = myuserinfo.(Values).Get("Id")
+			expiration = myuserinfo.(Values).Get("Expiration")
 		}
 
 		if txtid == "" {
 			s.Respond(w, r, http.StatusUnauthorized, errors.New("unauthorized"))
 			return
 		}
+
+		if exp, _ := strconv.ParseInt(expiration, 10, 64); userExpired(exp) {
+			s.Respond(w, r, http.StatusForbidden, errors.New("user expired"))
+			return
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -173,9 +184,14 @@ func (s *server) Connect() http.HandlerFunc {
 		v := updateUserInfo(r.Context().Value("userinfo"), "Events", eventstring)
 		userinfocache.Set(token, v, cache.NoExpiration)
 
+		session, started := clientManager.StartSession(txtid)
+		if !started {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("session already started (%s)", session.State())))
+			return
+		}
+
 		log.Info().Str("jid", jid).Msg("Attempt to connect")
-		killchannel[txtid] = make(chan bool)
-		go s.startClient(txtid, jid, token, subscribedEvents)
+		go s.startClient(session, txtid, jid, token, subscribedEvents)
 
 		if t.Immediate == false {
 			log.Warn().Msg("Waiting 10 seconds")
@@ -230,8 +246,9 @@ func (s *server) Disconnect() http.HandlerFunc {
 			response := map[string]interface{}{"Details": "Disconnected"}
 			responseJson, err := json.Marshal(response)
 
-			clientManager.DeleteWhatsmeowClient(txtid) // mameluco
-			killchannel[txtid] <- true
+			if session := clientManager.StopSession(txtid, "disconnect requested"); session != nil {
+				session.Wait(10 * time.Second)
+			}
 
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, err)
@@ -258,16 +275,19 @@ func (s *server) GetWebhook() http.HandlerFunc {
 
 		webhook := ""
 		events := ""
+		hasSecret := ""
+		omitToken := ""
+		schema := ""
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 
-		rows, err := s.db.Query("SELECT webhook,events FROM users WHERE id=$1 LIMIT 1", txtid)
+		rows, err := s.db.Query("SELECT webhook,events,CASE WHEN COALESCE(webhook_secret,'') <> '' THEN 'true' ELSE 'false' END,CASE WHEN webhook_omit_token THEN 'true' ELSE 'false' END,COALESCE(webhook_schema,'v1') FROM users WHERE id=$1 LIMIT 1", txtid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not get webhook: %v", err)))
 			return
 		}
 		defer rows.Close()
 		for rows.Next() {
-			err = rows.Scan(&webhook, &events)
+			err = rows.Scan(&webhook, &events, &hasSecret, &omitToken, &schema)
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not get webhook: %s", fmt.Sprintf("%s", err))))
 				return
@@ -281,7 +301,7 @@ func (s *server) GetWebhook() http.HandlerFunc {
 
 		eventarray := strings.Split(events, ",")
 
-		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray}
+		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray, "hasSecret": hasSecret == "true", "omitToken": omitToken == "true", "schema": schema}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -323,9 +343,13 @@ func (s *server) DeleteWebhook() http.HandlerFunc {
 // UpdateWebhook updates the webhook URL and events for a user
 func (s *server) UpdateWebhook() http.HandlerFunc {
 	type updateWebhookStruct struct {
-		WebhookURL string   `json:"webhook"`
-		Events     []string `json:"events,omitempty"`
-		Active     bool     `json:"active"`
+		WebhookURL     string   `json:"webhook"`
+		Events         []string `json:"events,omitempty"`
+		Active         bool     `json:"active"`
+		Secret         *string  `json:"secret,omitempty"`
+		GenerateSecret bool     `json:"generateSecret,omitempty"`
+		OmitToken      *bool    `json:"omitToken,omitempty"`
+		Schema         *string  `json:"schema,omitempty"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
@@ -338,6 +362,10 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
 			return
 		}
+		if err := validWebhookSchema(t.Schema); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
 
 		webhook := t.WebhookURL
 
@@ -378,11 +406,23 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 			return
 		}
 
+		secret, err := s.updateWebhookSigning(txtid, r.Context().Value("userinfo"), t.Secret, t.GenerateSecret, t.OmitToken)
+		if err == nil {
+			err = s.updateWebhookSchema(txtid, r.Context().Value("userinfo"), t.Schema)
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not update webhook: %v", err)))
+			return
+		}
+
 		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
 		v = updateUserInfo(v, "Events", eventstring)
 		userinfocache.Set(token, v, cache.NoExpiration)
 
-		response := map[string]interface{}{"webhook": webhook, "events": validEvents, "active": t.Active}
+		response := map[string]interface{}{"webhook": webhook, "events": validEvents, "active": t.Active, "omitToken": v.(Values).Get("WebhookOmitToken") == "true", "schema": userWebhookSchema(token)}
+		if secret != "" {
+			response["secret"] = secret
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -392,11 +432,71 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 	}
 }
 
+// updateWebhookSigning stores the signing secret and token options sent to the
+// webhook endpoints. A new or generated secret is returned so it can be shown once
+func (s *server) updateWebhookSigning(txtid string, userinfo interface{}, secret *string, generate bool, omitToken *bool) (string, error) {
+	newSecret := ""
+	if generate {
+		generated, err := GenerateRandomID()
+		if err != nil {
+			return "", err
+		}
+		newSecret = generated
+		secret = &newSecret
+	} else if secret != nil {
+		newSecret = *secret
+	}
+
+	if secret != nil {
+		if _, err := s.db.Exec("UPDATE users SET webhook_secret=$1 WHERE id=$2", *secret, txtid); err != nil {
+			return "", err
+		}
+	}
+	if omitToken != nil {
+		if _, err := s.db.Exec("UPDATE users SET webhook_omit_token=$1 WHERE id=$2", *omitToken, txtid); err != nil {
+			return "", err
+		}
+		updateUserInfo(userinfo, "WebhookOmitToken", strconv.FormatBool(*omitToken))
+	}
+	return newSecret, nil
+}
+
+func validWebhookSchema(schema *string) error {
+	if schema != nil && *schema != webhookSchemaV1 && *schema != webhookSchemaV2 {
+		return errors.New("schema must be v1 or v2")
+	}
+	return nil
+}
+
+// updateWebhookSchema stores the payload format the webhooks of the user get
+func (s *server) updateWebhookSchema(txtid string, userinfo interface{}, schema *string) error {
+	if schema == nil {
+		return nil
+	}
+	if _, err := s.db.Exec("UPDATE users SET webhook_schema=$1 WHERE id=$2", *schema, txtid); err != nil {
+		return err
+	}
+	updateUserInfo(userinfo, "WebhookSchema", *schema)
+	return nil
+}
+
+// Gets the JSON Schema of the v2 webhook payload
+func (s *server) GetWebhookSchema() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/schema+json")
+		s.respondWithJSON(w, http.StatusOK, webhookEventSchema())
+	}
+}
+
 // SetWebhook sets the webhook URL and events for a user
 func (s *server) SetWebhook() http.HandlerFunc {
 	type webhookStruct struct {
-		WebhookURL string   `json:"webhookurl"`
-		Events     []string `json:"events,omitempty"`
+		WebhookURL     string   `json:"webhookurl"`
+		Events         []string `json:"events,omitempty"`
+		Secret         *string  `json:"secret,omitempty"`
+		GenerateSecret bool     `json:"generateSecret,omitempty"`
+		OmitToken      *bool    `json:"omitToken,omitempty"`
+		Schema         *string  `json:"schema,omitempty"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
@@ -409,6 +509,10 @@ func (s *server) SetWebhook() http.HandlerFunc {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
 			return
 		}
+		if err := validWebhookSchema(t.Schema); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
 
 		webhook := t.WebhookURL
 
@@ -446,11 +550,235 @@ func (s *server) SetWebhook() http.HandlerFunc {
 			return
 		}
 
+		secret, err := s.updateWebhookSigning(txtid, r.Context().Value("userinfo"), t.Secret, t.GenerateSecret, t.OmitToken)
+		if err == nil {
+			err = s.updateWebhookSchema(txtid, r.Context().Value("userinfo"), t.Schema)
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not set webhook: %v", err)))
+			return
+		}
+
 		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
 		v = updateUserInfo(v, "Events", eventstring)
 		userinfocache.Set(token, v, cache.NoExpiration)
 
-		response := map[string]interface{}{"webhook": webhook}
+		response := map[string]interface{}{"webhook": webhook, "omitToken": v.(Values).Get("WebhookOmitToken") == "true", "schema": userWebhookSchema(token)}
+		if secret != "" {
+			response["secret"] = secret
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// validWebhookEvents keeps the supported event types of a subscription list
+func validWebhookEvents(events []string) []string {
+	validEvents := []string{}
+	for _, event := range events {
+		if !Find(supportedEventTypes, event) {
+			log.Warn().Str("Type", event).Msg("Event type discarded")
+			continue
+		}
+		if !Find(validEvents, event) {
+			validEvents = append(validEvents, event)
+		}
+	}
+	return validEvents
+}
+
+// Lists additional webhook endpoints
+func (s *server) ListWebhookEndpoints() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		endpoints, err := listWebhookEndpoints(s.db, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not list webhook endpoints: %v", err)))
+			return
+		}
+
+		responseJson, err := json.Marshal(endpoints)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets one additional webhook endpoint
+func (s *server) GetWebhookEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		endpoint, err := getWebhookEndpoint(s.db, txtid, mux.Vars(r)["id"])
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("webhook endpoint not found"))
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not get webhook endpoint: %v", err)))
+			return
+		}
+
+		responseJson, err := json.Marshal(endpoint)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Adds a webhook endpoint with its own events, format and headers
+func (s *server) AddWebhookEndpoint() http.HandlerFunc {
+	type endpointStruct struct {
+		URL     string            `json:"url"`
+		Events  []string          `json:"events"`
+		Format  string            `json:"format"`
+		Headers map[string]string `json:"headers"`
+		Active  *bool             `json:"active,omitempty"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		decoder := json.NewDecoder(r.Body)
+		var t endpointStruct
+		if err := decoder.Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+
+		if !isHTTPURL(t.URL) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing or invalid url"))
+			return
+		}
+		if t.Format == "" {
+			t.Format = "json"
+		}
+		if t.Format != "json" && t.Format != "form" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("format must be json or form"))
+			return
+		}
+
+		id, err := GenerateRandomID()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		endpoint := &WebhookEndpoint{
+			ID:        id,
+			UserID:    txtid,
+			URL:       t.URL,
+			Events:    validWebhookEvents(t.Events),
+			Format:    t.Format,
+			Headers:   t.Headers,
+			Active:    t.Active == nil || *t.Active,
+			CreatedAt: time.Now().Unix(),
+		}
+		if err := saveWebhookEndpoint(s.db, endpoint); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not add webhook endpoint: %v", err)))
+			return
+		}
+
+		responseJson, err := json.Marshal(endpoint)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Updates a webhook endpoint, only the fields sent are changed
+func (s *server) UpdateWebhookEndpoint() http.HandlerFunc {
+	type endpointStruct struct {
+		URL     *string            `json:"url,omitempty"`
+		Events  *[]string          `json:"events,omitempty"`
+		Format  *string            `json:"format,omitempty"`
+		Headers *map[string]string `json:"headers,omitempty"`
+		Active  *bool              `json:"active,omitempty"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		decoder := json.NewDecoder(r.Body)
+		var t endpointStruct
+		if err := decoder.Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+
+		endpoint, err := getWebhookEndpoint(s.db, txtid, mux.Vars(r)["id"])
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("webhook endpoint not found"))
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not get webhook endpoint: %v", err)))
+			return
+		}
+
+		if t.URL != nil {
+			if !isHTTPURL(*t.URL) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("invalid url"))
+				return
+			}
+			endpoint.URL = *t.URL
+		}
+		if t.Format != nil {
+			if *t.Format != "json" && *t.Format != "form" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("format must be json or form"))
+				return
+			}
+			endpoint.Format = *t.Format
+		}
+		if t.Events != nil {
+			endpoint.Events = validWebhookEvents(*t.Events)
+		}
+		if t.Headers != nil {
+			endpoint.Headers = *t.Headers
+		}
+		if t.Active != nil {
+			endpoint.Active = *t.Active
+		}
+
+		if err := saveWebhookEndpoint(s.db, endpoint); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not update webhook endpoint: %v", err)))
+			return
+		}
+
+		responseJson, err := json.Marshal(endpoint)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Removes a webhook endpoint
+func (s *server) DeleteWebhookEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		deleted, err := deleteWebhookEndpoint(s.db, txtid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not delete webhook endpoint: %v", err)))
+			return
+		}
+		if !deleted {
+			s.Respond(w, r, http.StatusNotFound, errors.New("webhook endpoint not found"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Webhook endpoint deleted successfully", "id": id}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -531,8 +859,11 @@ func (s *server) Logout() http.HandlerFunc {
 					return
 				} else {
 					log.Info().Str("jid", jid).Msg("Logged out")
-					clientManager.DeleteWhatsmeowClient(txtid)
-					killchannel[txtid] <- true
+					if session := clientManager.GetSession(txtid); session != nil {
+						session.SetState(SessionLoggedOut, "logout requested")
+						session.Stop("logout requested")
+						session.Wait(10 * time.Second)
+					}
 				}
 			} else {
 				if clientManager.GetWhatsmeowClient(txtid).IsConnected() == true {
@@ -634,15 +965,19 @@ func (s *server) GetStatus() http.HandlerFunc {
 
 		txtid := userInfo.Get("Id")
 
-		/*
-			if clientManager.GetWhatsmeowClient(txtid) == nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
-				return
-			}
-		*/
+		isConnected := false
+		isLoggedIn := false
+		if client := clientManager.GetWhatsmeowClient(txtid); client != nil {
+			isConnected = client.IsConnected()
+			isLoggedIn = client.IsLoggedIn()
+		}
 
-		isConnected := clientManager.GetWhatsmeowClient(txtid).IsConnected()
-		isLoggedIn := clientManager.GetWhatsmeowClient(txtid).IsLoggedIn()
+		state := SessionIdle
+		history := []SessionTransition{}
+		if session := clientManager.GetSession(txtid); session != nil {
+			state = session.State()
+			history = session.History()
+		}
 
 		// Get proxy_config
 		var proxyURL string
@@ -681,6 +1016,8 @@ func (s *server) GetStatus() http.HandlerFunc {
 			"qrcode":       userInfo.Get("Qrcode"),
 			"proxy_config": proxyConfig,
 			"s3_config":    s3Config,
+			"state":        state,
+			"history":      history,
 		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -702,6 +1039,7 @@ func (s *server) SendDocument() http.HandlerFunc {
 		FileName    string
 		Id          string
 		MimeType    string
+		QuotedText  string
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -716,25 +1054,28 @@ func (s *server) SendDocument() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t documentStruct
-		var err error
-		err = decoder.Decode(&t)
+		upload, err := decodeSendPayload(w, r, &t, mediaSizeLimit("document"))
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.Respond(w, r, payloadErrorStatus(err), err)
 			return
 		}
+		defer upload.Close()
 
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
 			return
 		}
 
-		if t.Document == "" {
+		if t.Document == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Document in Payload"))
 			return
 		}
 
+		if t.FileName == "" && upload != nil {
+			t.FileName = upload.fileName
+		}
+
 		if t.FileName == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing FileName in Payload"))
 			return
@@ -755,8 +1096,18 @@ func (s *server) SendDocument() http.HandlerFunc {
 
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
+		mimeType := t.MimeType
 
-		if t.Document[0:29] == "data:application/octet-stream" {
+		if upload != nil {
+			uploaded, err = upload.Upload(clientManager.GetWhatsmeowClient(txtid), whatsmeow.MediaDocument)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
+				return
+			}
+			if mimeType == "" {
+				mimeType = upload.MimeType()
+			}
+		} else if strings.HasPrefix(t.Document, "data:application/octet-stream") {
 			var dataURL, err = dataurl.DecodeString(t.Document)
 			if err != nil {
 				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
@@ -780,30 +1131,18 @@ func (s *server) SendDocument() http.HandlerFunc {
 			DirectPath: proto.String(uploaded.DirectPath),
 			MediaKey:   uploaded.MediaKey,
 			Mimetype: proto.String(func() string {
-				if t.MimeType != "" {
-					return t.MimeType
+				if mimeType != "" {
+					return mimeType
 				}
 				return http.DetectContentType(filedata)
 			}()),
 			FileEncSHA256: uploaded.FileEncSHA256,
 			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
+			FileLength:    proto.Uint64(uploaded.FileLength),
 			Caption:       proto.String(t.Caption),
 		}}
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		setContextInfo(msg, replyContextInfo(s.db, txtid, &t.ContextInfo, t.QuotedText))
 
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
@@ -812,6 +1151,7 @@ func (s *server) SendDocument() http.HandlerFunc {
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -831,6 +1171,8 @@ func (s *server) SendAudio() http.HandlerFunc {
 		Audio       string
 		Caption     string
 		Id          string
+		PTT         *bool
+		QuotedText  string
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -845,20 +1187,20 @@ func (s *server) SendAudio() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t audioStruct
-		err := decoder.Decode(&t)
+		upload, err := decodeSendPayload(w, r, &t, mediaSizeLimit("audio"))
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.Respond(w, r, payloadErrorStatus(err), err)
 			return
 		}
+		defer upload.Close()
 
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
 			return
 		}
 
-		if t.Audio == "" {
+		if t.Audio == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Audio in Payload"))
 			return
 		}
@@ -876,28 +1218,49 @@ func (s *server) SendAudio() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Audio[0:14] == "data:audio/ogg" {
-			var dataURL, err = dataurl.DecodeString(t.Audio)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaAudio)
+		media := upload
+		if media == nil {
+			switch {
+			case strings.HasPrefix(t.Audio, "data:"):
+				dataURL, err := dataurl.DecodeString(t.Audio)
 				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
+					s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
+					return
+				}
+				media, err = spoolMedia(bytes.NewReader(dataURL.Data), mediaSizeLimit("audio"))
+				if err != nil {
+					s.Respond(w, r, payloadErrorStatus(err), err)
+					return
+				}
+			case isHTTPURL(t.Audio):
+				allowSlowTransfer(w)
+				media, err = fetchURLMedia(r.Context(), t.Audio, mediaSizeLimit("audio"))
+				if err != nil {
+					s.Respond(w, r, payloadErrorStatus(err), errors.New(fmt.Sprintf("failed to fetch audio from url: %v", err)))
 					return
 				}
+			default:
+				s.Respond(w, r, http.StatusBadRequest, errors.New("audio data should be a base64 data URL or an http(s) URL"))
+				return
 			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("audio data should start with \"data:audio/ogg;base64,\""))
+			defer media.Close()
+		}
+
+		// Sent as a voice note unless PTT is false
+		ptt := t.PTT == nil || *t.PTT
+		audio, info, err := prepareAudio(media, ptt)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		defer audio.Close()
+
+		uploaded, err := audio.Upload(clientManager.GetWhatsmeowClient(txtid), whatsmeow.MediaAudio)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
 			return
 		}
 
-		ptt := true
 		mime := "audio/ogg; codecs=opus"
 
 		msg := &waE2E.Message{AudioMessage: &waE2E.AudioMessage{
@@ -908,24 +1271,16 @@ func (s *server) SendAudio() http.HandlerFunc {
 			Mimetype:      &mime,
 			FileEncSHA256: uploaded.FileEncSHA256,
 			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
+			FileLength:    proto.Uint64(uploaded.FileLength),
 			PTT:           &ptt,
+			Waveform:      info.Waveform,
 		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		if info.Seconds > 0 {
+			msg.AudioMessage.Seconds = proto.Uint32(info.Seconds)
 		}
 
+		setContextInfo(msg, replyContextInfo(s.db, txtid, &t.ContextInfo, t.QuotedText))
+
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
@@ -933,6 +1288,7 @@ func (s *server) SendAudio() http.HandlerFunc {
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -953,6 +1309,7 @@ func (s *server) SendImage() http.HandlerFunc {
 		Caption     string
 		Id          string
 		MimeType    string
+		QuotedText  string
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -967,20 +1324,20 @@ func (s *server) SendImage() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t imageStruct
-		err := decoder.Decode(&t)
+		upload, err := decodeSendPayload(w, r, &t, mediaSizeLimit("image"))
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.Respond(w, r, payloadErrorStatus(err), err)
 			return
 		}
+		defer upload.Close()
 
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
 			return
 		}
 
-		if t.Image == "" {
+		if t.Image == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Image in Payload"))
 			return
 		}
@@ -1002,7 +1359,12 @@ func (s *server) SendImage() http.HandlerFunc {
 		var filedata []byte
 		var thumbnailBytes []byte
 
-		if len(t.Image) >= 10 && t.Image[0:10] == "data:image" {
+		if upload != nil {
+			if filedata, err = upload.Bytes(); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("could not read uploaded file: %v", err)))
+				return
+			}
+		} else if len(t.Image) >= 10 && t.Image[0:10] == "data:image" {
 			var dataURL, err = dataurl.DecodeString(t.Image)
 			if err != nil {
 				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
@@ -1011,7 +1373,7 @@ func (s *server) SendImage() http.HandlerFunc {
 				filedata = dataURL.Data
 			}
 		} else if isHTTPURL(t.Image) {
-			data, ct, err := fetchURLBytes(t.Image)
+			data, ct, err := fetchURLBytes(t.Image, mediaSizeLimit("image"))
 			if err != nil {
 				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("failed to fetch image from url: %v", err)))
 				return
@@ -1085,19 +1447,7 @@ func (s *server) SendImage() http.HandlerFunc {
 			JPEGThumbnail: thumbnailBytes,
 		}}
 
-		if t.ContextInfo.StanzaID != nil {
-			if msg.ImageMessage.ContextInfo == nil {
-				msg.ImageMessage.ContextInfo = &waE2E.ContextInfo{
-					StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-					Participant:   proto.String(*t.ContextInfo.Participant),
-					QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-				}
-			}
-		}
-
-		if t.ContextInfo.MentionedJID != nil {
-			msg.ImageMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		setContextInfo(msg, replyContextInfo(s.db, txtid, &t.ContextInfo, t.QuotedText))
 
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
@@ -1106,6 +1456,7 @@ func (s *server) SendImage() http.HandlerFunc {
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -1121,12 +1472,16 @@ func (s *server) SendImage() http.HandlerFunc {
 func (s *server) SendSticker() http.HandlerFunc {
 
 	type stickerStruct struct {
-		Phone        string
-		Sticker      string
-		Id           string
-		PngThumbnail []byte
-		MimeType     string
-		ContextInfo  waE2E.ContextInfo
+		Phone         string
+		Sticker       string
+		Id            string
+		PngThumbnail  []byte
+		PackId        string
+		PackName      string
+		PackPublisher string
+		Emojis        []string
+		QuotedText    string
+		ContextInfo   waE2E.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1140,20 +1495,20 @@ func (s *server) SendSticker() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t stickerStruct
-		err := decoder.Decode(&t)
+		upload, err := decodeSendPayload(w, r, &t, mediaSizeLimit("sticker"))
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.Respond(w, r, payloadErrorStatus(err), err)
 			return
 		}
+		defer upload.Close()
 
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
 			return
 		}
 
-		if t.Sticker == "" {
+		if t.Sticker == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sticker in Payload"))
 			return
 		}
@@ -1171,56 +1526,67 @@ func (s *server) SendSticker() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Sticker[0:4] == "data" {
-			var dataURL, err = dataurl.DecodeString(t.Sticker)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaImage)
+		media := upload
+		if media == nil {
+			switch {
+			case strings.HasPrefix(t.Sticker, "data"):
+				dataURL, err := dataurl.DecodeString(t.Sticker)
 				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+					s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
 					return
 				}
+				media, err = spoolMedia(bytes.NewReader(dataURL.Data), mediaSizeLimit("sticker"))
+				if err != nil {
+					s.Respond(w, r, payloadErrorStatus(err), err)
+					return
+				}
+			case isHTTPURL(t.Sticker):
+				media, err = fetchURLMedia(r.Context(), t.Sticker, mediaSizeLimit("sticker"))
+				if err != nil {
+					s.Respond(w, r, payloadErrorStatus(err), errors.New(fmt.Sprintf("failed to fetch sticker from url: %v", err)))
+					return
+				}
+			default:
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
+				return
 			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
+			defer media.Close()
+		}
+
+		meta := stickerMetadata{PackId: t.PackId, PackName: t.PackName, PackPublisher: t.PackPublisher, Emojis: t.Emojis}
+		if meta.PackName == "" {
+			meta.PackName = os.Getenv("STICKER_PACK_NAME")
+		}
+		if meta.PackPublisher == "" {
+			meta.PackPublisher = os.Getenv("STICKER_PACK_PUBLISHER")
+		}
+		filedata, info, err := prepareSticker(media, meta)
+		if err != nil {
+			s.Respond(w, r, payloadErrorStatus(err), err)
+			return
+		}
+
+		uploaded, err := clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaImage)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 			return
 		}
 
 		msg := &waE2E.Message{StickerMessage: &waE2E.StickerMessage{
-			URL:        proto.String(uploaded.URL),
-			DirectPath: proto.String(uploaded.DirectPath),
-			MediaKey:   uploaded.MediaKey,
-			Mimetype: proto.String(func() string {
-				if t.MimeType != "" {
-					return t.MimeType
-				}
-				return http.DetectContentType(filedata)
-			}()),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String("image/webp"),
 			FileEncSHA256: uploaded.FileEncSHA256,
 			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
+			FileLength:    proto.Uint64(uploaded.FileLength),
 			PngThumbnail:  t.PngThumbnail,
+			Width:         proto.Uint32(info.Width),
+			Height:        proto.Uint32(info.Height),
+			IsAnimated:    proto.Bool(info.Animated),
 		}}
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		setContextInfo(msg, replyContextInfo(s.db, txtid, &t.ContextInfo, t.QuotedText))
 
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
@@ -1229,6 +1595,7 @@ func (s *server) SendSticker() http.HandlerFunc {
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -1250,6 +1617,8 @@ func (s *server) SendVideo() http.HandlerFunc {
 		Id            string
 		JPEGThumbnail []byte
 		MimeType      string
+		Convert       *bool
+		QuotedText    string
 		ContextInfo   waE2E.ContextInfo
 	}
 
@@ -1264,20 +1633,20 @@ func (s *server) SendVideo() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t imageStruct
-		err := decoder.Decode(&t)
+		upload, err := decodeSendPayload(w, r, &t, mediaSizeLimit("video"))
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.Respond(w, r, payloadErrorStatus(err), err)
 			return
 		}
+		defer upload.Close()
 
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
 			return
 		}
 
-		if t.Video == "" {
+		if t.Video == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Video in Payload"))
 			return
 		}
@@ -1295,78 +1664,85 @@ func (s *server) SendVideo() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Video[0:4] == "data" {
-			var dataURL, err = dataurl.DecodeString(t.Video)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-
-			}
-		} else if isHTTPURL(t.Video) {
-			data, ct, err := fetchURLBytes(t.Video)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("failed to fetch image from url: %v", err)))
-				return
-			}
-			mimeType := ct
-			if !strings.HasPrefix(strings.ToLower(mimeType), "video/") {
-				mimeType = "video/mpeg"
-			}
-			imgDataURL := dataurl.New(data, mimeType)
-			parsed, err := dataurl.DecodeString(imgDataURL.String())
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("could not re-encode video to base64"))
+		media := upload
+		if media == nil {
+			switch {
+			case isHTTPURL(t.Video):
+				// Videos can be large, download them to disk instead of memory
+				allowSlowTransfer(w)
+				media, err = fetchURLMedia(r.Context(), t.Video, mediaSizeLimit("video"))
+				if err != nil {
+					s.Respond(w, r, payloadErrorStatus(err), errors.New(fmt.Sprintf("failed to fetch video from url: %v", err)))
+					return
+				}
+				if !strings.HasPrefix(strings.ToLower(media.mimeType), "video/") {
+					media.mimeType = ""
+				}
+			case strings.HasPrefix(t.Video, "data"):
+				dataURL, err := dataurl.DecodeString(t.Video)
+				if err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
+					return
+				}
+				media, err = spoolMedia(bytes.NewReader(dataURL.Data), mediaSizeLimit("video"))
+				if err != nil {
+					s.Respond(w, r, payloadErrorStatus(err), err)
+					return
+				}
+			default:
+				s.Respond(w, r, http.StatusBadRequest, errors.New("data should start with \"data:mime/type;base64,\""))
 				return
 			}
-			filedata = parsed.Data
+			defer media.Close()
+		}
 
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("data should start with \"data:mime/type;base64,\""))
+		convert := envBool("MEDIA_CONVERT_VIDEO", false)
+		if t.Convert != nil {
+			convert = *t.Convert
+		}
+		video, info, err := prepareVideo(media, convert)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		defer video.Close()
+
+		mimeType := t.MimeType
+		if video != media || mimeType == "" {
+			mimeType = video.MimeType()
+		}
+		thumbnail := t.JPEGThumbnail
+		if len(thumbnail) == 0 {
+			thumbnail = info.Thumbnail
+		}
 
-		uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaVideo)
+		uploaded, err := video.Upload(clientManager.GetWhatsmeowClient(txtid), whatsmeow.MediaVideo)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
 			return
 		}
 
 		msg := &waE2E.Message{VideoMessage: &waE2E.VideoMessage{
-			Caption:    proto.String(t.Caption),
-			URL:        proto.String(uploaded.URL),
-			DirectPath: proto.String(uploaded.DirectPath),
-			MediaKey:   uploaded.MediaKey,
-			Mimetype: proto.String(func() string {
-				if t.MimeType != "" {
-					return t.MimeType
-				}
-				return http.DetectContentType(filedata)
-			}()),
+			Caption:       proto.String(t.Caption),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimeType),
 			FileEncSHA256: uploaded.FileEncSHA256,
 			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JPEGThumbnail: t.JPEGThumbnail,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			JPEGThumbnail: thumbnail,
 		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-			}
+		if info.Seconds > 0 {
+			msg.VideoMessage.Seconds = proto.Uint32(info.Seconds)
 		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		if info.Width > 0 && info.Height > 0 {
+			msg.VideoMessage.Width = proto.Uint32(info.Width)
+			msg.VideoMessage.Height = proto.Uint32(info.Height)
 		}
 
+		setContextInfo(msg, replyContextInfo(s.db, txtid, &t.ContextInfo, t.QuotedText))
+
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
@@ -1374,6 +1750,7 @@ func (s *server) SendVideo() http.HandlerFunc {
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -1393,6 +1770,7 @@ func (s *server) SendContact() http.HandlerFunc {
 		Id          string
 		Name        string
 		Vcard       string
+		QuotedText  string
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -1446,19 +1824,7 @@ func (s *server) SendContact() http.HandlerFunc {
 			Vcard:       &t.Vcard,
 		}}
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		setContextInfo(msg, replyContextInfo(s.db, txtid, &t.ContextInfo, t.QuotedText))
 
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
@@ -1467,6 +1833,7 @@ func (s *server) SendContact() http.HandlerFunc {
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -1487,6 +1854,7 @@ func (s *server) SendLocation() http.HandlerFunc {
 		Name        string
 		Latitude    float64
 		Longitude   float64
+		QuotedText  string
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -1541,19 +1909,7 @@ func (s *server) SendLocation() http.HandlerFunc {
 			Name:             &t.Name,
 		}}
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		setContextInfo(msg, replyContextInfo(s.db, txtid, &t.ContextInfo, t.QuotedText))
 
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
@@ -1562,6 +1918,7 @@ func (s *server) SendLocation() http.HandlerFunc {
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -1655,17 +2012,20 @@ func (s *server) SendButtons() http.HandlerFunc {
 			Buttons:     buttons,
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
+		msg := &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
 			Message: &waE2E.Message{
 				ButtonsMessage: msg2,
 			},
-		}}, whatsmeow.SendRequestExtra{ID: msgid})
+		}}
+
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -1812,6 +2172,8 @@ func (s *server) SendList() http.HandlerFunc {
 			return
 		}
 
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
+
 		response := map[string]interface{}{
 			"Details":   "Sent",
 			"Timestamp": resp.Timestamp,
@@ -1833,6 +2195,8 @@ func (s *server) SendMessage() http.HandlerFunc {
 		Phone       string
 		Body        string
 		Id          string
+		LinkPreview *LinkPreview
+		QuotedText  string
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -1884,20 +2248,9 @@ func (s *server) SendMessage() http.HandlerFunc {
 				Text: &t.Body,
 			},
 		}
+		preview := addLinkPreview(msg.ExtendedTextMessage, txtid, clientManager.GetWhatsmeowClient(txtid), t.LinkPreview)
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		setContextInfo(msg, replyContextInfo(s.db, txtid, &t.ContextInfo, t.QuotedText))
 
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
@@ -1906,7 +2259,11 @@ func (s *server) SendMessage() http.HandlerFunc {
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
+		if preview != nil {
+			response["LinkPreview"] = preview
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1920,10 +2277,12 @@ func (s *server) SendMessage() http.HandlerFunc {
 
 func (s *server) SendPoll() http.HandlerFunc {
 	type pollRequest struct {
-		Group   string   `json:"group"`   // The recipient's group id (120363313346913103@g.us)
-		Header  string   `json:"header"`  // The poll's headline text
-		Options []string `json:"options"` // The list of poll options
-		Id      string
+		Phone           string   `json:"phone"`           // The recipient's phone or chat JID
+		Group           string   `json:"group"`           // The recipient's group id (120363313346913103@g.us)
+		Header          string   `json:"header"`          // The poll's headline text
+		Options         []string `json:"options"`         // The list of poll options
+		SelectableCount *int     `json:"selectableCount"` // Options a voter can pick, 0 for any number
+		Id              string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1945,8 +2304,12 @@ func (s *server) SendPoll() http.HandlerFunc {
 			return
 		}
 
-		if req.Group == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Grouop in payload"))
+		// Group is kept from when polls could only be sent to groups
+		if req.Phone == "" {
+			req.Phone = req.Group
+		}
+		if req.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in payload"))
 			return
 		}
 
@@ -1960,19 +2323,28 @@ func (s *server) SendPoll() http.HandlerFunc {
 			return
 		}
 
+		selectable := 1
+		if req.SelectableCount != nil {
+			selectable = *req.SelectableCount
+		}
+		if selectable < 0 || selectable > len(req.Options) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("selectableCount must be between 0 and %d", len(req.Options))))
+			return
+		}
+
 		if req.Id == "" {
 			msgid = clientManager.GetWhatsmeowClient(txtid).GenerateMessageID()
 		} else {
 			msgid = req.Id
 		}
 
-		recipient, err := validateMessageFields(req.Group, nil, nil)
+		recipient, err := validateMessageFields(req.Phone, nil, nil)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		pollMessage := clientManager.GetWhatsmeowClient(txtid).BuildPollCreation(req.Header, req.Options, 1)
+		pollMessage := clientManager.GetWhatsmeowClient(txtid).BuildPollCreation(req.Header, req.Options, selectable)
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, pollMessage, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to send poll: %v", err)))
@@ -1980,6 +2352,7 @@ func (s *server) SendPoll() http.HandlerFunc {
 		}
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Poll sent")
+		storeOutgoingMessage(s.db, txtid, recipient, msgid, pollMessage, resp.Timestamp)
 
 		response := map[string]interface{}{"Details": "Poll sent successfully", "Id": msgid}
 		responseJson, err := json.Marshal(response)
@@ -1991,6 +2364,37 @@ func (s *server) SendPoll() http.HandlerFunc {
 	}
 }
 
+// Gets the votes received on a poll
+func (s *server) GetPollResults() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		pollID := r.URL.Query().Get("id")
+		if pollID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing id in query"))
+			return
+		}
+
+		results, err := getPollResults(s.db, txtid, pollID)
+		if err != nil {
+			if errors.Is(err, errPollNotFound) {
+				s.Respond(w, r, http.StatusNotFound, err)
+				return
+			}
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to get poll results")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get poll results"))
+			return
+		}
+
+		responseJson, err := json.Marshal(results)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
 // Delete message
 func (s *server) DeleteMessage() http.HandlerFunc {
 
@@ -2063,6 +2467,7 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 		Phone       string
 		Body        string
 		Id          string
+		QuotedText  string
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -2116,19 +2521,7 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 			},
 		}
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		setContextInfo(msg, replyContextInfo(s.db, txtid, &t.ContextInfo, t.QuotedText))
 
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, clientManager.GetWhatsmeowClient(txtid).BuildEdit(recipient, msgid, msg))
 		if err != nil {
@@ -2149,6 +2542,125 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 	}
 }
 
+// Forwards a stored message to one or more chats
+func (s *server) ForwardMessage() http.HandlerFunc {
+
+	type forwardStruct struct {
+		Id    string
+		Phone []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		client := clientManager.GetWhatsmeowClient(txtid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		var t forwardStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Id in Payload"))
+			return
+		}
+
+		if len(t.Phone) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			return
+		}
+
+		if len(t.Phone) > forwardMaxTargets {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("a message can be forwarded to at most %d chats at once", forwardMaxTargets)))
+			return
+		}
+
+		recipients := make([]types.JID, len(t.Phone))
+		for i, phone := range t.Phone {
+			recipient, ok := parseJID(phone)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("could not parse Phone %s", phone)))
+				return
+			}
+			recipients[i] = recipient
+		}
+
+		stored, err := getStoredMessage(s.db, txtid, t.Id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("message not found"))
+				return
+			}
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to get message")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get message"))
+			return
+		}
+
+		msg, err := forwardedMessage(stored)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		q, err := outboundQueues.Get(txtid)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to load rate limit settings")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load rate limit settings"))
+			return
+		}
+
+		results := make([]map[string]interface{}, 0, len(recipients))
+		failed := 0
+		var sendErr error
+		for i, recipient := range recipients {
+			// Each copy is a send of its own for the rate limit
+			if settings := q.Settings(); settings.Enabled {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(q.reserve() + settings.humanDelay()):
+				}
+			}
+
+			msgid := client.GenerateMessageID()
+			forward := proto.Clone(msg).(*waE2E.Message)
+			result := map[string]interface{}{"Phone": t.Phone[i]}
+			resp, err := client.SendMessage(context.Background(), recipient, forward, whatsmeow.SendRequestExtra{ID: msgid})
+			if err != nil {
+				log.Warn().Err(err).Str("id", t.Id).Str("to", recipient.String()).Msg("Failed to forward message")
+				result["Error"] = err.Error()
+				sendErr = err
+				failed++
+			} else {
+				log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message forwarded")
+				storeOutgoingMessage(s.db, txtid, recipient, msgid, forward, resp.Timestamp)
+				result["Id"] = msgid
+				result["Timestamp"] = resp.Timestamp.Unix()
+			}
+			results = append(results, result)
+		}
+
+		if failed == len(results) {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error forwarding message: %v", sendErr)))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Forwarded", "Results": results}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
 // Request History Sync
 func (s *server) RequestHistorySync() http.HandlerFunc {
 
@@ -3172,64 +3684,278 @@ func (s *server) MarkRead() http.HandlerFunc {
 	}
 }
 
-// List groups
-func (s *server) ListGroups() http.HandlerFunc {
-
-	type GroupCollection struct {
-		Groups []types.GroupInfo
-	}
+// Lists stored messages, optionally filtered by chat and text
+func (s *server) ListMessages() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		params := r.URL.Query()
 
-		if clientManager.GetWhatsmeowClient(txtid) == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
-			return
+		q := messageQuery{Limit: 50}
+
+		if chat := params.Get("chat"); chat != "" {
+			jid, ok := parseJID(chat)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse chat"))
+				return
+			}
+			q.Chat = jid.String()
 		}
+		q.Search = strings.TrimSpace(params.Get("search"))
 
-		resp, err := clientManager.GetWhatsmeowClient(txtid).GetJoinedGroups()
+		if v := params.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("limit must be a number between 1 and 500"))
+				return
+			}
+			q.Limit = limit
+		}
+		if v := params.Get("offset"); v != "" {
+			offset, err := strconv.Atoi(v)
+			if err != nil || offset < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("offset must be a positive number"))
+				return
+			}
+			q.Offset = offset
+		}
+		if v := params.Get("before"); v != "" {
+			before, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("before must be a unix timestamp"))
+				return
+			}
+			q.Before = before
+		}
 
+		messages, err := listStoredMessages(s.db, txtid, q)
 		if err != nil {
-			msg := fmt.Sprintf("failed to get group list: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to list messages")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list messages"))
 			return
 		}
 
-		gc := new(GroupCollection)
-		for _, info := range resp {
-			gc.Groups = append(gc.Groups, *info)
+		response := map[string]interface{}{
+			"messages": messages,
+			"limit":    q.Limit,
+			"offset":   q.Offset,
 		}
-
-		responseJson, err := json.Marshal(gc)
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Get group info
-func (s *server) GetGroupInfo() http.HandlerFunc {
-
-	type getGroupInfoStruct struct {
-		GroupJID string
-	}
+// Gets a stored message by ID, including its raw content
+func (s *server) GetMessage() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		messageID := mux.Vars(r)["id"]
 
-		if clientManager.GetWhatsmeowClient(txtid) == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+		stored, err := getStoredMessage(s.db, txtid, messageID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("message not found"))
+				return
+			}
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to get message")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get message"))
 			return
 		}
 
-		// Get GroupJID from query parameter
+		response := map[string]interface{}{"message": stored}
+		if stored.RawMessage != "" {
+			response["content"] = json.RawMessage(stored.RawMessage)
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the conversations of the session, latest first
+func (s *server) ListConversations() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		params := r.URL.Query()
+
+		limit, offset := 50, 0
+		if v := params.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("limit must be a number between 1 and 500"))
+				return
+			}
+			limit = n
+		}
+		if v := params.Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("offset must be a positive number"))
+				return
+			}
+			offset = n
+		}
+
+		conversations, err := listConversations(s.db, txtid, limit, offset)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to list conversations")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list conversations"))
+			return
+		}
+
+		response := map[string]interface{}{
+			"conversations": conversations,
+			"limit":         limit,
+			"offset":        offset,
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Asks the phone for the history of a chat back to a date
+func (s *server) BackfillHistory() http.HandlerFunc {
+	type backfillStruct struct {
+		Chat  string
+		Since json.RawMessage
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		mycli := clientManager.GetMyClient(txtid)
+		if mycli == nil || mycli.WAClient == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		var t backfillStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		chat, ok := parseJID(t.Chat)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Chat"))
+			return
+		}
+		if len(t.Since) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Since in Payload"))
+			return
+		}
+		since, err := parseBackfillSince(t.Since)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		started, oldest, err := mycli.startBackfill(chat, since)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				s.Respond(w, r, http.StatusNotFound, errors.New("no message of this chat is stored, the backfill starts from the oldest one"))
+			case errors.Is(err, errBackfillRunning):
+				s.Respond(w, r, http.StatusConflict, err)
+			default:
+				log.Error().Err(err).Str("userID", txtid).Str("chat", chat.String()).Msg("Failed to start history backfill")
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to request history: %v", err)))
+			}
+			return
+		}
+
+		details := "Backfill started"
+		if !started {
+			details = "History already stored back to Since"
+		}
+		response := map[string]interface{}{
+			"Details":         details,
+			"Chat":            chat.String(),
+			"Since":           since.Unix(),
+			"OldestMessageAt": oldest.Timestamp,
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// List groups
+func (s *server) ListGroups() http.HandlerFunc {
+
+	type GroupCollection struct {
+		Groups []types.GroupInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		resp, err := clientManager.GetWhatsmeowClient(txtid).GetJoinedGroups()
+
+		if err != nil {
+			msg := fmt.Sprintf("failed to get group list: %v", err)
+			log.Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+
+		gc := new(GroupCollection)
+		for _, info := range resp {
+			gc.Groups = append(gc.Groups, *info)
+		}
+
+		responseJson, err := json.Marshal(gc)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Get group info
+func (s *server) GetGroupInfo() http.HandlerFunc {
+
+	type getGroupInfoStruct struct {
+		GroupJID string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		// Get GroupJID from query parameter
 		groupJID := r.URL.Query().Get("groupJID")
 		if groupJID == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing groupJID parameter"))
@@ -4131,6 +4857,10 @@ func (s *server) ListUsers() http.HandlerFunc {
 		Expiration sql.NullInt64  `db:"expiration"`
 		ProxyURL   sql.NullString `db:"proxy_url"`
 		Events     string         `db:"events"`
+
+		DisconnectCount   int   `db:"disconnect_count"`
+		ReconnectFailures int   `db:"reconnect_failures"`
+		LastDisconnectAt  int64 `db:"last_disconnect_at"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -4141,11 +4871,11 @@ func (s *server) ListUsers() http.HandlerFunc {
 
 		if hasID {
 			// Fetch a single user
-			query = "SELECT id, name, token, webhook, jid, qrcode, connected, expiration, proxy_url, events FROM users WHERE id = $1"
+			query = "SELECT id, name, token, webhook, jid, qrcode, connected, expiration, proxy_url, events, disconnect_count, reconnect_failures, last_disconnect_at FROM users WHERE id = $1"
 			args = append(args, userID)
 		} else {
 			// Fetch all users
-			query = "SELECT id, name, token, webhook, jid, qrcode, connected, expiration, proxy_url, events FROM users"
+			query = "SELECT id, name, token, webhook, jid, qrcode, connected, expiration, proxy_url, events, disconnect_count, reconnect_failures, last_disconnect_at FROM users"
 		}
 
 		rows, err := s.db.Queryx(query, args...)
@@ -4188,6 +4918,12 @@ func (s *server) ListUsers() http.HandlerFunc {
 				"proxy_url":  user.ProxyURL.String,
 				"events":     user.Events,
 			}
+			// Lets admins spot sessions that keep flapping
+			userMap["connection_stats"] = map[string]interface{}{
+				"disconnect_count":   user.DisconnectCount,
+				"reconnect_failures": user.ReconnectFailures,
+				"last_disconnect_at": user.LastDisconnectAt,
+			}
 			// Add proxy_config
 			proxyURL := user.ProxyURL.String
 			userMap["proxy_config"] = map[string]interface{}{
@@ -4300,18 +5036,24 @@ func (s *server) AddUser() http.HandlerFunc {
 		}
 
 		// Validate events
-		eventList := strings.Split(user.Events, ",")
-		for _, event := range eventList {
-			event = strings.TrimSpace(event)
-			if event == "" {
-				continue // allow empty
-			}
-			if !Find(supportedEventTypes, event) {
+		if event := invalidEventType(user.Events); event != "" {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "invalid event type",
+				"success": false,
+				"details": "invalid event: " + event,
+			})
+			return
+		}
+
+		// Validate proxy
+		if user.ProxyConfig.ProxyURL != "" {
+			if _, err := parseProxyURL(user.ProxyConfig.ProxyURL); err != nil {
 				s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
 					"code":    http.StatusBadRequest,
-					"error":   "invalid event type",
+					"error":   "invalid proxy",
 					"success": false,
-					"details": "invalid event: " + event,
+					"details": err.Error(),
 				})
 				return
 			}
@@ -4395,84 +5137,79 @@ func (s *server) AddUser() http.HandlerFunc {
 	}
 }
 
-// Delete user
-func (s *server) DeleteUser() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-
-		// Get the user ID from the request URL
-		vars := mux.Vars(r)
-		userID := vars["id"]
-
-		// Delete the user from the database
-		result, err := s.db.Exec("DELETE FROM users WHERE id=$1", userID)
-		if err != nil {
-			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"code":    http.StatusInternalServerError,
-				"error":   "database error",
-				"success": false,
-			})
-			return
-		}
-
-		// Check if the user was deleted
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"code":    http.StatusInternalServerError,
-				"error":   "Failed to verify deletion",
-				"success": false,
-			})
-			return
+// invalidEventType returns the first unsupported event of a comma separated list
+func invalidEventType(events string) string {
+	for _, event := range strings.Split(events, ",") {
+		event = strings.TrimSpace(event)
+		if event == "" {
+			continue // allow empty
 		}
-		if rowsAffected == 0 {
-			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
-				"code":    http.StatusNotFound,
-				"error":   "user not found",
-				"success": false,
-				"details": fmt.Sprintf("No user found with ID: %s", userID),
-			})
-			return
+		if !Find(supportedEventTypes, event) {
+			return event
 		}
-		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
-			"code":    http.StatusOK,
-			"data":    map[string]string{"id": userID},
-			"success": true,
-			"details": "user deleted successfully",
-		})
 	}
+	return ""
 }
 
-// Delete user complete
-func (s *server) DeleteUserComplete() http.HandlerFunc {
+// Update user in place, only the fields present in the payload are changed
+func (s *server) UpdateUser() http.HandlerFunc {
+	type ProxyConfig struct {
+		Enabled  bool   `json:"enabled"`
+		ProxyURL string `json:"proxyURL"`
+	}
+	type storedUser struct {
+		Name          string `db:"name"`
+		Token         string `db:"token"`
+		Webhook       string `db:"webhook"`
+		Expiration    int64  `db:"expiration"`
+		Events        string `db:"events"`
+		ProxyURL      string `db:"proxy_url"`
+		S3Enabled     bool   `db:"s3_enabled"`
+		S3Endpoint    string `db:"s3_endpoint"`
+		S3Region      string `db:"s3_region"`
+		S3Bucket      string `db:"s3_bucket"`
+		S3AccessKey   string `db:"s3_access_key"`
+		S3SecretKey   string `db:"s3_secret_key"`
+		S3PathStyle   bool   `db:"s3_path_style"`
+		S3PublicURL   string `db:"s3_public_url"`
+		MediaDelivery string `db:"media_delivery"`
+		RetentionDays int    `db:"s3_retention_days"`
+		Notice        int    `db:"expiration_notice"`
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		vars := mux.Vars(r)
-		id := vars["id"]
+		id := mux.Vars(r)["id"]
 
-		// Validate ID
-		if id == "" {
+		var user struct {
+			Name        *string         `json:"name"`
+			Webhook     *string         `json:"webhook"`
+			Expiration  *int64          `json:"expiration"`
+			Events      *string         `json:"events"`
+			ProxyConfig *ProxyConfig    `json:"proxyConfig"`
+			S3Config    json.RawMessage `json:"s3Config"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
 			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
 				"code":    http.StatusBadRequest,
-				"error":   "missing ID",
+				"error":   "invalid request payload",
 				"success": false,
 			})
 			return
 		}
 
-		// Check if user exists
-		var exists bool
-		err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists)
-		if err != nil {
-			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"code":    http.StatusInternalServerError,
-				"error":   "database error",
-				"success": false,
-				"details": "problem checking user existence",
-			})
-			return
-		}
-		if !exists {
+		var current storedUser
+		err := s.db.Get(&current, `
+			SELECT name, token, COALESCE(webhook, '') AS webhook, COALESCE(expiration, 0) AS expiration,
+				COALESCE(events, '') AS events, COALESCE(proxy_url, '') AS proxy_url,
+				COALESCE(s3_enabled, FALSE) AS s3_enabled, COALESCE(s3_endpoint, '') AS s3_endpoint,
+				COALESCE(s3_region, '') AS s3_region, COALESCE(s3_bucket, '') AS s3_bucket,
+				COALESCE(s3_access_key, '') AS s3_access_key, COALESCE(s3_secret_key, '') AS s3_secret_key,
+				COALESCE(s3_path_style, TRUE) AS s3_path_style, COALESCE(s3_public_url, '') AS s3_public_url,
+				COALESCE(media_delivery, 'base64') AS media_delivery, COALESCE(s3_retention_days, 30) AS s3_retention_days,
+				expiration_notice
+			FROM users WHERE id = $1`, id)
+		if err == sql.ErrNoRows {
 			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
 				"code":    http.StatusNotFound,
 				"error":   "user not found",
@@ -4481,54 +5218,380 @@ func (s *server) DeleteUserComplete() http.HandlerFunc {
 			})
 			return
 		}
-
-		// Get user info before deletion
-		var uname, jid, token string
-		err = s.db.QueryRow("SELECT name, jid, token FROM users WHERE id = $1", id).Scan(&uname, &jid, &token)
-		if err != nil {
-			log.Error().Err(err).Str("id", id).Msg("problem retrieving user information")
-			// Continue anyway since we have the ID
-		}
-
-		// 1. Logout and disconnect instance
-		if client := clientManager.GetWhatsmeowClient(id); client != nil {
-			if client.IsConnected() {
-				log.Info().Str("id", id).Msg("Logging out user")
-				client.Logout(context.Background())
-			}
-			log.Info().Str("id", id).Msg("Disconnecting from WhatsApp")
-			client.Disconnect()
-		}
-
-		// 2. Remove from DB
-		_, err = s.db.Exec("DELETE FROM users WHERE id = $1", id)
 		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("admin DB error")
 			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"code":    http.StatusInternalServerError,
 				"error":   "database error",
 				"success": false,
-				"details": "failed to delete user from database",
 			})
 			return
 		}
 
-		// 3. Cleanup from memory
-		clientManager.DeleteWhatsmeowClient(id)
-		clientManager.DeleteMyClient(id)
-		clientManager.DeleteHTTPClient(id)
-		userinfocache.Delete(token)
-
-		// 4. Remove media files
-		userDirectory := filepath.Join(s.exPath, "files", id)
-		if stat, err := os.Stat(userDirectory); err == nil && stat.IsDir() {
-			log.Info().Str("dir", userDirectory).Msg("deleting media and history files from disk")
-			err = os.RemoveAll(userDirectory)
-			if err != nil {
-				log.Error().Err(err).Str("dir", userDirectory).Msg("error removing media directory")
+		// Apply the payload over the stored values
+		updated := current
+		if user.Name != nil {
+			updated.Name = *user.Name
+		}
+		if user.Webhook != nil {
+			updated.Webhook = *user.Webhook
+		}
+		if user.Expiration != nil {
+			updated.Expiration = *user.Expiration
+		}
+		if user.Events != nil {
+			updated.Events = *user.Events
+		}
+		if user.ProxyConfig != nil {
+			if user.ProxyConfig.Enabled {
+				updated.ProxyURL = user.ProxyConfig.ProxyURL
+			} else {
+				updated.ProxyURL = ""
 			}
 		}
-
-		// 5. Remove files from S3 (if enabled)
+		s3Config := S3Config{
+			Enabled:       current.S3Enabled,
+			Endpoint:      current.S3Endpoint,
+			Region:        current.S3Region,
+			Bucket:        current.S3Bucket,
+			AccessKey:     current.S3AccessKey,
+			SecretKey:     current.S3SecretKey,
+			PathStyle:     current.S3PathStyle,
+			PublicURL:     current.S3PublicURL,
+			MediaDelivery: current.MediaDelivery,
+			RetentionDays: current.RetentionDays,
+		}
+		if len(user.S3Config) > 0 {
+			// Decoding over the stored config keeps the fields that were not sent
+			if err := json.Unmarshal(user.S3Config, &s3Config); err != nil {
+				s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"code":    http.StatusBadRequest,
+					"error":   "invalid s3Config",
+					"success": false,
+					"details": err.Error(),
+				})
+				return
+			}
+		}
+
+		// Validate like AddUser
+		if updated.Name == "" {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "missing name",
+				"success": false,
+			})
+			return
+		}
+		if updated.Expiration < 0 {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "invalid expiration",
+				"success": false,
+			})
+			return
+		}
+		if event := invalidEventType(updated.Events); event != "" {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "invalid event type",
+				"success": false,
+				"details": "invalid event: " + event,
+			})
+			return
+		}
+		if updated.ProxyURL != "" {
+			if _, err := parseProxyURL(updated.ProxyURL); err != nil {
+				s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"code":    http.StatusBadRequest,
+					"error":   "invalid proxy",
+					"success": false,
+					"details": err.Error(),
+				})
+				return
+			}
+		}
+		if s3Config.MediaDelivery == "" {
+			s3Config.MediaDelivery = "base64"
+		}
+		if s3Config.MediaDelivery != "base64" && s3Config.MediaDelivery != "s3" && s3Config.MediaDelivery != "both" {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "invalid s3Config",
+				"success": false,
+				"details": "mediaDelivery must be 'base64', 's3', or 'both'",
+			})
+			return
+		}
+
+		// A new expiration gets its own expiry notices
+		if updated.Expiration != current.Expiration {
+			updated.Notice = expirationNoticeNone
+		}
+		if _, err := s.db.Exec(`
+			UPDATE users SET name=$1, webhook=$2, expiration=$3, events=$4, proxy_url=$5,
+				s3_enabled=$6, s3_endpoint=$7, s3_region=$8, s3_bucket=$9, s3_access_key=$10, s3_secret_key=$11,
+				s3_path_style=$12, s3_public_url=$13, media_delivery=$14, s3_retention_days=$15,
+				expiration_notice=$16
+			WHERE id=$17`,
+			updated.Name, updated.Webhook, updated.Expiration, updated.Events, updated.ProxyURL,
+			s3Config.Enabled, s3Config.Endpoint, s3Config.Region, s3Config.Bucket, s3Config.AccessKey, s3Config.SecretKey,
+			s3Config.PathStyle, s3Config.PublicURL, s3Config.MediaDelivery, s3Config.RetentionDays, updated.Notice, id,
+		); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("admin DB error")
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "database error",
+				"success": false,
+			})
+			return
+		}
+
+		// Refresh the running session so the changes apply without a reconnect
+		if myuserinfo, found := userinfocache.Get(current.Token); found {
+			v := updateUserInfo(myuserinfo, "Name", updated.Name)
+			v = updateUserInfo(v, "Webhook", updated.Webhook)
+			v = updateUserInfo(v, "Events", updated.Events)
+			v = updateUserInfo(v, "Proxy", updated.ProxyURL)
+			v = updateUserInfo(v, "Expiration", strconv.FormatInt(updated.Expiration, 10))
+			v = updateUserInfo(v, "S3Enabled", strconv.FormatBool(s3Config.Enabled))
+			v = updateUserInfo(v, "MediaDelivery", s3Config.MediaDelivery)
+			userinfocache.Set(current.Token, v, cache.NoExpiration)
+		}
+		if updated.Events != current.Events {
+			subscriptions := []string{}
+			for _, event := range strings.Split(updated.Events, ",") {
+				if event = strings.TrimSpace(event); event != "" {
+					subscriptions = append(subscriptions, event)
+				}
+			}
+			clientManager.UpdateMyClientSubscriptions(id, subscriptions)
+		}
+		if updated.ProxyURL != current.ProxyURL {
+			// Media and webhook calls switch right away, the websocket on its next connect
+			if client := clientManager.GetWhatsmeowClient(id); client != nil {
+				if err := client.SetProxyAddress(updated.ProxyURL); err != nil {
+					log.Warn().Err(err).Str("id", id).Msg("Could not apply proxy to running client")
+				}
+			}
+			if httpClient := clientManager.GetHTTPClient(id); httpClient != nil {
+				if updated.ProxyURL != "" {
+					httpClient.SetProxy(updated.ProxyURL)
+				} else {
+					httpClient.RemoveProxy()
+				}
+			}
+		}
+		if s3Config.Enabled {
+			if err := GetS3Manager().InitializeS3Client(id, &s3Config); err != nil {
+				log.Error().Err(err).Str("id", id).Msg("Failed to initialize S3 client")
+			}
+		} else {
+			GetS3Manager().RemoveClient(id)
+		}
+
+		userMap := map[string]interface{}{
+			"id":         id,
+			"name":       updated.Name,
+			"token":      current.Token,
+			"webhook":    updated.Webhook,
+			"expiration": updated.Expiration,
+			"events":     updated.Events,
+			"proxy_config": map[string]interface{}{
+				"enabled":   updated.ProxyURL != "",
+				"proxy_url": updated.ProxyURL,
+			},
+			"s3_config": map[string]interface{}{
+				"enabled":        s3Config.Enabled,
+				"endpoint":       s3Config.Endpoint,
+				"region":         s3Config.Region,
+				"bucket":         s3Config.Bucket,
+				"access_key":     "***",
+				"path_style":     s3Config.PathStyle,
+				"public_url":     s3Config.PublicURL,
+				"media_delivery": s3Config.MediaDelivery,
+				"retention_days": s3Config.RetentionDays,
+			},
+		}
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    userMap,
+			"success": true,
+		})
+	}
+}
+
+// Delete user
+func (s *server) DeleteUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Get the user ID from the request URL
+		vars := mux.Vars(r)
+		userID := vars["id"]
+
+		// Delete the user from the database
+		result, err := s.db.Exec("DELETE FROM users WHERE id=$1", userID)
+		if err != nil {
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "database error",
+				"success": false,
+			})
+			return
+		}
+
+		// Check if the user was deleted
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "Failed to verify deletion",
+				"success": false,
+			})
+			return
+		}
+		if rowsAffected == 0 {
+			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
+				"code":    http.StatusNotFound,
+				"error":   "user not found",
+				"success": false,
+				"details": fmt.Sprintf("No user found with ID: %s", userID),
+			})
+			return
+		}
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    map[string]string{"id": userID},
+			"success": true,
+			"details": "user deleted successfully",
+		})
+	}
+}
+
+// Delete user complete
+func (s *server) DeleteUserComplete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		// Validate ID
+		if id == "" {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "missing ID",
+				"success": false,
+			})
+			return
+		}
+
+		// Check if user exists
+		var exists bool
+		err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists)
+		if err != nil {
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "database error",
+				"success": false,
+				"details": "problem checking user existence",
+			})
+			return
+		}
+		if !exists {
+			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
+				"code":    http.StatusNotFound,
+				"error":   "user not found",
+				"success": false,
+				"details": fmt.Sprintf("No user found with ID: %s", id),
+			})
+			return
+		}
+
+		// Get user info before deletion
+		var uname, jid, token string
+		err = s.db.QueryRow("SELECT name, jid, token FROM users WHERE id = $1", id).Scan(&uname, &jid, &token)
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("problem retrieving user information")
+			// Continue anyway since we have the ID
+		}
+
+		// 1. Logout and disconnect instance
+		if client := clientManager.GetWhatsmeowClient(id); client != nil {
+			if client.IsConnected() {
+				log.Info().Str("id", id).Msg("Logging out user")
+				client.Logout(context.Background())
+			}
+			log.Info().Str("id", id).Msg("Disconnecting from WhatsApp")
+			client.Disconnect()
+		}
+		if session := clientManager.StopSession(id, "user deleted"); session != nil {
+			session.Wait(10 * time.Second)
+		}
+
+		// 2. Remove from DB
+		_, err = s.db.Exec("DELETE FROM users WHERE id = $1", id)
+		if err != nil {
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "database error",
+				"success": false,
+				"details": "failed to delete user from database",
+			})
+			return
+		}
+		if _, err := s.db.Exec("DELETE FROM webhooks WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing webhook endpoints")
+		}
+		if _, err := s.db.Exec("DELETE FROM webhook_outbox WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing pending webhook deliveries")
+		}
+		if _, err := s.db.Exec("DELETE FROM webhook_dead_letters WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing webhook dead letters")
+		}
+		bulkSender.StopUser(id)
+		if _, err := s.db.Exec("DELETE FROM bulk_job_recipients WHERE job_id IN (SELECT id FROM bulk_jobs WHERE user_id = $1)", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing bulk job recipients")
+		}
+		if _, err := s.db.Exec("DELETE FROM bulk_jobs WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing bulk jobs")
+		}
+		if _, err := s.db.Exec("DELETE FROM scheduled_messages WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing scheduled messages")
+		}
+		if _, err := s.db.Exec("DELETE FROM poll_votes WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing poll votes")
+		}
+		if _, err := s.db.Exec("DELETE FROM call_log WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing call log")
+		}
+		if _, err := s.db.Exec("DELETE FROM conversations WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing conversations")
+		}
+		if _, err := s.db.Exec("DELETE FROM messages WHERE user_id = $1", id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("error removing messages")
+		}
+
+		// 3. Cleanup from memory
+		clientManager.DeleteWhatsmeowClient(id)
+		clientManager.DeleteMyClient(id)
+		clientManager.DeleteHTTPClient(id)
+		clientManager.DeleteSession(id)
+		outboundQueues.Delete(id)
+		userinfocache.Delete(token)
+		webhookEndpointCache.Delete(id)
+
+		// 4. Remove media files
+		userDirectory := filepath.Join(s.exPath, "files", id)
+		if stat, err := os.Stat(userDirectory); err == nil && stat.IsDir() {
+			log.Info().Str("dir", userDirectory).Msg("deleting media and history files from disk")
+			err = os.RemoveAll(userDirectory)
+			if err != nil {
+				log.Error().Err(err).Str("dir", userDirectory).Msg("error removing media directory")
+			}
+		}
+
+		// 5. Remove files from S3 (if enabled)
 		var s3Enabled bool
 		err = s.db.QueryRow("SELECT s3_enabled FROM users WHERE id = $1", id).Scan(&s3Enabled)
 		if err == nil && s3Enabled {
@@ -4542,18 +5605,778 @@ func (s *server) DeleteUserComplete() http.HandlerFunc {
 			}
 		}
 
-		log.Info().Str("id", id).Str("name", uname).Str("jid", jid).Msg("user deleted successfully")
+		log.Info().Str("id", id).Str("name", uname).Str("jid", jid).Msg("user deleted successfully")
+
+		// Success response
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code": http.StatusOK,
+			"data": map[string]interface{}{
+				"id":   id,
+				"name": uname,
+				"jid":  jid,
+			},
+			"success": true,
+			"details": "user instance removed completely",
+		})
+	}
+}
+
+// List webhook deliveries that exhausted their retries
+func (s *server) ListWebhookDeadLetters() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := "SELECT " + webhookDeliveryColumns + ", failed_at FROM webhook_dead_letters"
+		var args []interface{}
+		if userID := r.URL.Query().Get("user_id"); userID != "" {
+			query += " WHERE user_id = $1"
+			args = append(args, userID)
+		}
+		query += " ORDER BY failed_at DESC"
+
+		deadLetters := []webhookDeadLetter{}
+		if err := s.db.Select(&deadLetters, query, args...); err != nil {
+			log.Error().Err(err).Msg("Failed to list webhook dead letters")
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "database error",
+				"success": false,
+			})
+			return
+		}
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    deadLetters,
+			"success": true,
+		})
+	}
+}
+
+// Put a dead lettered webhook delivery back in the outbox
+func (s *server) RetryWebhookDeadLetter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := mux.Vars(r)["id"]
+		err := webhookQueue.Requeue(id)
+		if errors.Is(err, errDeadLetterNotFound) {
+			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
+				"code":    http.StatusNotFound,
+				"error":   "dead letter not found",
+				"success": false,
+				"details": fmt.Sprintf("No dead letter found with ID: %s", id),
+			})
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to requeue webhook dead letter")
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "database error",
+				"success": false,
+			})
+			return
+		}
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    map[string]string{"id": id},
+			"success": true,
+			"details": "webhook delivery queued for retry",
+		})
+	}
+}
+
+// Discard a dead lettered webhook delivery
+func (s *server) DeleteWebhookDeadLetter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := mux.Vars(r)["id"]
+		result, err := s.db.Exec("DELETE FROM webhook_dead_letters WHERE id=$1", id)
+		if err != nil {
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "database error",
+				"success": false,
+			})
+			return
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
+				"code":    http.StatusNotFound,
+				"error":   "dead letter not found",
+				"success": false,
+				"details": fmt.Sprintf("No dead letter found with ID: %s", id),
+			})
+			return
+		}
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    map[string]string{"id": id},
+			"success": true,
+			"details": "dead letter deleted successfully",
+		})
+	}
+}
+
+// Gets the outbound rate limit settings of the session
+func (s *server) GetRateLimit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		q, err := outboundQueues.Get(txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load rate limit settings"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"settings": q.Settings(), "queued": q.Len()})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sets the outbound rate limit settings of the session, fields not sent are kept
+func (s *server) SetRateLimit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		q, err := outboundQueues.Get(txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load rate limit settings"))
+			return
+		}
+		settings := q.Settings()
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		if err := settings.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		_, err = s.db.Exec(`UPDATE users SET ratelimit_enabled=$1, ratelimit_per_minute=$2, ratelimit_burst=$3,
+			ratelimit_min_delay_ms=$4, ratelimit_max_delay_ms=$5, ratelimit_typing=$6 WHERE id=$7`,
+			settings.Enabled, settings.PerMinute, settings.Burst, settings.MinDelayMs, settings.MaxDelayMs, settings.Typing, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save rate limit settings"))
+			return
+		}
+		q.SetSettings(settings)
+
+		responseJson, err := json.Marshal(map[string]interface{}{"settings": settings, "queued": q.Len()})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the call policy of the session
+func (s *server) GetCallSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		settings, err := getCallSettings(s.db, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load call settings"))
+			return
+		}
+
+		responseJson, err := json.Marshal(settings)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sets the call policy of the session, fields not sent are kept
+func (s *server) SetCallSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		settings, err := getCallSettings(s.db, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load call settings"))
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		if err := settings.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		_, err = s.db.Exec("UPDATE users SET call_policy=$1, call_reject_message=$2 WHERE id=$3", settings.Policy, settings.Message, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save call settings"))
+			return
+		}
+
+		responseJson, err := json.Marshal(settings)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Rejects an incoming call
+func (s *server) RejectCall() http.HandlerFunc {
+	type rejectCallStruct struct {
+		CallId string
+		From   string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		client := clientManager.GetWhatsmeowClient(txtid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		var t rejectCallStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		if t.CallId == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing CallId in Payload"))
+			return
+		}
+
+		// The caller is in the call log unless the call came before it was kept
+		if t.From == "" {
+			entry, err := getCallLogEntry(s.db, txtid, t.CallId)
+			if err != nil {
+				if errors.Is(err, errCallNotFound) {
+					s.Respond(w, r, http.StatusNotFound, errors.New("call not found, From is required"))
+				} else {
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load call"))
+				}
+				return
+			}
+			t.From = entry.From
+		}
+		from, ok := parseJID(t.From)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse From"))
+			return
+		}
+
+		if err := client.RejectCall(from, t.CallId); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to reject call: %v", err)))
+			return
+		}
+		if err := setCallStatus(s.db, txtid, t.CallId, callRejected, "api"); err != nil {
+			log.Error().Err(err).Str("call", t.CallId).Msg("Failed to update call log")
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"Details": "Call rejected", "CallId": t.CallId})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the calls received by the session, latest first
+func (s *server) ListCallLog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		params := r.URL.Query()
+		status := params.Get("status")
+		switch status {
+		case "", callRinging, callAccepted, callRejected, callMissed, callEnded:
+		default:
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid status"))
+			return
+		}
+		limit := 50
+		if v := params.Get("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("limit must be a number between 1 and 500"))
+				return
+			}
+		}
+
+		calls, err := listCallLog(s.db, txtid, status, limit)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to list calls")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list calls"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"calls": calls})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists scheduled messages, optionally filtered by status
+func (s *server) ListScheduledMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "", scheduledPending, scheduledSending, scheduledSent, scheduledFailed, scheduledCancelled:
+		default:
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid status"))
+			return
+		}
+
+		messages, err := listScheduledMessages(s.db, txtid, status)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to list scheduled messages")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list scheduled messages"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"scheduled": messages})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Moves a pending scheduled message to a new time
+func (s *server) RescheduleMessage() http.HandlerFunc {
+	type rescheduleStruct struct {
+		SendAt       json.RawMessage
+		DelaySeconds json.RawMessage
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		var t rescheduleStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		at, ok, err := parseSchedule(t.SendAt, t.DelaySeconds)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing SendAt or DelaySeconds in Payload"))
+			return
+		}
+
+		err = rescheduleMessage(s.db, txtid, id, at)
+		if errors.Is(err, errScheduledNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, errScheduledNotPending) {
+			s.Respond(w, r, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to reschedule message"))
+			return
+		}
+		messageScheduler.Wake()
+
+		responseJson, err := json.Marshal(map[string]interface{}{"Details": "Rescheduled", "Id": id, "SendAt": at.Unix()})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Cancels a pending scheduled message
+func (s *server) CancelScheduledMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		err := cancelScheduledMessage(s.db, txtid, id)
+		if errors.Is(err, errScheduledNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, errScheduledNotPending) {
+			s.Respond(w, r, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to cancel scheduled message"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"Details": "Cancelled", "Id": id})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sends one message template to many recipients as a background job
+func (s *server) SendBulk() http.HandlerFunc {
+	type bulkRecipientStruct struct {
+		Phone     string
+		Variables map[string]string
+	}
+	type bulkStruct struct {
+		Type       string
+		Message    json.RawMessage
+		Recipients []bulkRecipientStruct
+		SkipCheck  bool
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		var t bulkStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		t.Type = strings.ToLower(t.Type)
+		if t.Type == "" {
+			t.Type = "text"
+		}
+		if _, ok := bulkMessageTypes[t.Type]; !ok {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("unsupported Type %s", t.Type))
+			return
+		}
+		template := map[string]interface{}{}
+		if err := json.Unmarshal(t.Message, &template); err != nil || len(template) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Message in Payload"))
+			return
+		}
+		// Set per recipient, or not supported for bulk sends
+		for key := range template {
+			switch strings.ToLower(key) {
+			case "phone", "id", "sendat", "delayseconds":
+				delete(template, key)
+			}
+		}
+
+		maxRecipients := envInt("BULK_MAX_RECIPIENTS", 10000)
+		if len(t.Recipients) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Recipients in Payload"))
+			return
+		}
+		if len(t.Recipients) > maxRecipients {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("too many Recipients, the limit is %d", maxRecipients))
+			return
+		}
+		for i, rc := range t.Recipients {
+			if digitsOnly(rc.Phone) == "" {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("recipient %d has no Phone", i))
+				return
+			}
+			if _, err := renderTemplate(template, recipientVariables(rc.Phone, rc.Variables)); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("recipient %d: %s", i, err))
+				return
+			}
+		}
+
+		templateJson, err := json.Marshal(template)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		id, err := GenerateRandomID()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		tx, err := s.db.Beginx()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to create bulk job"))
+			return
+		}
+		defer tx.Rollback()
+		_, err = tx.Exec("INSERT INTO bulk_jobs ("+bulkJobColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			id, txtid, t.Type, string(templateJson), !t.SkipCheck, bulkRunning, time.Now().Unix(), 0)
+		seen := map[string]bool{}
+		skipped := 0
+		for i := 0; err == nil && i < len(t.Recipients); i++ {
+			rc := t.Recipients[i]
+			status, errorText := recipientPending, ""
+			if seen[digitsOnly(rc.Phone)] {
+				status, errorText = recipientSkipped, "duplicate recipient"
+				skipped++
+			}
+			seen[digitsOnly(rc.Phone)] = true
+			variables, _ := json.Marshal(rc.Variables)
+			_, err = tx.Exec("INSERT INTO bulk_job_recipients ("+bulkRecipientColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+				id, i, rc.Phone, "", string(variables), status, "", errorText, 0)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to store bulk job")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to create bulk job"))
+			return
+		}
+		bulkSender.Start(id, txtid)
+		log.Info().Str("id", id).Str("type", t.Type).Int("recipients", len(t.Recipients)).Msg("Bulk job created")
+
+		response := map[string]interface{}{"Details": "Bulk job created", "Id": id, "Total": len(t.Recipients), "Skipped": skipped}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the bulk jobs of the user with their progress
+func (s *server) ListBulkJobs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		jobs, err := listBulkJobs(s.db, txtid)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to list bulk jobs")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list bulk jobs"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"jobs": jobs})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets a bulk job, with the report of its recipients when asked for
+func (s *server) GetBulkJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		job, err := getBulkJob(s.db, txtid, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errBulkJobNotFound)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to get bulk job")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get bulk job"))
+			return
+		}
+		response := map[string]interface{}{"job": job}
+
+		if r.URL.Query().Get("recipients") == "true" {
+			status := r.URL.Query().Get("status")
+			switch status {
+			case "", recipientPending, recipientSending, recipientSent, recipientFailed, recipientSkipped, recipientCancelled:
+			default:
+				s.Respond(w, r, http.StatusBadRequest, errors.New("invalid status"))
+				return
+			}
+			recipients, err := listBulkRecipients(s.db, id, status)
+			if err != nil {
+				log.Error().Err(err).Str("id", id).Msg("Failed to list bulk job recipients")
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list bulk job recipients"))
+				return
+			}
+			response["recipients"] = recipients
+		}
+
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Pauses, resumes or cancels a bulk job
+func (s *server) ControlBulkJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+		action := mux.Vars(r)["action"]
+
+		var err error
+		var details string
+		switch action {
+		case "pause":
+			details = "Paused"
+			if err = setBulkJobStatus(s.db, txtid, id, bulkPaused, bulkRunning); err == nil {
+				bulkSender.Stop(id)
+			}
+		case "resume":
+			details = "Resumed"
+			if err = setBulkJobStatus(s.db, txtid, id, bulkRunning, bulkPaused); err == nil {
+				bulkSender.Start(id, txtid)
+			}
+		case "cancel":
+			details = "Cancelled"
+			if err = setBulkJobStatus(s.db, txtid, id, bulkCancelled, bulkRunning, bulkPaused); err == nil {
+				bulkSender.Stop(id)
+				_, err = s.db.Exec("UPDATE bulk_job_recipients SET status=$1 WHERE job_id=$2 AND status=$3", recipientCancelled, id, recipientPending)
+			}
+		}
+		if errors.Is(err, errBulkJobNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, errBulkJobState) {
+			s.Respond(w, r, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Str("action", action).Msg("Failed to update bulk job")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to update bulk job"))
+			return
+		}
+
+		job, err := getBulkJob(s.db, txtid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get bulk job"))
+			return
+		}
+		if action == "cancel" {
+			token := r.Context().Value("userinfo").(Values).Get("Token")
+			sendEventWithWebHook(userEventClient(s, txtid, token), map[string]interface{}{
+				"type": "BulkJobCancelled",
+				"event": map[string]interface{}{
+					"id":       id,
+					"progress": job.Progress,
+				},
+			}, "")
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"Details": details, "Id": id, "Status": job.Status, "Progress": job.Progress})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Set, extend or remove the expiration of a user
+func (s *server) SetUserExpiration() http.HandlerFunc {
+	type expirationStruct struct {
+		Expiration *int64 `json:"expiration"`
+		ExtendDays int    `json:"extendDays"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := mux.Vars(r)["id"]
+		var t expirationStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "invalid request payload",
+				"success": false,
+			})
+			return
+		}
+		if (t.Expiration == nil) == (t.ExtendDays == 0) {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "missing expiration",
+				"success": false,
+				"details": "send either expiration (unix seconds, 0 to never expire) or extendDays",
+			})
+			return
+		}
+
+		var current sql.NullInt64
+		err := s.db.Get(&current, "SELECT expiration FROM users WHERE id=$1", id)
+		if err == sql.ErrNoRows {
+			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
+				"code":    http.StatusNotFound,
+				"error":   "user not found",
+				"success": false,
+				"details": fmt.Sprintf("No user found with ID: %s", id),
+			})
+			return
+		}
+		if err != nil {
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "database error",
+				"success": false,
+			})
+			return
+		}
+
+		var expiration int64
+		if t.Expiration != nil {
+			expiration = *t.Expiration
+		} else {
+			// Renewals of expired users start from now, not from the old date
+			from := time.Now().Unix()
+			if current.Int64 > from {
+				from = current.Int64
+			}
+			expiration = from + int64(t.ExtendDays)*24*60*60
+		}
+		if expiration < 0 {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "invalid expiration",
+				"success": false,
+			})
+			return
+		}
+
+		if err := setUserExpiration(s.db, id, expiration); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to update user expiration")
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "database error",
+				"success": false,
+			})
+			return
+		}
 
-		// Success response
 		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
-			"code": http.StatusOK,
-			"data": map[string]interface{}{
-				"id":   id,
-				"name": uname,
-				"jid":  jid,
-			},
+			"code":    http.StatusOK,
+			"data":    map[string]interface{}{"id": id, "expiration": expiration},
 			"success": true,
-			"details": "user instance removed completely",
+			"details": "expiration updated successfully",
 		})
 	}
 }
@@ -4621,6 +6444,7 @@ func (s *server) SetProxy() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		token := r.Context().Value("userinfo").(Values).Get("Token")
 
 		// Check if client exists and is connected
 
@@ -4644,6 +6468,8 @@ func (s *server) SetProxy() http.HandlerFunc {
 				s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to remove proxy configuration"))
 				return
 			}
+			v := updateUserInfo(r.Context().Value("userinfo"), "Proxy", "")
+			userinfocache.Set(token, v, cache.NoExpiration)
 
 			response := map[string]interface{}{"Details": "Proxy disabled successfully"}
 			responseJson, err := json.Marshal(response)
@@ -4661,15 +6487,9 @@ func (s *server) SetProxy() http.HandlerFunc {
 			return
 		}
 
-		proxyURL, err := url.Parse(t.ProxyURL)
+		proxyURL, err := parseProxyURL(t.ProxyURL)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid proxy URL format"))
-			return
-		}
-
-		// Only allow http and socks5 proxies
-		if proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("only HTTP and SOCKS5 proxies are supported"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
@@ -4679,10 +6499,77 @@ func (s *server) SetProxy() http.HandlerFunc {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save proxy configuration"))
 			return
 		}
+		v := updateUserInfo(r.Context().Value("userinfo"), "Proxy", t.ProxyURL)
+		userinfocache.Set(token, v, cache.NoExpiration)
 
 		response := map[string]interface{}{
 			"Details":  "Proxy configured successfully",
-			"ProxyURL": t.ProxyURL,
+			"ProxyURL": proxyURL.Redacted(),
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Tests the session proxy, or the one sent in the payload, reporting exit IP and latency
+func (s *server) TestProxy() http.HandlerFunc {
+	type proxyTestStruct struct {
+		ProxyURL string `json:"proxy_url"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var t proxyTestStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+				return
+			}
+		}
+
+		// Proxies sent in the payload could point the server at internal
+		// hosts, only the configured one may be on a private address
+		publicOnly := t.ProxyURL != ""
+		if t.ProxyURL == "" {
+			var stored sql.NullString
+			if err := s.db.Get(&stored, "SELECT proxy_url FROM users WHERE id = $1", txtid); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load proxy configuration"))
+				return
+			}
+			t.ProxyURL = stored.String
+		}
+		if t.ProxyURL == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("no proxy configured"))
+			return
+		}
+
+		proxyURL, err := parseProxyURL(t.ProxyURL)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		ip, latency, err := checkProxy(proxyURL, publicOnly)
+		if errors.Is(err, errPrivateAddress) {
+			s.Respond(w, r, http.StatusBadRequest, errPrivateAddress)
+			return
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("userid", txtid).Msg("Proxy test failed")
+			s.Respond(w, r, http.StatusBadGateway, errors.New(fmt.Sprintf("proxy test failed: %v", err)))
+			return
+		}
+
+		response := map[string]interface{}{
+			"Details":   "Proxy is working",
+			"ProxyURL":  proxyURL.Redacted(),
+			"IP":        ip,
+			"LatencyMs": latency.Milliseconds(),
 		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waCompanionReg"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Messages asked for in each on-demand request, the amount WhatsApp recommends
+	backfillPageSize = 50
+	// A backfill stops after this many requests, 5000 messages
+	backfillMaxRequests = 100
+)
+
+// Backfills nobody answered are dropped after this long
+const backfillTimeout = 10 * time.Minute
+
+var errBackfillRunning = errors.New("a backfill of this chat is already running")
+
+// historyBackfills holds the running backfills by user and chat
+var historyBackfills = newBackfillCache()
+
+func newBackfillCache() *cache.Cache {
+	c := cache.New(backfillTimeout, time.Minute)
+	c.OnEvicted(backfillEvicted)
+	return c
+}
+
+// Conversation is a chat of the session, from the history sync or from
+// messages sent and received since
+type Conversation struct {
+	ChatJID         string `db:"chat_jid" json:"chat_jid"`
+	Name            string `db:"name" json:"name"`
+	UnreadCount     int    `db:"unread_count" json:"unread_count"`
+	Archived        bool   `db:"archived" json:"archived"`
+	Pinned          bool   `db:"pinned" json:"pinned"`
+	LastMessageAt   int64  `db:"last_message_at" json:"last_message_at"`
+	OldestMessageAt int64  `db:"oldest_message_at" json:"oldest_message_at"`
+	MessageCount    int    `db:"message_count" json:"message_count"`
+}
+
+// InitHistorySync sets how much history is asked for when a number is
+// paired. whatsmeow's default applies unless HISTORY_FULL_SYNC asks for the
+// full history, HISTORY_SYNC_DAYS limits it to the last days
+func InitHistorySync() {
+	if envBool("HISTORY_FULL_SYNC", false) {
+		store.DeviceProps.RequireFullSync = proto.Bool(true)
+	}
+	if os.Getenv("HISTORY_SYNC_DAYS") != "" {
+		store.DeviceProps.HistorySyncConfig = &waCompanionReg.DeviceProps_HistorySyncConfig{
+			FullSyncDaysLimit: proto.Uint32(uint32(envInt("HISTORY_SYNC_DAYS", 365))),
+		}
+	}
+}
+
+// saveConversation records a conversation of the history sync. Only the
+// initial syncs carry the state of the chat, on-demand ones just messages
+func saveConversation(db sqlx.Execer, userID string, c *Conversation, withState bool) error {
+	if !withState {
+		_, err := db.Exec(`
+			INSERT INTO conversations (user_id, chat_jid, last_message_at) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, chat_jid) DO NOTHING`,
+			userID, c.ChatJID, c.LastMessageAt)
+		return err
+	}
+	_, err := db.Exec(`
+		INSERT INTO conversations (user_id, chat_jid, name, unread_count, archived, pinned, last_message_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id, chat_jid) DO UPDATE SET
+			name = CASE WHEN excluded.name = '' THEN conversations.name ELSE excluded.name END,
+			unread_count = excluded.unread_count,
+			archived = excluded.archived,
+			pinned = excluded.pinned,
+			last_message_at = CASE WHEN excluded.last_message_at > conversations.last_message_at THEN excluded.last_message_at ELSE conversations.last_message_at END`,
+		userID, c.ChatJID, c.Name, c.UnreadCount, c.Archived, c.Pinned, c.LastMessageAt)
+	return err
+}
+
+// touchConversation keeps the conversation of a stored message up to date
+func touchConversation(db *sqlx.DB, userID string, chat string, timestamp int64) {
+	_, err := db.Exec(`
+		INSERT INTO conversations (user_id, chat_jid, last_message_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, chat_jid) DO UPDATE SET last_message_at = excluded.last_message_at
+		WHERE conversations.last_message_at < excluded.last_message_at`,
+		userID, chat, timestamp)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Str("chat", chat).Msg("Failed to update conversation")
+	}
+}
+
+// listConversations returns the conversations with the latest message first
+func listConversations(db *sqlx.DB, userID string, limit int, offset int) ([]Conversation, error) {
+	conversations := []Conversation{}
+	err := db.Select(&conversations, `
+		SELECT c.chat_jid, c.name, c.unread_count, c.archived, c.pinned, c.last_message_at,
+			(SELECT COALESCE(MIN(m.timestamp), 0) FROM messages m WHERE m.user_id = c.user_id AND m.chat_jid = c.chat_jid) AS oldest_message_at,
+			(SELECT COUNT(*) FROM messages m WHERE m.user_id = c.user_id AND m.chat_jid = c.chat_jid) AS message_count
+		FROM conversations c WHERE c.user_id = $1
+		ORDER BY c.last_message_at DESC, c.chat_jid LIMIT $2 OFFSET $3`,
+		userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
+
+// historyChunk is what a history sync chunk added to the archive
+type historyChunk struct {
+	conversations int
+	messages      int
+	skipped       int
+	chats         []string
+}
+
+// importHistory stores the conversations and messages of a history sync
+// chunk in one transaction
+func (mycli *MyClient) importHistory(data *waHistorySync.HistorySync) (*historyChunk, error) {
+	chunk := &historyChunk{}
+	withState := data.GetSyncType() != waHistorySync.HistorySync_ON_DEMAND
+
+	// Messages of the history often lack the push name of their sender
+	pushNames := map[string]string{}
+	for _, pn := range data.GetPushnames() {
+		pushNames[pn.GetID()] = pn.GetPushname()
+	}
+
+	tx, err := mycli.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, conv := range data.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetID())
+		if err != nil {
+			log.Warn().Err(err).Str("userID", mycli.userID).Str("chat", conv.GetID()).Msg("Skipping conversation with invalid JID")
+			continue
+		}
+		conversation := &Conversation{
+			ChatJID:       chatJID.String(),
+			Name:          conv.GetName(),
+			UnreadCount:   int(conv.GetUnreadCount()),
+			Archived:      conv.GetArchived(),
+			Pinned:        conv.GetPinned() > 0,
+			LastMessageAt: int64(conv.GetConversationTimestamp()),
+		}
+		if conversation.Name == "" {
+			conversation.Name = conv.GetDisplayName()
+		}
+
+		for _, historyMsg := range conv.GetMessages() {
+			evt, err := mycli.WAClient.ParseWebMessage(chatJID, historyMsg.GetMessage())
+			// Group notifications and other stubs have no content to keep
+			if err != nil || evt.Message == nil {
+				chunk.skipped++
+				continue
+			}
+			if evt.Info.PushName == "" {
+				evt.Info.PushName = pushNames[evt.Info.Sender.ToNonAD().String()]
+			}
+			m := messageFromEvent(evt)
+			if err := saveMessage(tx, mycli.userID, m); err != nil {
+				return nil, err
+			}
+			chunk.messages++
+			if m.Timestamp > conversation.LastMessageAt {
+				conversation.LastMessageAt = m.Timestamp
+			}
+		}
+
+		if err := saveConversation(tx, mycli.userID, conversation, withState); err != nil {
+			return nil, err
+		}
+		chunk.conversations++
+		chunk.chats = append(chunk.chats, conversation.ChatJID)
+	}
+	return chunk, tx.Commit()
+}
+
+// handleHistorySync archives a history sync chunk and emits its progress
+// instead of the chunk itself, which can be many megabytes
+func (mycli *MyClient) handleHistorySync(evt *events.HistorySync) {
+	data := evt.Data
+	syncType := data.GetSyncType()
+	chunk, err := mycli.importHistory(data)
+	if err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Str("type", syncType.String()).Msg("Failed to import history sync")
+		chunk = &historyChunk{}
+	}
+	log.Info().Str("userID", mycli.userID).Str("type", syncType.String()).Uint32("chunk", data.GetChunkOrder()).
+		Int("conversations", chunk.conversations).Int("messages", chunk.messages).Msg("History sync imported")
+
+	event := map[string]interface{}{
+		"SyncType":      syncType.String(),
+		"ChunkOrder":    data.GetChunkOrder(),
+		"Progress":      data.GetProgress(),
+		"Conversations": chunk.conversations,
+		"Messages":      chunk.messages,
+		"Skipped":       chunk.skipped,
+	}
+	if err != nil {
+		event["Error"] = err.Error()
+	}
+	sendEventWithWebHook(mycli, map[string]interface{}{"type": "HistorySync", "event": event}, "")
+
+	if syncType == waHistorySync.HistorySync_ON_DEMAND {
+		for _, chat := range chunk.chats {
+			mycli.continueBackfill(chat)
+		}
+	}
+}
+
+// historyBackfill is a backfill of a chat running. It is stored by value and
+// replaced on every request, the requests are sent from other goroutines
+type historyBackfill struct {
+	Chat     string
+	Since    int64
+	Requests int
+	// Timestamp of the message the last page was asked before
+	Before    int64
+	StartedAt time.Time
+	UpdatedAt time.Time
+	mycli     *MyClient
+}
+
+func backfillKey(userID string, chat string) string {
+	return userID + "|" + chat
+}
+
+// backfillEvicted reports backfills dropped for lack of answers. The cache
+// also calls it when a backfill is deleted on finishing, those were updated
+// recently
+func backfillEvicted(key string, value interface{}) {
+	backfill := value.(historyBackfill)
+	if time.Since(backfill.UpdatedAt) < backfillTimeout {
+		return
+	}
+	backfill.mycli.sendBackfillEvent(backfill, "failed", "timeout")
+}
+
+// startBackfill asks the phone for the history of a chat back to a date,
+// starting from its oldest stored message. It is false when the archive
+// already goes back that far
+func (mycli *MyClient) startBackfill(chat types.JID, since time.Time) (bool, *StoredMessage, error) {
+	oldest, err := oldestStoredMessage(mycli.db, mycli.userID, chat.String())
+	if err != nil {
+		return false, nil, err
+	}
+	if oldest.Timestamp <= since.Unix() {
+		return false, oldest, nil
+	}
+
+	now := time.Now()
+	backfill := historyBackfill{
+		Chat:      chat.String(),
+		Since:     since.Unix(),
+		Requests:  1,
+		Before:    oldest.Timestamp,
+		StartedAt: now,
+		UpdatedAt: now,
+		mycli:     mycli,
+	}
+	if err := historyBackfills.Add(backfillKey(mycli.userID, backfill.Chat), backfill, cache.DefaultExpiration); err != nil {
+		return false, oldest, errBackfillRunning
+	}
+	if err := mycli.requestHistory(backfill, oldest); err != nil {
+		historyBackfills.Delete(backfillKey(mycli.userID, backfill.Chat))
+		return false, oldest, err
+	}
+	return true, oldest, nil
+}
+
+// continueBackfill asks for the next page of a running backfill once a page
+// arrived, until the archive reaches the date or the phone has no more
+func (mycli *MyClient) continueBackfill(chat string) {
+	key := backfillKey(mycli.userID, chat)
+	value, found := historyBackfills.Get(key)
+	if !found {
+		return
+	}
+	backfill := value.(historyBackfill)
+
+	oldest, err := oldestStoredMessage(mycli.db, mycli.userID, chat)
+	switch {
+	case err != nil:
+		mycli.finishBackfill(backfill, "failed", err.Error())
+	case oldest.Timestamp <= backfill.Since:
+		mycli.finishBackfill(backfill, "completed", "reached date")
+	case oldest.Timestamp >= backfill.Before:
+		// The page held no message older than the ones stored
+		mycli.finishBackfill(backfill, "completed", "no older messages")
+	case backfill.Requests >= backfillMaxRequests:
+		mycli.finishBackfill(backfill, "completed", "request limit reached")
+	default:
+		backfill.Requests++
+		backfill.Before = oldest.Timestamp
+		backfill.UpdatedAt = time.Now()
+		historyBackfills.Set(key, backfill, cache.DefaultExpiration)
+		// Replies come from the event handler, the request is sent apart
+		go func() {
+			if err := mycli.requestHistory(backfill, oldest); err != nil {
+				mycli.finishBackfill(backfill, "failed", err.Error())
+			}
+		}()
+	}
+}
+
+// requestHistory asks for the page of history before a stored message
+func (mycli *MyClient) requestHistory(backfill historyBackfill, before *StoredMessage) error {
+	if mycli.WAClient == nil || !mycli.WAClient.IsConnected() || mycli.WAClient.Store.ID == nil {
+		return errors.New("session is not connected")
+	}
+	chat, _ := types.ParseJID(before.ChatJID)
+	request := mycli.WAClient.BuildHistorySyncRequest(&types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: chat, IsFromMe: before.IsFromMe},
+		ID:            before.ID,
+		Timestamp:     time.Unix(before.Timestamp, 0),
+	}, backfillPageSize)
+
+	_, err := mycli.WAClient.SendMessage(context.Background(), mycli.WAClient.Store.ID.ToNonAD(), request, whatsmeow.SendRequestExtra{Peer: true})
+	if err != nil {
+		return err
+	}
+	log.Info().Str("userID", mycli.userID).Str("chat", backfill.Chat).Int("request", backfill.Requests).Msg("History backfill requested")
+	return nil
+}
+
+// finishBackfill ends a backfill and emits how far back the archive goes
+func (mycli *MyClient) finishBackfill(backfill historyBackfill, status string, reason string) {
+	historyBackfills.Delete(backfillKey(mycli.userID, backfill.Chat))
+	mycli.sendBackfillEvent(backfill, status, reason)
+}
+
+func (mycli *MyClient) sendBackfillEvent(backfill historyBackfill, status string, reason string) {
+	event := map[string]interface{}{
+		"Chat":     backfill.Chat,
+		"Since":    backfill.Since,
+		"Status":   status,
+		"Reason":   reason,
+		"Requests": backfill.Requests,
+	}
+	if oldest, err := oldestStoredMessage(mycli.db, mycli.userID, backfill.Chat); err == nil {
+		event["OldestMessageAt"] = oldest.Timestamp
+	}
+	log.Info().Str("userID", mycli.userID).Str("chat", backfill.Chat).Str("status", status).Str("reason", reason).Msg("History backfill finished")
+	sendEventWithWebHook(mycli, map[string]interface{}{"type": "HistoryBackfill", "event": event}, "")
+}
+
+// parseBackfillSince reads the date a backfill goes back to, as a date,
+// a RFC3339 time or a unix timestamp
+func parseBackfillSince(since json.RawMessage) (time.Time, error) {
+	errInvalid := errors.New("Since must be a date (2006-01-02), a RFC3339 time or a unix timestamp")
+	var unix int64
+	if err := json.Unmarshal(since, &unix); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	var text string
+	if err := json.Unmarshal(since, &text); err != nil {
+		return time.Time{}, errInvalid
+	}
+	if at, err := parseTimeValue(text); err == nil {
+		return at, nil
+	}
+	if at, err := time.ParseInLocation("2006-01-02", text, time.Local); err == nil {
+		return at, nil
+	}
+	return time.Time{}, errInvalid
+}
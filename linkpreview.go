@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/rs/zerolog/log"
+	"github.com/vincent-petithory/dataurl"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Only the head of a page is parsed, metadata is expected early on
+	linkPreviewMaxPageSize  = 1 << 20
+	linkPreviewMaxImageSize = 5 << 20
+
+	// Sizes of the thumbnail sent inline and of the one uploaded for the card
+	linkPreviewInlineSize = 200
+	linkPreviewFullSize   = 1200
+)
+
+// Links in message bodies, with or without scheme
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// LinkPreview is the LinkPreview option of text sends: false to send without
+// a preview, or the metadata to show instead of fetching it from the page
+type LinkPreview struct {
+	Disabled    bool `json:"-"`
+	URL         string
+	Title       string
+	Description string
+	Thumbnail   string // data URL or http(s) URL of the image
+}
+
+func (lp *LinkPreview) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		lp.Disabled = !enabled
+		return nil
+	}
+	type plain LinkPreview
+	return json.Unmarshal(data, (*plain)(lp))
+}
+
+func (lp *LinkPreview) custom() bool {
+	return lp != nil && (lp.URL != "" || lp.Title != "" || lp.Description != "" || lp.Thumbnail != "")
+}
+
+// firstLink returns the first link of a text as written and as a full URL
+func firstLink(text string) (matched string, link string) {
+	matched = strings.TrimRight(linkPattern.FindString(text), ".,;:!?)]}'")
+	if matched == "" {
+		return "", ""
+	}
+	link = matched
+	if !strings.Contains(strings.ToLower(link), "://") {
+		link = "https://" + link
+	}
+	return matched, link
+}
+
+var errPrivateLink = errors.New("link points to a private or loopback address")
+
+// linkPreviewClient fetches previews of sessions without proxy. Any link a
+// user sends is fetched, so only public addresses are dialed
+var linkPreviewClient = newLinkPreviewClient()
+
+func newLinkPreviewClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicDialControl(errPrivateLink)}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 60 * time.Second, Transport: transport, CheckRedirect: checkPreviewRedirect}
+}
+
+// previewHTTPClient fetches previews through the session proxy when there is one
+func previewHTTPClient(userID string) *http.Client {
+	if httpClient := clientManager.GetHTTPClient(userID); httpClient != nil {
+		proxied := *httpClient.GetClient()
+		proxied.CheckRedirect = checkPreviewRedirect
+		return &proxied
+	}
+	return linkPreviewClient
+}
+
+// checkPublicLink refuses links to hosts that resolve to private, loopback or
+// link-local addresses. The proxy resolves the host itself, so this is the
+// only check previews through a proxy get
+func checkPublicLink(ctx context.Context, link *url.URL) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, link.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errPrivateLink
+		}
+	}
+	return nil
+}
+
+func checkPreviewRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return checkPublicLink(req.Context(), req.URL)
+}
+
+// linkMetadata is what a page says about itself in its OpenGraph and Twitter tags
+type linkMetadata struct {
+	URL         string
+	Title       string
+	Description string
+	Image       string
+}
+
+func fetchLinkMetadata(ctx context.Context, client *http.Client, link string) (linkMetadata, error) {
+	meta := linkMetadata{URL: link}
+	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return meta, err
+	}
+	req.Header.Set("User-Agent", "WhatsApp/2.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,image/*;q=0.8")
+	if err := checkPublicLink(ctx, req.URL); err != nil {
+		return meta, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return meta, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return meta, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	// After redirects, relative URLs are resolved against the final page
+	base := resp.Request.URL
+	meta.URL = base.String()
+	contentType := resp.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "image/") {
+		meta.Image = meta.URL
+		return meta, nil
+	}
+	if !strings.Contains(contentType, "html") {
+		return meta, fmt.Errorf("unsupported content type %q", contentType)
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, linkPreviewMaxPageSize), contentType)
+	if err != nil {
+		return meta, err
+	}
+	parseLinkMetadata(body, base, &meta)
+	return meta, nil
+}
+
+// parseLinkMetadata reads the head of a page, OpenGraph tags win over
+// Twitter tags, which win over the plain title and description
+func parseLinkMetadata(r io.Reader, base *url.URL, meta *linkMetadata) {
+	found := map[string]string{}
+	var title strings.Builder
+	inTitle := false
+
+	z := html.NewTokenizer(r)
+tokens:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			break tokens
+		case html.TextToken:
+			if inTitle {
+				title.Write(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				break tokens
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			if tag == "body" {
+				break tokens
+			}
+			if tag == "title" {
+				inTitle = tt == html.StartTagToken
+				continue
+			}
+			attrs := map[string]string{}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				attrs[strings.ToLower(string(key))] = string(val)
+			}
+			switch tag {
+			case "meta":
+				key := strings.ToLower(attrs["property"])
+				if key == "" {
+					key = strings.ToLower(attrs["name"])
+				}
+				if _, ok := found[key]; !ok && key != "" {
+					found[key] = strings.TrimSpace(attrs["content"])
+				}
+			case "link":
+				if strings.EqualFold(attrs["rel"], "canonical") {
+					found["canonical"] = attrs["href"]
+				}
+			}
+		}
+	}
+
+	found["title"] = strings.TrimSpace(title.String())
+	pick := func(keys ...string) string {
+		for _, key := range keys {
+			if value := found[key]; value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	resolve := func(ref string) string {
+		if ref == "" {
+			return ""
+		}
+		parsed, err := base.Parse(ref)
+		if err != nil {
+			return ""
+		}
+		return parsed.String()
+	}
+
+	meta.Title = pick("og:title", "twitter:title", "title")
+	meta.Description = pick("og:description", "twitter:description", "description")
+	meta.Image = resolve(pick("og:image:secure_url", "og:image", "og:image:url", "twitter:image", "twitter:image:src"))
+	if canonical := resolve(pick("og:url", "canonical")); canonical != "" {
+		meta.URL = canonical
+	}
+}
+
+// fetchPreviewImage loads the image of a preview, given as URL or data URL
+func fetchPreviewImage(ctx context.Context, client *http.Client, ref string) ([]byte, error) {
+	if strings.HasPrefix(ref, "data:") {
+		parsed, err := dataurl.DecodeString(ref)
+		if err != nil {
+			return nil, err
+		}
+		return parsed.Data, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "WhatsApp/2.0")
+	if err := checkPublicLink(ctx, req.URL); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, linkPreviewMaxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > linkPreviewMaxImageSize {
+		return nil, fmt.Errorf("%w, the limit is %d MB", errMediaTooLarge, linkPreviewMaxImageSize>>20)
+	}
+	return data, nil
+}
+
+func encodeThumbnail(img image.Image, size uint) ([]byte, image.Rectangle, error) {
+	resized := resize.Thumbnail(size, size, img, resize.Lanczos3)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	return buf.Bytes(), resized.Bounds(), nil
+}
+
+// addPreviewThumbnail attaches the image of a preview: a small JPEG inline
+// and a larger one uploaded as link thumbnail media for the card
+func addPreviewThumbnail(ext *waE2E.ExtendedTextMessage, client *whatsmeow.Client, data []byte) error {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("could not decode preview image: %w", err)
+	}
+	inline, _, err := encodeThumbnail(img, linkPreviewInlineSize)
+	if err != nil {
+		return err
+	}
+	ext.JPEGThumbnail = inline
+
+	full, bounds, err := encodeThumbnail(img, linkPreviewFullSize)
+	if err != nil {
+		return err
+	}
+	uploaded, err := client.Upload(context.Background(), full, whatsmeow.MediaLinkThumbnail)
+	if err != nil {
+		// The inline thumbnail is enough for a preview, only smaller
+		log.Warn().Err(err).Msg("Failed to upload link preview thumbnail")
+		return nil
+	}
+	ext.ThumbnailDirectPath = proto.String(uploaded.DirectPath)
+	ext.ThumbnailSHA256 = uploaded.FileSHA256
+	ext.ThumbnailEncSHA256 = uploaded.FileEncSHA256
+	ext.MediaKey = uploaded.MediaKey
+	ext.MediaKeyTimestamp = proto.Int64(time.Now().Unix())
+	ext.ThumbnailWidth = proto.Uint32(uint32(bounds.Dx()))
+	ext.ThumbnailHeight = proto.Uint32(uint32(bounds.Dy()))
+	return nil
+}
+
+// addLinkPreview fills the preview card of a text message for its first link.
+// A preview that cannot be built never fails the send, the text goes without
+// it. The metadata used is returned, nil when there is no preview
+func addLinkPreview(ext *waE2E.ExtendedTextMessage, userID string, client *whatsmeow.Client, opt *LinkPreview) *linkMetadata {
+	if opt != nil && opt.Disabled {
+		return nil
+	}
+	if !opt.custom() && !envBool("LINK_PREVIEW_ENABLED", true) {
+		return nil
+	}
+
+	matched, link := firstLink(ext.GetText())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(envInt("LINK_PREVIEW_TIMEOUT_SECONDS", 10))*time.Second)
+	defer cancel()
+	httpClient := previewHTTPClient(userID)
+
+	var meta linkMetadata
+	if opt.custom() {
+		meta = linkMetadata{URL: opt.URL, Title: opt.Title, Description: opt.Description, Image: opt.Thumbnail}
+		if meta.URL == "" {
+			meta.URL = link
+		}
+		if matched == "" {
+			matched = meta.URL
+		}
+	} else {
+		if link == "" {
+			return nil
+		}
+		var err error
+		meta, err = fetchLinkMetadata(ctx, httpClient, link)
+		if err != nil {
+			log.Warn().Err(err).Str("url", link).Msg("Could not fetch link preview")
+			return nil
+		}
+		if meta.Title == "" && meta.Description == "" && meta.Image == "" {
+			return nil
+		}
+	}
+	if matched == "" {
+		return nil
+	}
+
+	ext.MatchedText = proto.String(matched)
+	ext.Title = proto.String(meta.Title)
+	ext.Description = proto.String(meta.Description)
+	ext.PreviewType = waE2E.ExtendedTextMessage_NONE.Enum()
+	if meta.Image != "" {
+		data, err := fetchPreviewImage(ctx, httpClient, meta.Image)
+		if err == nil {
+			err = addPreviewThumbnail(ext, client, data)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("image", meta.Image).Msg("Could not add link preview thumbnail")
+		}
+	}
+	return &meta
+}
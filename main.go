@@ -49,7 +49,6 @@ var (
 
 	container        *sqlstore.Container
 	clientManager    = NewClientManager()
-	killchannel      = make(map[string](chan bool))
 	userinfocache    = cache.New(5*time.Minute, 10*time.Minute)
 	lastMessageCache = cache.New(24*time.Hour, 24*time.Hour)
 	globalHTTPClient = &http.Client{Timeout: 60 * time.Second}
@@ -182,6 +181,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Start the persistent webhook delivery queue
+	InitWebhookQueue(db)
+
+	// Pick the external tool media is converted with, if any
+	InitTranscoder()
+
+	// How much history newly paired numbers ask for
+	InitHistorySync()
+
 	var dbLog waLog.Logger
 	if *waDebug != "" {
 		dbLog = waLog.Stdout("Database", *waDebug, *colorOutput)
@@ -212,8 +220,12 @@ func main() {
 		exPath: exPath,
 	}
 	s.routes()
+	s.InitOutboundQueues()
 
 	s.connectOnStartup()
+	s.startExpirationWatcher()
+	s.StartMessageScheduler()
+	s.StartBulkSender()
 
 	srv := &http.Server{
 		Addr:              *address + ":" + *port,
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Default size limits of media sends in MB, as accepted by WhatsApp. Stickers
+// are converted before sending, so larger images and animations are taken
+var mediaSizeDefaults = map[string]int{
+	"image":    16,
+	"audio":    16,
+	"sticker":  8,
+	"video":    2048,
+	"document": 2048,
+}
+
+// Form values other than the file are small, this only guards against abuse
+const maxFormValueSize = 1 << 20
+
+var errMediaTooLarge = errors.New("file is too large")
+
+// mediaSizeLimit returns the size limit in bytes of a kind of media,
+// configurable with MEDIA_MAX_<KIND>_MB
+func mediaSizeLimit(kind string) int64 {
+	return int64(envInt("MEDIA_MAX_"+strings.ToUpper(kind)+"_MB", mediaSizeDefaults[kind])) << 20
+}
+
+// sendMedia is a media file received as a form part or downloaded from a URL.
+// It is kept in a temp file so large media is never held in memory
+type sendMedia struct {
+	file     *os.File
+	size     int64
+	mimeType string
+	fileName string
+}
+
+// Close removes the temp file, it is safe to call on a nil media
+func (m *sendMedia) Close() {
+	if m == nil || m.file == nil {
+		return
+	}
+	m.file.Close()
+	os.Remove(m.file.Name())
+}
+
+// Bytes reads the whole file, for media small enough to be processed in memory
+func (m *sendMedia) Bytes() ([]byte, error) {
+	if _, err := m.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(m.file)
+}
+
+// MimeType returns the type declared by the sender, or sniffs it from the content
+func (m *sendMedia) MimeType() string {
+	if m.mimeType != "" && m.mimeType != "application/octet-stream" {
+		return m.mimeType
+	}
+	head := make([]byte, 512)
+	m.file.Seek(0, io.SeekStart)
+	n, _ := io.ReadFull(m.file, head)
+	return http.DetectContentType(head[:n])
+}
+
+// Upload encrypts and uploads the file to WhatsApp straight from disk
+func (m *sendMedia) Upload(client *whatsmeow.Client, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	if _, err := m.file.Seek(0, io.SeekStart); err != nil {
+		return whatsmeow.UploadResponse{}, err
+	}
+	return client.UploadReader(context.Background(), m.file, nil, mediaType)
+}
+
+// spoolMedia copies media to a temp file, failing once it goes over limit
+func spoolMedia(src io.Reader, limit int64) (*sendMedia, error) {
+	f, err := os.CreateTemp("", "wuzapi-media-*")
+	if err != nil {
+		return nil, err
+	}
+	m := &sendMedia{file: f}
+	m.size, err = io.Copy(f, io.LimitReader(src, limit+1))
+	if err == nil && m.size > limit {
+		err = fmt.Errorf("%w, the limit is %d MB", errMediaTooLarge, limit>>20)
+	}
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// mediaFetchClient downloads URL media. It has no overall timeout, which
+// would also cover reading the body, the transfer is bounded by its context
+var mediaFetchClient = &http.Client{}
+
+// fetchURLMedia downloads media to a temp file, within the media transfer timeout
+func fetchURLMedia(ctx context.Context, resourceURL string, limit int64) (*sendMedia, error) {
+	ctx, cancel := context.WithTimeout(ctx, mediaTransferTimeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", resourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := mediaFetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("%w, the limit is %d MB", errMediaTooLarge, limit>>20)
+	}
+
+	m, err := spoolMedia(resp.Body, limit)
+	if err != nil {
+		return nil, err
+	}
+	m.mimeType = resp.Header.Get("Content-Type")
+	return m, nil
+}
+
+func isMultipartRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// allowSlowTransfer lifts the server read and write timeouts for requests
+// moving large media, up to MEDIA_TRANSFER_TIMEOUT_SECONDS
+func allowSlowTransfer(w http.ResponseWriter) {
+	deadline := time.Now().Add(mediaTransferTimeout())
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(deadline)
+	rc.SetWriteDeadline(deadline)
+}
+
+func mediaTransferTimeout() time.Duration {
+	return time.Duration(envInt("MEDIA_TRANSFER_TIMEOUT_SECONDS", 1800)) * time.Second
+}
+
+// decodeSendPayload decodes the payload of a media send into t. Besides JSON
+// it accepts multipart/form-data, with the fields of the payload as form
+// values and the media as a file part. The file is returned in a temp file,
+// nil when the payload was JSON or had no file
+func decodeSendPayload(w http.ResponseWriter, r *http.Request, t interface{}, limit int64) (*sendMedia, error) {
+	if !isMultipartRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+			return nil, errors.New("could not decode Payload")
+		}
+		return nil, nil
+	}
+
+	allowSlowTransfer(w)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.New("could not decode Payload")
+	}
+
+	var media *sendMedia
+	values := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			media.Close()
+			return nil, fmt.Errorf("could not read multipart payload: %v", err)
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize))
+			if err != nil {
+				media.Close()
+				return nil, fmt.Errorf("could not read multipart payload: %v", err)
+			}
+			values[part.FormName()] = string(value)
+			continue
+		}
+		if media != nil {
+			media.Close()
+			return nil, errors.New("only one file can be sent per message")
+		}
+		if media, err = spoolMedia(part, limit); err != nil {
+			return nil, err
+		}
+		media.mimeType = part.Header.Get("Content-Type")
+		media.fileName = part.FileName()
+	}
+
+	payload, err := formPayload(values, t)
+	if err == nil {
+		err = json.Unmarshal(payload, t)
+	}
+	if err != nil {
+		media.Close()
+		return nil, fmt.Errorf("could not decode Payload: %v", err)
+	}
+	return media, nil
+}
+
+// formPayload turns form values into the JSON payload of t. Values of string
+// fields are taken as is, the others (ContextInfo, numbers, booleans) as JSON
+func formPayload(values map[string]string, t interface{}) ([]byte, error) {
+	rt := reflect.TypeOf(t).Elem()
+	payload := make(map[string]json.RawMessage, len(values))
+	for key, value := range values {
+		switch strings.ToLower(key) {
+		case "sendat", "delayseconds":
+			return nil, errors.New("multipart sends cannot be scheduled")
+		}
+		field, ok := rt.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, key)
+		})
+		if ok && field.Type.Kind() != reflect.String {
+			if !json.Valid([]byte(value)) {
+				return nil, fmt.Errorf("%s must be valid JSON", key)
+			}
+			payload[key] = json.RawMessage(value)
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+		payload[key] = encoded
+	}
+	return json.Marshal(payload)
+}
+
+// payloadErrorStatus is the status to answer a failed decodeSendPayload with
+func payloadErrorStatus(err error) int {
+	if errors.Is(err, errMediaTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Transcoder converts media with an external tool, so sends are not limited
+// to the formats WhatsApp clients play
+type Transcoder interface {
+	Name() string
+	// AudioToOpus converts the audio of in to Opus in an Ogg container at out,
+	// as mono speech when voice is set
+	AudioToOpus(ctx context.Context, in string, out string, voice bool) error
+	// DecodeAudio writes the audio of in to w as mono signed 16 bit little
+	// endian samples at rate
+	DecodeAudio(ctx context.Context, in string, rate int, w io.Writer) error
+	// ProbeVideo reads the duration, dimensions and codecs of a video
+	ProbeVideo(ctx context.Context, in string) (videoInfo, error)
+	// VideoThumbnail writes the first keyframe of a video to w as JPEG
+	VideoThumbnail(ctx context.Context, in string, w io.Writer) error
+	// VideoToMP4 writes the video as MP4 to out. Streams are copied as they
+	// are, unless video or audio is set to convert them to H.264 or AAC
+	VideoToMP4(ctx context.Context, in string, out string, video bool, audio bool) error
+	// ImageToWebP writes an image, or the frames of an animation, to out as
+	// WebP at quality, scaled to fit a size by size square padded with transparency
+	ImageToWebP(ctx context.Context, in string, out string, size int, animated bool, quality int) error
+}
+
+// Transcoder backends by the name used in MEDIA_TRANSCODER
+var transcoderBackends = map[string]func() (Transcoder, error){
+	"ffmpeg": newFFmpegTranscoder,
+}
+
+// mediaTranscoder is nil when no backend is available, media is then sent as received
+var mediaTranscoder Transcoder
+
+var errNoTranscoder = errors.New("no media transcoder is available")
+
+// InitTranscoder sets up the backend named in MEDIA_TRANSCODER, "none" disables
+// transcoding. When unset, ffmpeg is used if it can be found
+func InitTranscoder() {
+	name := strings.ToLower(os.Getenv("MEDIA_TRANSCODER"))
+	if name == "none" {
+		log.Info().Msg("Media transcoding disabled")
+		return
+	}
+	auto := name == ""
+	if auto {
+		name = "ffmpeg"
+	}
+
+	newBackend, ok := transcoderBackends[name]
+	if !ok {
+		log.Error().Str("transcoder", name).Msg("Unknown media transcoder, media transcoding disabled")
+		return
+	}
+	t, err := newBackend()
+	if err != nil {
+		if auto {
+			log.Info().Err(err).Msg("No media transcoder found, audio has to be sent as Ogg Opus")
+		} else {
+			log.Error().Err(err).Str("transcoder", name).Msg("Could not set up media transcoder")
+		}
+		return
+	}
+	mediaTranscoder = t
+	log.Info().Str("transcoder", t.Name()).Msg("Media transcoding enabled")
+}
+
+// transcodeContext bounds a conversion by MEDIA_TRANSCODE_TIMEOUT_SECONDS
+func transcodeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(envInt("MEDIA_TRANSCODE_TIMEOUT_SECONDS", 300))*time.Second)
+}
+
+type ffmpegTranscoder struct {
+	path      string
+	probePath string
+}
+
+// newFFmpegTranscoder uses the binary at FFMPEG_PATH, or ffmpeg from PATH.
+// Videos are probed with the ffprobe at FFPROBE_PATH, next to ffmpeg or on PATH
+func newFFmpegTranscoder() (Transcoder, error) {
+	path := os.Getenv("FFMPEG_PATH")
+	if path == "" {
+		path = "ffmpeg"
+	}
+	path, err := exec.LookPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	probePath := os.Getenv("FFPROBE_PATH")
+	if probePath == "" {
+		probePath = filepath.Join(filepath.Dir(path), "ffprobe")
+		if _, err := exec.LookPath(probePath); err != nil {
+			probePath = "ffprobe"
+		}
+	}
+	if probePath, err = exec.LookPath(probePath); err != nil {
+		log.Warn().Err(err).Msg("ffprobe not found, videos will be sent without duration and dimensions")
+		probePath = ""
+	}
+	return &ffmpegTranscoder{path: path, probePath: probePath}, nil
+}
+
+func (f *ffmpegTranscoder) Name() string {
+	return "ffmpeg"
+}
+
+func (f *ffmpegTranscoder) run(ctx context.Context, stdout io.Writer, args ...string) error {
+	return runTool(ctx, stdout, f.path, append([]string{"-nostdin", "-hide_banner", "-loglevel", "error", "-y"}, args...)...)
+}
+
+// runTool runs an external tool, its errors carry the end of what it printed
+func runTool(ctx context.Context, stdout io.Writer, path string, args ...string) error {
+	cmd := exec.CommandContext(ctx, path, args...)
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	name := filepath.Base(path)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: %w", name, ctx.Err())
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 500 {
+			msg = msg[len(msg)-500:]
+		}
+		return fmt.Errorf("%s: %v: %s", name, err, msg)
+	}
+	return nil
+}
+
+func (f *ffmpegTranscoder) AudioToOpus(ctx context.Context, in string, out string, voice bool) error {
+	args := []string{"-i", in, "-vn", "-map_metadata", "-1", "-c:a", "libopus", "-ar", "48000"}
+	if voice {
+		args = append(args, "-ac", "1", "-b:a", "32k", "-application", "voip")
+	} else {
+		args = append(args, "-b:a", "96k")
+	}
+	return f.run(ctx, nil, append(args, "-f", "ogg", out)...)
+}
+
+func (f *ffmpegTranscoder) DecodeAudio(ctx context.Context, in string, rate int, w io.Writer) error {
+	return f.run(ctx, w, "-i", in, "-vn", "-ac", "1", "-ar", strconv.Itoa(rate), "-f", "s16le", "pipe:1")
+}
+
+func (f *ffmpegTranscoder) ProbeVideo(ctx context.Context, in string) (videoInfo, error) {
+	var info videoInfo
+	if f.probePath == "" {
+		return info, errors.New("ffprobe not found")
+	}
+	var out bytes.Buffer
+	if err := runTool(ctx, &out, f.probePath, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", in); err != nil {
+		return info, err
+	}
+
+	var probe struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     uint32 `json:"width"`
+			Height    uint32 `json:"height"`
+			PixFmt    string `json:"pix_fmt"`
+			Tags      struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideDataList []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &probe); err != nil {
+		return info, fmt.Errorf("could not parse ffprobe output: %w", err)
+	}
+
+	info.Format = probe.Format.FormatName
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil && duration > 0 {
+		info.Seconds = uint32(math.Ceil(duration))
+	}
+	for _, stream := range probe.Streams {
+		switch {
+		case stream.CodecType == "video" && info.VideoCodec == "":
+			info.VideoCodec = stream.CodecName
+			info.PixelFormat = stream.PixFmt
+			info.Width, info.Height = stream.Width, stream.Height
+			// Phones record portrait video as landscape with a rotation
+			rotation, _ := strconv.ParseFloat(stream.Tags.Rotate, 64)
+			for _, side := range stream.SideDataList {
+				if side.Rotation != 0 {
+					rotation = side.Rotation
+				}
+			}
+			if int(math.Abs(rotation))%180 == 90 {
+				info.Width, info.Height = info.Height, info.Width
+			}
+		case stream.CodecType == "audio" && info.AudioCodec == "":
+			info.AudioCodec = stream.CodecName
+		}
+	}
+	if info.VideoCodec == "" {
+		return info, errors.New("file has no video stream")
+	}
+	return info, nil
+}
+
+func (f *ffmpegTranscoder) VideoThumbnail(ctx context.Context, in string, w io.Writer) error {
+	return f.run(ctx, w, "-skip_frame", "nokey", "-i", in, "-an", "-frames:v", "1", "-c:v", "mjpeg", "-f", "image2pipe", "pipe:1")
+}
+
+func (f *ffmpegTranscoder) VideoToMP4(ctx context.Context, in string, out string, video bool, audio bool) error {
+	args := []string{"-i", in, "-map", "0:v:0", "-map", "0:a:0?"}
+	if video {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+			// yuv420p needs even dimensions
+			"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2")
+	} else {
+		args = append(args, "-c:v", "copy")
+	}
+	if audio {
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	} else {
+		args = append(args, "-c:a", "copy")
+	}
+	// Moving the index to the front lets the video play while it downloads
+	return f.run(ctx, nil, append(args, "-movflags", "+faststart", "-f", "mp4", out)...)
+}
+
+func (f *ffmpegTranscoder) ImageToWebP(ctx context.Context, in string, out string, size int, animated bool, quality int) error {
+	filter := fmt.Sprintf("scale=%[1]d:%[1]d:force_original_aspect_ratio=decrease:flags=lanczos,format=rgba,pad=%[1]d:%[1]d:(ow-iw)/2:(oh-ih)/2:color=0x00000000", size)
+	args := []string{"-i", in, "-an"}
+	if animated {
+		args = append(args, "-t", strconv.Itoa(stickerMaxSeconds), "-vf", "fps=15,"+filter, "-c:v", "libwebp_anim", "-loop", "0")
+	} else {
+		args = append(args, "-vf", filter, "-frames:v", "1", "-c:v", "libwebp")
+	}
+	return f.run(ctx, nil, append(args, "-lossless", "0", "-q:v", strconv.Itoa(quality), "-f", "webp", out)...)
+}
+
+const (
+	// Rate audio is decoded at to draw the waveform, plenty for a 64 bar graph
+	waveformSampleRate = 8000
+	waveformBars       = 64
+)
+
+// waveformWriter takes mono 16 bit PCM and keeps the mean amplitude of every
+// 10ms, so long audio is analyzed without holding its samples
+type waveformWriter struct {
+	rate    int
+	samples int64
+	blocks  []float64
+	sum     float64
+	count   int
+	odd     []byte
+}
+
+func (w *waveformWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(w.odd) > 0 {
+		p = append(w.odd, p...)
+		w.odd = nil
+	}
+	blockSize := w.rate / 100
+	for ; len(p) >= 2; p = p[2:] {
+		sample := float64(int16(binary.LittleEndian.Uint16(p)))
+		if sample < 0 {
+			sample = -sample
+		}
+		w.sum += sample
+		w.count++
+		w.samples++
+		if w.count == blockSize {
+			w.blocks = append(w.blocks, w.sum/float64(w.count))
+			w.sum, w.count = 0, 0
+		}
+	}
+	if len(p) == 1 {
+		w.odd = []byte{p[0]}
+	}
+	return n, nil
+}
+
+func (w *waveformWriter) Seconds() uint32 {
+	return uint32((w.samples + int64(w.rate) - 1) / int64(w.rate))
+}
+
+// Waveform scales the loudness of the audio to the 64 values from 0 to 100
+// WhatsApp draws voice notes with
+func (w *waveformWriter) Waveform() []byte {
+	blocks := w.blocks
+	if w.count > 0 {
+		blocks = append(blocks, w.sum/float64(w.count))
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	bars := make([]float64, waveformBars)
+	peak := 0.0
+	for i := range bars {
+		start := i * len(blocks) / waveformBars
+		end := (i + 1) * len(blocks) / waveformBars
+		if end <= start {
+			end = start + 1
+		}
+		for _, block := range blocks[start:end] {
+			bars[i] += block
+		}
+		bars[i] /= float64(end - start)
+		if bars[i] > peak {
+			peak = bars[i]
+		}
+	}
+
+	waveform := make([]byte, waveformBars)
+	if peak == 0 {
+		return waveform
+	}
+	for i, bar := range bars {
+		waveform[i] = byte(bar / peak * 100)
+	}
+	return waveform
+}
+
+// analyzeAudio returns the duration and waveform of an audio file
+func analyzeAudio(ctx context.Context, path string) (uint32, []byte, error) {
+	if mediaTranscoder == nil {
+		return 0, nil, errNoTranscoder
+	}
+	w := &waveformWriter{rate: waveformSampleRate}
+	if err := mediaTranscoder.DecodeAudio(ctx, path, waveformSampleRate, w); err != nil {
+		return 0, nil, err
+	}
+	return w.Seconds(), w.Waveform(), nil
+}
+
+// isOggOpus tells if a file is Opus in an Ogg container, by its first page
+func isOggOpus(f *os.File) bool {
+	head := make([]byte, 64)
+	n, _ := f.ReadAt(head, 0)
+	head = head[:n]
+	return bytes.HasPrefix(head, []byte("OggS")) && bytes.Contains(head, []byte("OpusHead"))
+}
+
+// oggOpusDuration reads the duration of an Ogg Opus file from the granule
+// position of its last page, for when there is no transcoder to decode it
+func oggOpusDuration(f *os.File) uint32 {
+	info, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	head := make([]byte, 64)
+	n, _ := f.ReadAt(head, 0)
+	idx := bytes.Index(head[:n], []byte("OpusHead"))
+	if idx < 0 || idx+12 > n {
+		return 0
+	}
+	preSkip := int64(binary.LittleEndian.Uint16(head[idx+10:]))
+
+	start := info.Size() - 64*1024
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, info.Size()-start)
+	n, _ = f.ReadAt(tail, start)
+	tail = tail[:n]
+	last := bytes.LastIndex(tail, []byte("OggS"))
+	if last < 0 || last+14 > len(tail) {
+		return 0
+	}
+	granule := int64(binary.LittleEndian.Uint64(tail[last+6:]))
+	if granule <= preSkip {
+		return 0
+	}
+	// Opus granule positions always count 48 kHz samples
+	return uint32((granule - preSkip + 47999) / 48000)
+}
+
+// audioInfo is what a prepared audio send carries besides the file
+type audioInfo struct {
+	Seconds  uint32
+	Waveform []byte
+}
+
+// prepareAudio makes sure audio is Ogg Opus, transcoding it otherwise, and
+// measures it. The returned media replaces the given one when it was
+// transcoded, the caller closes both
+func prepareAudio(media *sendMedia, voice bool) (*sendMedia, audioInfo, error) {
+	var info audioInfo
+	ctx, cancel := transcodeContext()
+	defer cancel()
+
+	out := media
+	if !isOggOpus(media.file) {
+		if mediaTranscoder == nil {
+			return nil, info, errors.New("audio should be Ogg Opus, no transcoder is available to convert it")
+		}
+		f, err := os.CreateTemp("", "wuzapi-media-*.ogg")
+		if err != nil {
+			return nil, info, err
+		}
+		out = &sendMedia{file: f, mimeType: "audio/ogg"}
+		if err := mediaTranscoder.AudioToOpus(ctx, media.file.Name(), f.Name(), voice); err != nil {
+			out.Close()
+			return nil, info, fmt.Errorf("could not convert audio: %w", err)
+		}
+		if stat, err := f.Stat(); err == nil {
+			out.size = stat.Size()
+		}
+	}
+
+	if mediaTranscoder == nil {
+		info.Seconds = oggOpusDuration(out.file)
+		return out, info, nil
+	}
+	seconds, waveform, err := analyzeAudio(ctx, out.file.Name())
+	if err != nil {
+		// The audio still plays, only without duration and waveform
+		log.Warn().Err(err).Msg("Could not analyze audio")
+		info.Seconds = oggOpusDuration(out.file)
+		return out, info, nil
+	}
+	info.Seconds = seconds
+	if voice {
+		info.Waveform = waveform
+	}
+	return out, info, nil
+}
+
+// Longest side of the inline thumbnail of videos
+const videoThumbnailSize = 200
+
+// videoInfo describes a video as probed by the transcoder
+type videoInfo struct {
+	Seconds     uint32
+	Width       uint32
+	Height      uint32
+	Format      string
+	VideoCodec  string
+	PixelFormat string
+	AudioCodec  string
+	Thumbnail   []byte
+}
+
+// playableVideo tells if WhatsApp clients can play the video stream inline,
+// which takes H.264 in 8 bit 4:2:0
+func (v videoInfo) playableVideo() bool {
+	return v.VideoCodec == "h264" && (v.PixelFormat == "" || v.PixelFormat == "yuv420p" || v.PixelFormat == "yuvj420p")
+}
+
+// playableAudio tells if the audio stream is AAC, or there is none
+func (v videoInfo) playableAudio() bool {
+	return v.AudioCodec == "" || v.AudioCodec == "aac"
+}
+
+// playable tells if WhatsApp clients can play the video inline as it is
+func (v videoInfo) playable() bool {
+	// ffprobe names the MP4 family of formats all together
+	return v.playableVideo() && v.playableAudio() && strings.Contains(v.Format, "mp4")
+}
+
+// prepareVideo probes a video and extracts its thumbnail. With convert set,
+// a video that does not play inline is remuxed to MP4, transcoding only the
+// streams that need it. The returned media replaces the given one when it
+// was converted, the caller closes both. Without a transcoder the video is
+// sent as it is, with no details
+func prepareVideo(media *sendMedia, convert bool) (*sendMedia, videoInfo, error) {
+	if mediaTranscoder == nil {
+		return media, videoInfo{}, nil
+	}
+	ctx, cancel := transcodeContext()
+	defer cancel()
+
+	out := media
+	info, err := mediaTranscoder.ProbeVideo(ctx, media.file.Name())
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not probe video")
+		return media, videoInfo{}, nil
+	}
+
+	if convert && !info.playable() {
+		f, err := os.CreateTemp("", "wuzapi-media-*.mp4")
+		if err != nil {
+			return nil, info, err
+		}
+		out = &sendMedia{file: f, mimeType: "video/mp4"}
+		log.Info().Str("format", info.Format).Str("video", info.VideoCodec).Str("audio", info.AudioCodec).Msg("Converting video to MP4")
+		if err := mediaTranscoder.VideoToMP4(ctx, media.file.Name(), f.Name(), !info.playableVideo(), !info.playableAudio()); err != nil {
+			out.Close()
+			return nil, info, fmt.Errorf("could not convert video: %w", err)
+		}
+		if stat, err := f.Stat(); err == nil {
+			out.size = stat.Size()
+		}
+		if converted, err := mediaTranscoder.ProbeVideo(ctx, f.Name()); err == nil {
+			info = converted
+		}
+	}
+
+	var frame bytes.Buffer
+	err = mediaTranscoder.VideoThumbnail(ctx, out.file.Name(), &frame)
+	if err == nil {
+		var img image.Image
+		if img, _, err = image.Decode(&frame); err == nil {
+			info.Thumbnail, _, err = encodeThumbnail(img, videoThumbnailSize)
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not extract video thumbnail")
+	}
+	return out, info, nil
+}
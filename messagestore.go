@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// StoredMessage is a row of the messages table
+type StoredMessage struct {
+	ID          string `db:"id" json:"id"`
+	ChatJID     string `db:"chat_jid" json:"chat_jid"`
+	SenderJID   string `db:"sender_jid" json:"sender_jid"`
+	IsFromMe    bool   `db:"is_from_me" json:"is_from_me"`
+	IsGroup     bool   `db:"is_group" json:"is_group"`
+	PushName    string `db:"push_name" json:"push_name"`
+	Timestamp   int64  `db:"timestamp" json:"timestamp"`
+	MessageType string `db:"message_type" json:"message_type"`
+	Text        string `db:"text" json:"text"`
+	Caption     string `db:"caption" json:"caption"`
+	MimeType    string `db:"mime_type" json:"mime_type"`
+	FileName    string `db:"file_name" json:"file_name"`
+	FileLength  int64  `db:"file_length" json:"file_length"`
+	RawMessage  string `db:"raw_message" json:"-"`
+}
+
+// messageQuery holds the filters accepted when listing stored messages
+type messageQuery struct {
+	Chat   string
+	Search string
+	Before int64
+	Limit  int
+	Offset int
+}
+
+const storedMessageColumns = "id, chat_jid, sender_jid, is_from_me, is_group, push_name, timestamp, message_type, text, caption, mime_type, file_name, file_length, raw_message"
+
+// setContent fills type, text and media metadata from the message protobuf
+func (m *StoredMessage) setContent(msg *waE2E.Message) {
+	if msg == nil {
+		m.MessageType = "unknown"
+		return
+	}
+
+	if raw, err := protojson.Marshal(msg); err == nil {
+		m.RawMessage = string(raw)
+	} else {
+		log.Warn().Err(err).Str("id", m.ID).Msg("Could not serialize message for storage")
+	}
+
+	switch {
+	case msg.GetConversation() != "":
+		m.MessageType = "text"
+		m.Text = msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		m.MessageType = "text"
+		m.Text = msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		img := msg.GetImageMessage()
+		m.MessageType = "image"
+		m.Caption = img.GetCaption()
+		m.MimeType = img.GetMimetype()
+		m.FileLength = int64(img.GetFileLength())
+	case msg.GetVideoMessage() != nil:
+		video := msg.GetVideoMessage()
+		m.MessageType = "video"
+		m.Caption = video.GetCaption()
+		m.MimeType = video.GetMimetype()
+		m.FileLength = int64(video.GetFileLength())
+	case msg.GetAudioMessage() != nil:
+		audio := msg.GetAudioMessage()
+		m.MessageType = "audio"
+		m.MimeType = audio.GetMimetype()
+		m.FileLength = int64(audio.GetFileLength())
+	case msg.GetDocumentMessage() != nil:
+		doc := msg.GetDocumentMessage()
+		m.MessageType = "document"
+		m.Caption = doc.GetCaption()
+		m.MimeType = doc.GetMimetype()
+		m.FileName = doc.GetFileName()
+		m.FileLength = int64(doc.GetFileLength())
+	case msg.GetStickerMessage() != nil:
+		sticker := msg.GetStickerMessage()
+		m.MessageType = "sticker"
+		m.MimeType = sticker.GetMimetype()
+		m.FileLength = int64(sticker.GetFileLength())
+	case msg.GetLocationMessage() != nil:
+		m.MessageType = "location"
+		m.Text = msg.GetLocationMessage().GetName()
+	case msg.GetContactMessage() != nil:
+		m.MessageType = "contact"
+		m.Text = msg.GetContactMessage().GetDisplayName()
+	case msg.GetReactionMessage() != nil:
+		m.MessageType = "reaction"
+		m.Text = msg.GetReactionMessage().GetText()
+	case msg.GetPollCreationMessage() != nil || msg.GetPollCreationMessageV3() != nil:
+		m.MessageType = "poll"
+		if msg.GetPollCreationMessage() != nil {
+			m.Text = msg.GetPollCreationMessage().GetName()
+		} else {
+			m.Text = msg.GetPollCreationMessageV3().GetName()
+		}
+	case msg.GetPollUpdateMessage() != nil:
+		m.MessageType = "poll_update"
+	case msg.GetButtonsMessage() != nil || msg.GetListMessage() != nil || msg.GetViewOnceMessage() != nil:
+		m.MessageType = "interactive"
+	case msg.GetProtocolMessage() != nil:
+		m.MessageType = "protocol"
+	default:
+		m.MessageType = "unknown"
+	}
+}
+
+// Message decodes the stored protobuf of the message
+func (m *StoredMessage) Message() (*waE2E.Message, error) {
+	if m.RawMessage == "" {
+		return nil, fmt.Errorf("message %s has no stored content", m.ID)
+	}
+	msg := &waE2E.Message{}
+	if err := protojson.Unmarshal([]byte(m.RawMessage), msg); err != nil {
+		return nil, fmt.Errorf("failed to decode stored message: %w", err)
+	}
+	return msg, nil
+}
+
+func saveMessage(db sqlx.Execer, userID string, m *StoredMessage) error {
+	_, err := db.Exec(`
+		INSERT INTO messages (user_id, `+storedMessageColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (user_id, id) DO NOTHING`,
+		userID, m.ID, m.ChatJID, m.SenderJID, m.IsFromMe, m.IsGroup, m.PushName, m.Timestamp,
+		m.MessageType, m.Text, m.Caption, m.MimeType, m.FileName, m.FileLength, m.RawMessage)
+	return err
+}
+
+// messageFromEvent builds the row of a received message
+func messageFromEvent(evt *events.Message) *StoredMessage {
+	m := &StoredMessage{
+		ID:        evt.Info.ID,
+		ChatJID:   evt.Info.Chat.String(),
+		SenderJID: evt.Info.Sender.String(),
+		IsFromMe:  evt.Info.IsFromMe,
+		IsGroup:   evt.Info.IsGroup,
+		PushName:  evt.Info.PushName,
+		Timestamp: evt.Info.Timestamp.Unix(),
+	}
+	m.setContent(evt.Message)
+	return m
+}
+
+// storeIncomingMessage records a message received through the websocket
+func storeIncomingMessage(db *sqlx.DB, userID string, evt *events.Message) {
+	m := messageFromEvent(evt)
+	if err := saveMessage(db, userID, m); err != nil {
+		log.Error().Err(err).Str("userID", userID).Str("id", m.ID).Msg("Failed to store incoming message")
+	}
+	touchConversation(db, userID, m.ChatJID, m.Timestamp)
+}
+
+// storeOutgoingMessage records a message sent through the API
+func storeOutgoingMessage(db *sqlx.DB, userID string, chat types.JID, messageID string, msg *waE2E.Message, timestamp time.Time) {
+	sender := ""
+	if client := clientManager.GetWhatsmeowClient(userID); client != nil && client.Store.ID != nil {
+		sender = client.Store.ID.ToNonAD().String()
+	}
+
+	m := &StoredMessage{
+		ID:        messageID,
+		ChatJID:   chat.String(),
+		SenderJID: sender,
+		IsFromMe:  true,
+		IsGroup:   chat.Server == types.GroupServer,
+		Timestamp: timestamp.Unix(),
+	}
+	m.setContent(msg)
+
+	if err := saveMessage(db, userID, m); err != nil {
+		log.Error().Err(err).Str("userID", userID).Str("id", m.ID).Msg("Failed to store outgoing message")
+	}
+	touchConversation(db, userID, m.ChatJID, m.Timestamp)
+}
+
+func getStoredMessage(db *sqlx.DB, userID string, messageID string) (*StoredMessage, error) {
+	var m StoredMessage
+	err := db.Get(&m, "SELECT "+storedMessageColumns+" FROM messages WHERE user_id = $1 AND id = $2", userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func listStoredMessages(db *sqlx.DB, userID string, q messageQuery) ([]StoredMessage, error) {
+	conditions := []string{"user_id = $1"}
+	args := []interface{}{userID}
+
+	if q.Chat != "" {
+		args = append(args, q.Chat)
+		conditions = append(conditions, fmt.Sprintf("chat_jid = $%d", len(args)))
+	}
+	if q.Search != "" {
+		args = append(args, "%"+strings.ToLower(q.Search)+"%")
+		conditions = append(conditions, fmt.Sprintf("(LOWER(text) LIKE $%d OR LOWER(caption) LIKE $%d)", len(args), len(args)))
+	}
+	if q.Before > 0 {
+		args = append(args, q.Before)
+		conditions = append(conditions, fmt.Sprintf("timestamp < $%d", len(args)))
+	}
+
+	args = append(args, q.Limit, q.Offset)
+	query := fmt.Sprintf("SELECT %s FROM messages WHERE %s ORDER BY timestamp DESC, id DESC LIMIT $%d OFFSET $%d",
+		storedMessageColumns, strings.Join(conditions, " AND "), len(args)-1, len(args))
+
+	messages := []StoredMessage{}
+	if err := db.Select(&messages, query, args...); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// oldestStoredMessage returns the earliest stored message of a chat
+func oldestStoredMessage(db *sqlx.DB, userID string, chat string) (*StoredMessage, error) {
+	var m StoredMessage
+	err := db.Get(&m, "SELECT "+storedMessageColumns+" FROM messages WHERE user_id = $1 AND chat_jid = $2 ORDER BY timestamp, id LIMIT 1", userID, chat)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -16,6 +16,9 @@ type Migration struct {
 	DownSQL string
 }
 
+// UpSQL is written for PostgreSQL. Migrations that only create tables and
+// indexes run as is on SQLite too, the ones adding columns have a SQLite
+// branch in applyMigration
 var migrations = []Migration{
 	{
 		ID:    1,
@@ -50,6 +53,71 @@ var migrations = []Migration{
 		Name:  "add_s3_support",
 		UpSQL: addS3SupportSQL,
 	},
+	{
+		ID:    5,
+		Name:  "add_message_store",
+		UpSQL: addMessageStoreSQL,
+	},
+	{
+		ID:    6,
+		Name:  "add_webhook_outbox",
+		UpSQL: addWebhookOutboxSQL,
+	},
+	{
+		ID:    7,
+		Name:  "add_webhook_signing",
+		UpSQL: addWebhookSigningSQL,
+	},
+	{
+		ID:    8,
+		Name:  "add_webhook_endpoints",
+		UpSQL: addWebhookEndpointsSQL,
+	},
+	{
+		ID:    9,
+		Name:  "add_reconnect_stats",
+		UpSQL: addReconnectStatsSQL,
+	},
+	{
+		ID:    10,
+		Name:  "add_expiration_notice",
+		UpSQL: addExpirationNoticeSQL,
+	},
+	{
+		ID:    11,
+		Name:  "add_scheduled_messages",
+		UpSQL: addScheduledMessagesSQL,
+	},
+	{
+		ID:    12,
+		Name:  "add_send_rate_limit",
+		UpSQL: addSendRateLimitSQL,
+	},
+	{
+		ID:    13,
+		Name:  "add_bulk_jobs",
+		UpSQL: addBulkJobsSQL,
+	},
+	{
+		ID:    14,
+		Name:  "add_poll_votes",
+		UpSQL: addPollVotesSQL,
+	},
+	{
+		ID:    15,
+		Name:  "add_call_handling",
+		UpSQL: addCallHandlingSQL,
+	},
+	{
+		ID:    16,
+		Name:  "add_webhook_schema",
+		UpSQL: addWebhookSchemaSQL,
+	},
+	{
+		ID:    17,
+		Name:  "add_conversations",
+		UpSQL: addConversationsSQL,
+	},
 }
 
 const changeIDToStringSQL = `
@@ -143,6 +211,287 @@ BEGIN
 END $$;
 `
 
+const addMessageStoreSQL = `
+CREATE TABLE IF NOT EXISTS messages (
+    user_id TEXT NOT NULL,
+    id TEXT NOT NULL,
+    chat_jid TEXT NOT NULL,
+    sender_jid TEXT NOT NULL DEFAULT '',
+    is_from_me BOOLEAN NOT NULL DEFAULT FALSE,
+    is_group BOOLEAN NOT NULL DEFAULT FALSE,
+    push_name TEXT NOT NULL DEFAULT '',
+    timestamp BIGINT NOT NULL,
+    message_type TEXT NOT NULL DEFAULT '',
+    text TEXT NOT NULL DEFAULT '',
+    caption TEXT NOT NULL DEFAULT '',
+    mime_type TEXT NOT NULL DEFAULT '',
+    file_name TEXT NOT NULL DEFAULT '',
+    file_length BIGINT NOT NULL DEFAULT 0,
+    raw_message TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (user_id, id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_chat ON messages (user_id, chat_jid, timestamp);
+`
+
+const addWebhookOutboxSQL = `
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    format TEXT NOT NULL DEFAULT 'form',
+    payload TEXT NOT NULL,
+    file_path TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at BIGINT NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_outbox_next_attempt ON webhook_outbox (next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    format TEXT NOT NULL DEFAULT 'form',
+    payload TEXT NOT NULL,
+    file_path TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at BIGINT NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL,
+    failed_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_dead_letters_user ON webhook_dead_letters (user_id, failed_at);
+`
+
+const addWebhookSigningSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'webhook_secret') THEN
+        ALTER TABLE users ADD COLUMN webhook_secret TEXT DEFAULT '';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'webhook_omit_token') THEN
+        ALTER TABLE users ADD COLUMN webhook_omit_token BOOLEAN DEFAULT FALSE;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_outbox' AND column_name = 'source') THEN
+        ALTER TABLE webhook_outbox ADD COLUMN source TEXT NOT NULL DEFAULT 'user';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_dead_letters' AND column_name = 'source') THEN
+        ALTER TABLE webhook_dead_letters ADD COLUMN source TEXT NOT NULL DEFAULT 'user';
+    END IF;
+END $$;
+`
+
+const addWebhookEndpointsSQL = `
+-- PostgreSQL version
+CREATE TABLE IF NOT EXISTS webhooks (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    events TEXT NOT NULL DEFAULT '',
+    format TEXT NOT NULL DEFAULT 'json',
+    headers TEXT NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhooks_user ON webhooks (user_id);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_outbox' AND column_name = 'headers') THEN
+        ALTER TABLE webhook_outbox ADD COLUMN headers TEXT NOT NULL DEFAULT '';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_dead_letters' AND column_name = 'headers') THEN
+        ALTER TABLE webhook_dead_letters ADD COLUMN headers TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+`
+
+const addReconnectStatsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'disconnect_count') THEN
+        ALTER TABLE users ADD COLUMN disconnect_count INTEGER NOT NULL DEFAULT 0;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'reconnect_failures') THEN
+        ALTER TABLE users ADD COLUMN reconnect_failures INTEGER NOT NULL DEFAULT 0;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'last_disconnect_at') THEN
+        ALTER TABLE users ADD COLUMN last_disconnect_at BIGINT NOT NULL DEFAULT 0;
+    END IF;
+END $$;
+`
+
+const addExpirationNoticeSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'expiration_notice') THEN
+        ALTER TABLE users ADD COLUMN expiration_notice INTEGER NOT NULL DEFAULT 0;
+    END IF;
+END $$;
+`
+
+const addScheduledMessagesSQL = `
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    path TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    send_at BIGINT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    message_id TEXT NOT NULL DEFAULT '',
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL,
+    sent_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due ON scheduled_messages (status, send_at);
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_user ON scheduled_messages (user_id, send_at);
+`
+
+const addSendRateLimitSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'ratelimit_enabled') THEN
+        ALTER TABLE users ADD COLUMN ratelimit_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'ratelimit_per_minute') THEN
+        ALTER TABLE users ADD COLUMN ratelimit_per_minute INTEGER NOT NULL DEFAULT 20;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'ratelimit_burst') THEN
+        ALTER TABLE users ADD COLUMN ratelimit_burst INTEGER NOT NULL DEFAULT 5;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'ratelimit_min_delay_ms') THEN
+        ALTER TABLE users ADD COLUMN ratelimit_min_delay_ms INTEGER NOT NULL DEFAULT 1000;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'ratelimit_max_delay_ms') THEN
+        ALTER TABLE users ADD COLUMN ratelimit_max_delay_ms INTEGER NOT NULL DEFAULT 4000;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'ratelimit_typing') THEN
+        ALTER TABLE users ADD COLUMN ratelimit_typing BOOLEAN NOT NULL DEFAULT FALSE;
+    END IF;
+END $$;
+`
+
+const addBulkJobsSQL = `
+CREATE TABLE IF NOT EXISTS bulk_jobs (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    template TEXT NOT NULL,
+    check_numbers BOOLEAN NOT NULL DEFAULT TRUE,
+    status TEXT NOT NULL DEFAULT 'running',
+    created_at BIGINT NOT NULL,
+    finished_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_user ON bulk_jobs (user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS bulk_job_recipients (
+    job_id TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    phone TEXT NOT NULL,
+    jid TEXT NOT NULL DEFAULT '',
+    variables TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'pending',
+    message_id TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    sent_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (job_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS idx_bulk_job_recipients_status ON bulk_job_recipients (job_id, status, position);
+`
+
+const addPollVotesSQL = `
+CREATE TABLE IF NOT EXISTS poll_votes (
+    user_id TEXT NOT NULL,
+    poll_id TEXT NOT NULL,
+    chat_jid TEXT NOT NULL,
+    voter_jid TEXT NOT NULL,
+    options TEXT NOT NULL DEFAULT '[]',
+    timestamp BIGINT NOT NULL,
+    PRIMARY KEY (user_id, poll_id, voter_jid)
+);
+`
+
+const addCallHandlingSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'call_policy') THEN
+        ALTER TABLE users ADD COLUMN call_policy TEXT NOT NULL DEFAULT 'ignore';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'call_reject_message') THEN
+        ALTER TABLE users ADD COLUMN call_reject_message TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+
+` + callLogTableSQL
+
+const callLogTableSQL = `
+CREATE TABLE IF NOT EXISTS call_log (
+    user_id TEXT NOT NULL,
+    call_id TEXT NOT NULL,
+    from_jid TEXT NOT NULL,
+    group_jid TEXT NOT NULL DEFAULT '',
+    is_video BOOLEAN NOT NULL DEFAULT FALSE,
+    is_group BOOLEAN NOT NULL DEFAULT FALSE,
+    status TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    started_at BIGINT NOT NULL,
+    ended_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, call_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_call_log_user ON call_log (user_id, started_at);
+`
+
+const addWebhookSchemaSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'webhook_schema') THEN
+        ALTER TABLE users ADD COLUMN webhook_schema TEXT NOT NULL DEFAULT 'v1';
+    END IF;
+END $$;
+`
+
+const addConversationsSQL = `
+CREATE TABLE IF NOT EXISTS conversations (
+    user_id TEXT NOT NULL,
+    chat_jid TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    unread_count INTEGER NOT NULL DEFAULT 0,
+    archived BOOLEAN NOT NULL DEFAULT FALSE,
+    pinned BOOLEAN NOT NULL DEFAULT FALSE,
+    last_message_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, chat_jid)
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversations_last_message ON conversations (user_id, last_message_at);
+`
+
 // GenerateRandomID creates a random string ID
 func GenerateRandomID() (string, error) {
 	bytes := make([]byte, 16) // 128 bits
@@ -314,6 +663,98 @@ func applyMigration(db *sqlx.DB, migration Migration) error {
 		} else {
 			_, err = tx.Exec(migration.UpSQL)
 		}
+	} else if migration.ID == 7 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "webhook_secret", "TEXT DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "webhook_omit_token", "BOOLEAN DEFAULT 0")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhook_outbox", "source", "TEXT NOT NULL DEFAULT 'user'")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhook_dead_letters", "source", "TEXT NOT NULL DEFAULT 'user'")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 8 {
+		if db.DriverName() == "sqlite" {
+			_, err = tx.Exec(`
+                CREATE TABLE IF NOT EXISTS webhooks (
+                    id TEXT PRIMARY KEY,
+                    user_id TEXT NOT NULL,
+                    url TEXT NOT NULL,
+                    events TEXT NOT NULL DEFAULT '',
+                    format TEXT NOT NULL DEFAULT 'json',
+                    headers TEXT NOT NULL DEFAULT '{}',
+                    active BOOLEAN NOT NULL DEFAULT 1,
+                    created_at BIGINT NOT NULL
+                );
+                CREATE INDEX IF NOT EXISTS idx_webhooks_user ON webhooks (user_id)`)
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhook_outbox", "headers", "TEXT NOT NULL DEFAULT ''")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhook_dead_letters", "headers", "TEXT NOT NULL DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 9 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "disconnect_count", "INTEGER NOT NULL DEFAULT 0")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "reconnect_failures", "INTEGER NOT NULL DEFAULT 0")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "last_disconnect_at", "BIGINT NOT NULL DEFAULT 0")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 10 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "expiration_notice", "INTEGER NOT NULL DEFAULT 0")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 12 {
+		if db.DriverName() == "sqlite" {
+			columns := [][2]string{
+				{"ratelimit_enabled", "BOOLEAN NOT NULL DEFAULT 0"},
+				{"ratelimit_per_minute", "INTEGER NOT NULL DEFAULT 20"},
+				{"ratelimit_burst", "INTEGER NOT NULL DEFAULT 5"},
+				{"ratelimit_min_delay_ms", "INTEGER NOT NULL DEFAULT 1000"},
+				{"ratelimit_max_delay_ms", "INTEGER NOT NULL DEFAULT 4000"},
+				{"ratelimit_typing", "BOOLEAN NOT NULL DEFAULT 0"},
+			}
+			for _, c := range columns {
+				if err = addColumnIfNotExistsSQLite(tx, "users", c[0], c[1]); err != nil {
+					break
+				}
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 16 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "webhook_schema", "TEXT NOT NULL DEFAULT 'v1'")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 15 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "call_policy", "TEXT NOT NULL DEFAULT 'ignore'")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "call_reject_message", "TEXT NOT NULL DEFAULT ''")
+			}
+			if err == nil {
+				_, err = tx.Exec(callLogTableSQL)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
 	} else {
 		_, err = tx.Exec(migration.UpSQL)
 	}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Kinds of message content
+const (
+	contentText        = "text"
+	contentImage       = "image"
+	contentVideo       = "video"
+	contentAudio       = "audio"
+	contentDocument    = "document"
+	contentSticker     = "sticker"
+	contentLocation    = "location"
+	contentContact     = "contact"
+	contentReaction    = "reaction"
+	contentEdit        = "edit"
+	contentRevoke      = "revoke"
+	contentPoll        = "poll"
+	contentPollUpdate  = "poll_update"
+	contentInteractive = "interactive"
+	contentProtocol    = "protocol"
+	contentUnknown     = "unknown"
+)
+
+// MessageContent is the content of a message in one flat shape, whichever
+// protobuf field it arrived in
+type MessageContent struct {
+	Kind         string           `json:"kind"`
+	Text         string           `json:"text,omitempty" doc:"Text of the message, new text of an edit or emoji of a reaction, empty when a reaction is removed"`
+	Caption      string           `json:"caption,omitempty"`
+	Media        *ContentMedia    `json:"media,omitempty"`
+	QuotedID     string           `json:"quotedId,omitempty" doc:"Id of the message replied to"`
+	QuotedSender string           `json:"quotedSender,omitempty"`
+	Mentions     []string         `json:"mentions,omitempty"`
+	Forwarded    bool             `json:"forwarded,omitempty"`
+	ViewOnce     bool             `json:"viewOnce,omitempty"`
+	Target       *ContentTarget   `json:"target,omitempty" doc:"Message a reaction, edit, revoke or poll vote applies to"`
+	Location     *ContentLocation `json:"location,omitempty"`
+	Contacts     []ContentContact `json:"contacts,omitempty"`
+	Poll         *ContentPoll     `json:"poll,omitempty"`
+}
+
+// ContentMedia describes the media of a message, the file itself is
+// delivered apart as base64 or S3 upload
+type ContentMedia struct {
+	MimeType   string `json:"mimeType,omitempty"`
+	FileName   string `json:"fileName,omitempty"`
+	FileLength int64  `json:"fileLength,omitempty"`
+	Seconds    uint32 `json:"seconds,omitempty"`
+	Width      uint32 `json:"width,omitempty"`
+	Height     uint32 `json:"height,omitempty"`
+	VoiceNote  bool   `json:"voiceNote,omitempty"`
+	Animated   bool   `json:"animated,omitempty"`
+}
+
+// ContentTarget is the message another message acts on
+type ContentTarget struct {
+	ID     string `json:"id"`
+	Chat   string `json:"chat,omitempty"`
+	Sender string `json:"sender,omitempty" doc:"Author of the target message in groups"`
+	FromMe bool   `json:"fromMe"`
+}
+
+type ContentLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+	Live      bool    `json:"live,omitempty"`
+}
+
+type ContentContact struct {
+	DisplayName string `json:"displayName"`
+	VCard       string `json:"vcard"`
+}
+
+type ContentPoll struct {
+	Question        string   `json:"question"`
+	Options         []string `json:"options"`
+	SelectableCount uint32   `json:"selectableCount" doc:"0 when any number of options can be chosen"`
+}
+
+// normalizeMessage reads the content of a received message
+func normalizeMessage(evt *events.Message) *MessageContent {
+	content := normalizeContent(evt.Message)
+	content.ViewOnce = evt.IsViewOnce
+	return content
+}
+
+// normalizeContent reads the content of a message, with its reply,
+// mentions and forward from the ContextInfo of the content
+func normalizeContent(msg *waE2E.Message) *MessageContent {
+	content := &MessageContent{Kind: contentUnknown}
+	if msg == nil {
+		return content
+	}
+
+	switch {
+	case msg.Conversation != nil:
+		content.Kind = contentText
+		content.Text = msg.GetConversation()
+	case msg.ExtendedTextMessage != nil:
+		content.Kind = contentText
+		content.Text = msg.ExtendedTextMessage.GetText()
+	case msg.ImageMessage != nil:
+		img := msg.ImageMessage
+		content.Kind = contentImage
+		content.Caption = img.GetCaption()
+		content.Media = &ContentMedia{
+			MimeType:   img.GetMimetype(),
+			FileLength: int64(img.GetFileLength()),
+			Width:      img.GetWidth(),
+			Height:     img.GetHeight(),
+		}
+	case msg.VideoMessage != nil || msg.PtvMessage != nil:
+		video := msg.VideoMessage
+		if video == nil {
+			video = msg.PtvMessage
+		}
+		content.Kind = contentVideo
+		content.Caption = video.GetCaption()
+		content.Media = &ContentMedia{
+			MimeType:   video.GetMimetype(),
+			FileLength: int64(video.GetFileLength()),
+			Seconds:    video.GetSeconds(),
+			Width:      video.GetWidth(),
+			Height:     video.GetHeight(),
+			Animated:   video.GetGifPlayback(),
+		}
+	case msg.AudioMessage != nil:
+		audio := msg.AudioMessage
+		content.Kind = contentAudio
+		content.Media = &ContentMedia{
+			MimeType:   audio.GetMimetype(),
+			FileLength: int64(audio.GetFileLength()),
+			Seconds:    audio.GetSeconds(),
+			VoiceNote:  audio.GetPTT(),
+		}
+	case msg.DocumentMessage != nil:
+		doc := msg.DocumentMessage
+		content.Kind = contentDocument
+		content.Caption = doc.GetCaption()
+		content.Media = &ContentMedia{
+			MimeType:   doc.GetMimetype(),
+			FileName:   doc.GetFileName(),
+			FileLength: int64(doc.GetFileLength()),
+		}
+	case msg.StickerMessage != nil:
+		sticker := msg.StickerMessage
+		content.Kind = contentSticker
+		content.Media = &ContentMedia{
+			MimeType:   sticker.GetMimetype(),
+			FileLength: int64(sticker.GetFileLength()),
+			Width:      sticker.GetWidth(),
+			Height:     sticker.GetHeight(),
+			Animated:   sticker.GetIsAnimated(),
+		}
+	case msg.LocationMessage != nil:
+		location := msg.LocationMessage
+		content.Kind = contentLocation
+		content.Location = &ContentLocation{
+			Latitude:  location.GetDegreesLatitude(),
+			Longitude: location.GetDegreesLongitude(),
+			Name:      location.GetName(),
+			Address:   location.GetAddress(),
+		}
+	case msg.LiveLocationMessage != nil:
+		location := msg.LiveLocationMessage
+		content.Kind = contentLocation
+		content.Caption = location.GetCaption()
+		content.Location = &ContentLocation{
+			Latitude:  location.GetDegreesLatitude(),
+			Longitude: location.GetDegreesLongitude(),
+			Live:      true,
+		}
+	case msg.ContactMessage != nil:
+		content.Kind = contentContact
+		content.Contacts = []ContentContact{{DisplayName: msg.ContactMessage.GetDisplayName(), VCard: msg.ContactMessage.GetVcard()}}
+	case msg.ContactsArrayMessage != nil:
+		content.Kind = contentContact
+		content.Text = msg.ContactsArrayMessage.GetDisplayName()
+		for _, contact := range msg.ContactsArrayMessage.GetContacts() {
+			content.Contacts = append(content.Contacts, ContentContact{DisplayName: contact.GetDisplayName(), VCard: contact.GetVcard()})
+		}
+	case msg.ReactionMessage != nil:
+		content.Kind = contentReaction
+		content.Text = msg.ReactionMessage.GetText()
+		content.Target = contentTarget(msg.ReactionMessage.GetKey())
+	case pollCreation(msg) != nil:
+		poll := pollCreation(msg)
+		content.Kind = contentPoll
+		content.Text = poll.GetName()
+		content.Poll = &ContentPoll{Question: poll.GetName(), Options: []string{}, SelectableCount: poll.GetSelectableOptionsCount()}
+		for _, option := range poll.GetOptions() {
+			content.Poll.Options = append(content.Poll.Options, option.GetOptionName())
+		}
+	case msg.PollUpdateMessage != nil:
+		// The vote itself is encrypted, it is emitted decrypted as PollVote
+		content.Kind = contentPollUpdate
+		content.Target = contentTarget(msg.PollUpdateMessage.GetPollCreationMessageKey())
+	case msg.ProtocolMessage != nil:
+		return normalizeProtocolMessage(msg.ProtocolMessage)
+	case msg.ButtonsMessage != nil || msg.ListMessage != nil || msg.TemplateMessage != nil || msg.InteractiveMessage != nil:
+		content.Kind = contentInteractive
+	}
+
+	if ci := getContextInfo(msg); ci != nil {
+		content.QuotedID = ci.GetStanzaID()
+		content.QuotedSender = ci.GetParticipant()
+		content.Mentions = ci.GetMentionedJID()
+		content.Forwarded = ci.GetIsForwarded()
+	}
+	return content
+}
+
+// normalizeProtocolMessage reads edits and revokes, other protocol messages
+// are only given their kind
+func normalizeProtocolMessage(protocol *waE2E.ProtocolMessage) *MessageContent {
+	switch protocol.GetType() {
+	case waE2E.ProtocolMessage_MESSAGE_EDIT:
+		// An edit carries the whole new content of the message
+		content := normalizeContent(protocol.GetEditedMessage())
+		content.Kind = contentEdit
+		content.Target = contentTarget(protocol.GetKey())
+		return content
+	case waE2E.ProtocolMessage_REVOKE:
+		return &MessageContent{Kind: contentRevoke, Target: contentTarget(protocol.GetKey())}
+	}
+	return &MessageContent{Kind: contentProtocol}
+}
+
+func contentTarget(key *waCommon.MessageKey) *ContentTarget {
+	if key == nil {
+		return nil
+	}
+	return &ContentTarget{
+		ID:     key.GetID(),
+		Chat:   key.GetRemoteJID(),
+		Sender: key.GetParticipant(),
+		FromMe: key.GetFromMe(),
+	}
+}
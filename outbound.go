@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// RateLimitSettings paces the sends of a session
+type RateLimitSettings struct {
+	Enabled    bool `db:"ratelimit_enabled" json:"enabled"`
+	PerMinute  int  `db:"ratelimit_per_minute" json:"messagesPerMinute"`
+	Burst      int  `db:"ratelimit_burst" json:"burst"`
+	MinDelayMs int  `db:"ratelimit_min_delay_ms" json:"minDelayMs"`
+	MaxDelayMs int  `db:"ratelimit_max_delay_ms" json:"maxDelayMs"`
+	Typing     bool `db:"ratelimit_typing" json:"typing"`
+}
+
+const rateLimitColumns = "ratelimit_enabled, ratelimit_per_minute, ratelimit_burst, ratelimit_min_delay_ms, ratelimit_max_delay_ms, ratelimit_typing"
+
+func (rl RateLimitSettings) validate() error {
+	if rl.PerMinute < 1 || rl.PerMinute > 600 {
+		return errors.New("messagesPerMinute must be between 1 and 600")
+	}
+	if rl.Burst < 1 {
+		return errors.New("burst must be at least 1")
+	}
+	if rl.MinDelayMs < 0 || rl.MaxDelayMs < rl.MinDelayMs || rl.MaxDelayMs > 60000 {
+		return errors.New("delays must satisfy 0 <= minDelayMs <= maxDelayMs <= 60000")
+	}
+	return nil
+}
+
+// humanDelay picks a random pause between the configured bounds
+func (rl RateLimitSettings) humanDelay() time.Duration {
+	delay := rl.MinDelayMs
+	if spread := rl.MaxDelayMs - rl.MinDelayMs; spread > 0 {
+		delay += rand.Intn(spread + 1)
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+type outboundJob struct {
+	// Row of the job in scheduled_messages
+	rowID    string
+	id       string
+	path     string
+	phone    string
+	body     []byte
+	token    string
+	queuedAt time.Time
+	// Set for scheduled messages, which report the outcome themselves
+	done func(data map[string]interface{}, err error)
+}
+
+// OutboundQueue sends the queued messages of one session, paced by a token bucket
+type OutboundQueue struct {
+	userID   string
+	jobs     chan outboundJob
+	start    sync.Once
+	stop     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+	settings RateLimitSettings
+	tokens   float64
+	refilled time.Time
+}
+
+// OutboundQueues holds the queue of every session that sent something
+type OutboundQueues struct {
+	s      *server
+	size   int
+	mu     sync.Mutex
+	queues map[string]*OutboundQueue
+}
+
+var outboundQueues *OutboundQueues
+
+// InitOutboundQueues prepares the per session outbound queues
+func (s *server) InitOutboundQueues() {
+	outboundQueues = &OutboundQueues{
+		s:      s,
+		size:   envInt("OUTBOUND_QUEUE_SIZE", 1000),
+		queues: make(map[string]*OutboundQueue),
+	}
+	s.failInterruptedJobs()
+}
+
+// failInterruptedJobs reports the messages that were still queued when the
+// server stopped. They are not sent late, the client may have retried them
+func (s *server) failInterruptedJobs() {
+	var jobs []struct {
+		ScheduledMessage
+		Token string `db:"token"`
+	}
+	err := s.db.Select(&jobs, `
+		SELECT m.id, m.user_id, m.path, m.message_id, m.created_at, u.token
+		FROM scheduled_messages m JOIN users u ON u.id = m.user_id
+		WHERE m.status=$1`, scheduledQueued)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load interrupted outbound messages")
+		return
+	}
+	for _, job := range jobs {
+		log.Warn().Str("id", job.MessageID).Str("userID", job.UserID).Msg("Queued message interrupted by restart")
+		sendEventWithWebHook(userEventClient(s, job.UserID, job.Token), map[string]interface{}{
+			"type": "MessageFailed",
+			"event": map[string]interface{}{
+				"id":       job.MessageID,
+				"path":     job.Path,
+				"queuedAt": job.CreatedAt,
+				"error":    "interrupted by restart",
+			},
+		}, "")
+	}
+	if _, err := s.db.Exec("DELETE FROM scheduled_messages WHERE status=$1", scheduledQueued); err != nil {
+		log.Error().Err(err).Msg("Failed to clear interrupted outbound messages")
+	}
+}
+
+// Get returns the queue of a user, loading its settings on first use
+func (oq *OutboundQueues) Get(userID string) (*OutboundQueue, error) {
+	oq.mu.Lock()
+	defer oq.mu.Unlock()
+	if q, ok := oq.queues[userID]; ok {
+		return q, nil
+	}
+	var settings RateLimitSettings
+	if err := oq.s.db.Get(&settings, "SELECT "+rateLimitColumns+" FROM users WHERE id=$1", userID); err != nil {
+		return nil, err
+	}
+	q := &OutboundQueue{
+		userID:   userID,
+		jobs:     make(chan outboundJob, oq.size),
+		stop:     make(chan struct{}),
+		settings: settings,
+		tokens:   float64(settings.Burst),
+		refilled: time.Now(),
+	}
+	oq.queues[userID] = q
+	return q, nil
+}
+
+// Delete stops the queue of a user and forgets it, the messages still
+// waiting in it are dropped
+func (oq *OutboundQueues) Delete(userID string) {
+	oq.mu.Lock()
+	defer oq.mu.Unlock()
+	if q, ok := oq.queues[userID]; ok {
+		q.Stop()
+		delete(oq.queues, userID)
+	}
+}
+
+// Settings returns the current pacing settings
+func (q *OutboundQueue) Settings() RateLimitSettings {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.settings
+}
+
+// SetSettings applies new pacing settings to the running queue
+func (q *OutboundQueue) SetSettings(settings RateLimitSettings) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.settings = settings
+	if q.tokens > float64(settings.Burst) {
+		q.tokens = float64(settings.Burst)
+	}
+}
+
+// Len is the number of messages waiting to be sent
+func (q *OutboundQueue) Len() int {
+	return len(q.jobs)
+}
+
+// reserve takes a token from the bucket and returns how long to wait for it
+func (q *OutboundQueue) reserve() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	rate := float64(q.settings.PerMinute) / 60
+	q.tokens += now.Sub(q.refilled).Seconds() * rate
+	if q.tokens > float64(q.settings.Burst) {
+		q.tokens = float64(q.settings.Burst)
+	}
+	q.refilled = now
+	q.tokens--
+	if q.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-q.tokens / rate * float64(time.Second))
+}
+
+// Stop ends the goroutine sending the queued messages. The channel is left
+// open, sends racing the stop must not panic
+func (q *OutboundQueue) Stop() {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+}
+
+func (q *OutboundQueue) enqueue(job outboundJob) bool {
+	select {
+	case <-q.stop:
+		return false
+	default:
+	}
+	q.start.Do(func() {
+		go q.run()
+	})
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *OutboundQueue) run() {
+	for {
+		var job outboundJob
+		select {
+		case <-q.stop:
+			return
+		case job = <-q.jobs:
+		}
+		if !q.wait(q.reserve()) {
+			return
+		}
+
+		settings := q.Settings()
+		delay := settings.humanDelay()
+		if settings.Typing && job.path == "/chat/send/text" {
+			q.composing(job.phone)
+		}
+		if !q.wait(delay) {
+			return
+		}
+
+		q.send(job)
+	}
+}
+
+// wait pauses the queue, it is false when the queue was stopped meanwhile
+func (q *OutboundQueue) wait(d time.Duration) bool {
+	select {
+	case <-q.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// composing shows the typing indicator to the recipient during the pause
+func (q *OutboundQueue) composing(phone string) {
+	client := clientManager.GetWhatsmeowClient(q.userID)
+	if client == nil || phone == "" {
+		return
+	}
+	jid, ok := parseJID(phone)
+	if !ok {
+		return
+	}
+	if err := client.SendChatPresence(jid, types.ChatPresenceComposing, types.ChatPresenceMediaText); err != nil {
+		log.Warn().Err(err).Str("userID", q.userID).Msg("Failed to send composing presence")
+	}
+}
+
+func (q *OutboundQueue) send(job outboundJob) {
+	data, err := outboundQueues.s.replaySend(job.token, job.path, job.body, job.id)
+	if job.done != nil {
+		job.done(data, err)
+		return
+	}
+	if _, dbErr := outboundQueues.s.db.Exec("DELETE FROM scheduled_messages WHERE id=$1", job.rowID); dbErr != nil {
+		log.Error().Err(dbErr).Str("id", job.id).Msg("Failed to remove sent message from the queue")
+	}
+	event := map[string]interface{}{
+		"id":       job.id,
+		"path":     job.path,
+		"queuedAt": job.queuedAt.Unix(),
+	}
+	eventType := "MessageSent"
+	if err != nil {
+		log.Warn().Err(err).Str("id", job.id).Str("userID", q.userID).Msg("Queued message failed")
+		eventType = "MessageFailed"
+		event["error"] = err.Error()
+	} else {
+		log.Info().Str("id", job.id).Str("userID", q.userID).Msg("Queued message sent")
+		event["timestamp"] = data["Timestamp"]
+	}
+	sendEventWithWebHook(userEventClient(outboundQueues.s, q.userID, job.token), map[string]interface{}{
+		"type":  eventType,
+		"event": event,
+	}, "")
+}
+
+// payloadPhone reads the recipient of a send request, for the typing indicator
+func payloadPhone(body []byte) string {
+	fields := map[string]json.RawMessage{}
+	json.Unmarshal(body, &fields)
+	var phone string
+	for key, value := range fields {
+		if strings.ToLower(key) == "phone" {
+			json.Unmarshal(value, &phone)
+		}
+	}
+	return phone
+}
+
+// queueSend hands send requests of sessions with rate limiting enabled to
+// their outbound queue. The message id is generated up front so it can be
+// returned right away and matches the id of the message once sent
+func (s *server) queueSend(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isReplayed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		token := r.Context().Value("userinfo").(Values).Get("Token")
+		q, err := outboundQueues.Get(txtid)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to load rate limit settings")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to load rate limit settings"))
+			return
+		}
+		settings := q.Settings()
+		if !settings.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isMultipartRequest(r) {
+			// Uploads are not kept around to be queued, the request waits
+			// for its turn instead
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(q.reserve() + settings.humanDelay()):
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := clientManager.GetWhatsmeowClient(txtid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not read payload"))
+			return
+		}
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			// Let the handler report the malformed payload
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		job := outboundJob{path: r.URL.Path, token: token, queuedAt: time.Now()}
+		for key, value := range fields {
+			switch strings.ToLower(key) {
+			case "id":
+				json.Unmarshal(value, &job.id)
+				delete(fields, key)
+			case "phone":
+				json.Unmarshal(value, &job.phone)
+			}
+		}
+		if job.id == "" {
+			job.id = client.GenerateMessageID()
+		}
+		idJson, _ := json.Marshal(job.id)
+		fields["Id"] = idJson
+		if job.body, err = json.Marshal(fields); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		// The job is stored so a restart can report it instead of losing it
+		if job.rowID, err = GenerateRandomID(); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		err = storeScheduledMessage(s.db, ScheduledMessage{
+			ID:        job.rowID,
+			UserID:    txtid,
+			Path:      job.path,
+			RawBody:   string(job.body),
+			SendAt:    job.queuedAt.Unix(),
+			Status:    scheduledQueued,
+			MessageID: job.id,
+			CreatedAt: job.queuedAt.Unix(),
+		})
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to store queued message")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to queue message"))
+			return
+		}
+		if !q.enqueue(job) {
+			s.db.Exec("DELETE FROM scheduled_messages WHERE id=$1", job.rowID)
+			s.Respond(w, r, http.StatusTooManyRequests, errors.New("outbound queue is full"))
+			return
+		}
+		log.Info().Str("id", job.id).Str("path", job.path).Int("queued", q.Len()).Msg("Message queued")
+		sendEventWithWebHook(userEventClient(s, txtid, token), map[string]interface{}{
+			"type": "MessageQueued",
+			"event": map[string]interface{}{
+				"id":       job.id,
+				"path":     job.path,
+				"queuedAt": job.queuedAt.Unix(),
+			},
+		}, "")
+
+		response := map[string]interface{}{"Details": "Queued", "Id": job.id, "Queued": q.Len()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	})
+}
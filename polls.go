@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+var errPollNotFound = errors.New("poll not found")
+
+// PollVote is the current vote of a voter in a poll, an empty Options means
+// the vote was taken back
+type PollVote struct {
+	PollID     string   `db:"poll_id" json:"poll_id"`
+	ChatJID    string   `db:"chat_jid" json:"chat_jid"`
+	VoterJID   string   `db:"voter_jid" json:"voter_jid"`
+	RawOptions string   `db:"options" json:"-"`
+	Options    []string `db:"-" json:"options"`
+	Timestamp  int64    `db:"timestamp" json:"timestamp"`
+}
+
+// PollOptionResult is the tally of one option of a poll
+type PollOptionResult struct {
+	Name   string   `json:"name"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters"`
+}
+
+// PollResults is the state of a poll from the votes received so far
+type PollResults struct {
+	PollID          string             `json:"poll_id"`
+	ChatJID         string             `json:"chat_jid"`
+	Question        string             `json:"question"`
+	SelectableCount uint32             `json:"selectable_count"`
+	Options         []PollOptionResult `json:"options"`
+	Votes           []PollVote         `json:"votes"`
+}
+
+// pollCreation returns the poll of a message, whichever version it was sent as
+func pollCreation(msg *waE2E.Message) *waE2E.PollCreationMessage {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage()
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2()
+	case msg.GetPollCreationMessageV3() != nil:
+		return msg.GetPollCreationMessageV3()
+	}
+	return nil
+}
+
+// storedPoll loads a poll from the message store, nil when it is not stored
+func storedPoll(db *sqlx.DB, userID string, pollID string) (*StoredMessage, *waE2E.PollCreationMessage) {
+	stored, err := getStoredMessage(db, userID, pollID)
+	if err != nil {
+		return nil, nil
+	}
+	msg, err := stored.Message()
+	if err != nil {
+		return stored, nil
+	}
+	return stored, pollCreation(msg)
+}
+
+// pollOptionNames maps the option hashes of a vote to the option names of
+// the poll. Options of a poll that is not stored are given by their hash
+func pollOptionNames(poll *waE2E.PollCreationMessage, selected [][]byte) []string {
+	names := map[string]string{}
+	if poll != nil {
+		optionNames := make([]string, len(poll.GetOptions()))
+		for i, option := range poll.GetOptions() {
+			optionNames[i] = option.GetOptionName()
+		}
+		for i, hash := range whatsmeow.HashPollOptions(optionNames) {
+			names[string(hash)] = optionNames[i]
+		}
+	}
+
+	options := make([]string, 0, len(selected))
+	for _, hash := range selected {
+		if name, ok := names[string(hash)]; ok {
+			options = append(options, name)
+		} else {
+			options = append(options, hex.EncodeToString(hash))
+		}
+	}
+	return options
+}
+
+// savePollVote keeps the vote unless a later one from the same voter is stored
+func savePollVote(db *sqlx.DB, userID string, vote *PollVote) error {
+	options, err := json.Marshal(vote.Options)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO poll_votes (user_id, poll_id, chat_jid, voter_jid, options, timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, poll_id, voter_jid) DO UPDATE SET options = excluded.options, timestamp = excluded.timestamp
+		WHERE poll_votes.timestamp <= excluded.timestamp`,
+		userID, vote.PollID, vote.ChatJID, vote.VoterJID, string(options), vote.Timestamp)
+	return err
+}
+
+func listPollVotes(db *sqlx.DB, userID string, pollID string) ([]PollVote, error) {
+	votes := []PollVote{}
+	err := db.Select(&votes, "SELECT poll_id, chat_jid, voter_jid, options, timestamp FROM poll_votes WHERE user_id = $1 AND poll_id = $2 ORDER BY timestamp", userID, pollID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range votes {
+		votes[i].Options = []string{}
+		json.Unmarshal([]byte(votes[i].RawOptions), &votes[i].Options)
+	}
+	return votes, nil
+}
+
+// getPollResults tallies the votes of a poll. Options nobody voted for are
+// listed when the poll itself is stored
+func getPollResults(db *sqlx.DB, userID string, pollID string) (*PollResults, error) {
+	stored, poll := storedPoll(db, userID, pollID)
+	votes, err := listPollVotes(db, userID, pollID)
+	if err != nil {
+		return nil, err
+	}
+	if poll == nil && len(votes) == 0 {
+		return nil, errPollNotFound
+	}
+
+	results := &PollResults{PollID: pollID, Options: []PollOptionResult{}, Votes: votes}
+	index := map[string]int{}
+	addOption := func(name string) int {
+		if i, ok := index[name]; ok {
+			return i
+		}
+		index[name] = len(results.Options)
+		results.Options = append(results.Options, PollOptionResult{Name: name, Voters: []string{}})
+		return index[name]
+	}
+	if stored != nil {
+		results.ChatJID = stored.ChatJID
+	}
+	if poll != nil {
+		results.Question = poll.GetName()
+		results.SelectableCount = poll.GetSelectableOptionsCount()
+		for _, option := range poll.GetOptions() {
+			addOption(option.GetOptionName())
+		}
+	}
+	for _, vote := range votes {
+		if results.ChatJID == "" {
+			results.ChatJID = vote.ChatJID
+		}
+		for _, name := range vote.Options {
+			i := addOption(name)
+			results.Options[i].Votes++
+			results.Options[i].Voters = append(results.Options[i].Voters, vote.VoterJID)
+		}
+	}
+	return results, nil
+}
+
+// handlePollVote decrypts a vote on a poll, keeps it as the current vote of
+// the voter and emits a PollVote event with the names of the chosen options
+func (mycli *MyClient) handlePollVote(evt *events.Message) {
+	update := evt.Message.GetPollUpdateMessage()
+	pollID := update.GetPollCreationMessageKey().GetID()
+	decrypted, err := mycli.WAClient.DecryptPollVote(context.Background(), evt)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", mycli.userID).Str("poll", pollID).Msg("Could not decrypt poll vote")
+		return
+	}
+
+	_, poll := storedPoll(mycli.db, mycli.userID, pollID)
+	vote := &PollVote{
+		PollID:    pollID,
+		ChatJID:   evt.Info.Chat.String(),
+		VoterJID:  evt.Info.Sender.ToNonAD().String(),
+		Options:   pollOptionNames(poll, decrypted.GetSelectedOptions()),
+		Timestamp: evt.Info.Timestamp.Unix(),
+	}
+	if err := savePollVote(mycli.db, mycli.userID, vote); err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Str("poll", pollID).Msg("Failed to store poll vote")
+	}
+
+	event := map[string]interface{}{
+		"PollId":    vote.PollID,
+		"Chat":      vote.ChatJID,
+		"Voter":     vote.VoterJID,
+		"PushName":  evt.Info.PushName,
+		"IsFromMe":  evt.Info.IsFromMe,
+		"Options":   vote.Options,
+		"Timestamp": vote.Timestamp,
+	}
+	if poll != nil {
+		event["Question"] = poll.GetName()
+	}
+	sendEventWithWebHook(mycli, map[string]interface{}{"type": "PollVote", "event": event}, "")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// replyContextInfo builds the ContextInfo of a send from the one in the
+// request. A reply quotes the stored content of the message it answers, so
+// the quote shows its text, caption or thumbnail. When the message is not
+// stored, quotedText is shown instead. nil when the send neither replies
+// nor mentions
+func replyContextInfo(db *sqlx.DB, userID string, requested *waE2E.ContextInfo, quotedText string) *waE2E.ContextInfo {
+	if requested.StanzaID == nil && requested.MentionedJID == nil {
+		return nil
+	}
+
+	ci := &waE2E.ContextInfo{MentionedJID: requested.MentionedJID}
+	if requested.StanzaID != nil {
+		ci.StanzaID = proto.String(*requested.StanzaID)
+		ci.Participant = proto.String(requested.GetParticipant())
+		ci.QuotedMessage = quotedMessage(db, userID, *requested.StanzaID, quotedText)
+	}
+	return ci
+}
+
+// quotedMessage returns the content a reply shows for the message it quotes
+func quotedMessage(db *sqlx.DB, userID string, stanzaID string, quotedText string) *waE2E.Message {
+	stored, err := getStoredMessage(db, userID, stanzaID)
+	if err != nil {
+		log.Debug().Err(err).Str("id", stanzaID).Msg("Quoted message not found in store")
+		return &waE2E.Message{Conversation: proto.String(quotedText)}
+	}
+
+	if msg, err := stored.Message(); err == nil {
+		stripContextInfo(msg)
+		return msg
+	}
+	// Rows stored without their protobuf still have the text or caption
+	text := stored.Text
+	if text == "" {
+		text = stored.Caption
+	}
+	if text == "" {
+		text = quotedText
+	}
+	return &waE2E.Message{Conversation: proto.String(text)}
+}
+
+// stripContextInfo removes the context of a quoted message, quotes do not
+// nest and its mentions and own quote are not shown
+func stripContextInfo(msg *waE2E.Message) {
+	msg.MessageContextInfo = nil
+	msg.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return true
+		}
+		content := v.Message()
+		if field := content.Descriptor().Fields().ByName("contextInfo"); field != nil {
+			content.Clear(field)
+		}
+		return true
+	})
+}
+
+// getContextInfo returns the ContextInfo of the content of a message
+func getContextInfo(msg *waE2E.Message) *waE2E.ContextInfo {
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		return msg.ExtendedTextMessage.GetContextInfo()
+	case msg.ImageMessage != nil:
+		return msg.ImageMessage.GetContextInfo()
+	case msg.VideoMessage != nil:
+		return msg.VideoMessage.GetContextInfo()
+	case msg.AudioMessage != nil:
+		return msg.AudioMessage.GetContextInfo()
+	case msg.DocumentMessage != nil:
+		return msg.DocumentMessage.GetContextInfo()
+	case msg.StickerMessage != nil:
+		return msg.StickerMessage.GetContextInfo()
+	case msg.ContactMessage != nil:
+		return msg.ContactMessage.GetContextInfo()
+	case msg.LocationMessage != nil:
+		return msg.LocationMessage.GetContextInfo()
+	}
+	return nil
+}
+
+// setContextInfo attaches a ContextInfo to the content of a message
+func setContextInfo(msg *waE2E.Message, ci *waE2E.ContextInfo) {
+	if ci == nil {
+		return
+	}
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.ContextInfo = ci
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = ci
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ContextInfo = ci
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ContextInfo = ci
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = ci
+	case msg.StickerMessage != nil:
+		msg.StickerMessage.ContextInfo = ci
+	case msg.ContactMessage != nil:
+		msg.ContactMessage.ContextInfo = ci
+	case msg.LocationMessage != nil:
+		msg.LocationMessage.ContextInfo = ci
+	case msg.Conversation != nil:
+		// Plain text cannot carry a context, it has to be extended text
+		msg.ExtendedTextMessage = &waE2E.ExtendedTextMessage{Text: msg.Conversation, ContextInfo: ci}
+		msg.Conversation = nil
+	}
+}
+
+// Chats a message can be forwarded to in one request
+const forwardMaxTargets = 50
+
+// Types of stored messages that can be forwarded
+var forwardableTypes = map[string]bool{
+	"text":     true,
+	"image":    true,
+	"video":    true,
+	"audio":    true,
+	"document": true,
+	"sticker":  true,
+	"location": true,
+	"contact":  true,
+}
+
+// forwardedMessage prepares a stored message to be sent again as forwarded.
+// Media keeps its keys and paths, so nothing is uploaded again
+func forwardedMessage(stored *StoredMessage) (*waE2E.Message, error) {
+	if !forwardableTypes[stored.MessageType] {
+		return nil, fmt.Errorf("%s messages cannot be forwarded", stored.MessageType)
+	}
+	msg, err := stored.Message()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each forward counts, WhatsApp labels messages forwarded many times
+	score := getContextInfo(msg).GetForwardingScore() + 1
+	stripContextInfo(msg)
+	setContextInfo(msg, &waE2E.ContextInfo{
+		IsForwarded:     proto.Bool(true),
+		ForwardingScore: proto.Uint32(score),
+	})
+	return msg, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// reconnectPolicy controls how a session is brought back after losing its connection
+type reconnectPolicy struct {
+	maxAttempts    int
+	baseDelay      time.Duration
+	maxDelay       time.Duration
+	connectTimeout time.Duration
+}
+
+func loadReconnectPolicy() reconnectPolicy {
+	return reconnectPolicy{
+		maxAttempts:    envInt("RECONNECT_MAX_ATTEMPTS", 10),
+		baseDelay:      time.Duration(envInt("RECONNECT_BASE_SECONDS", 2)) * time.Second,
+		maxDelay:       time.Duration(envInt("RECONNECT_MAX_SECONDS", 300)) * time.Second,
+		connectTimeout: time.Duration(envInt("RECONNECT_LOGIN_TIMEOUT_SECONDS", 30)) * time.Second,
+	}
+}
+
+// connectFailureRetryable tells if connecting again can fix a connect
+// failure. Logged out, banned and outdated clients are refused every time
+func connectFailureRetryable(reason events.ConnectFailureReason) bool {
+	switch {
+	case reason.IsLoggedOut(),
+		reason == events.ConnectFailureTempBanned,
+		reason == events.ConnectFailureClientOutdated,
+		reason == events.ConnectFailureBadUserAgent:
+		return false
+	}
+	return true
+}
+
+// beginReconnect marks the reconnect loop as running, false if one already is
+func (s *Session) beginReconnect() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reconnecting {
+		return false
+	}
+	s.reconnecting = true
+	return true
+}
+
+func (s *Session) endReconnect() {
+	s.mu.Lock()
+	s.reconnecting = false
+	s.mu.Unlock()
+}
+
+// reportReconnect hands the outcome of a connection attempt to the reconnect
+// loop, nil meaning the client logged in again. It is a no-op when no loop runs
+func (s *Session) reportReconnect(err error) {
+	s.mu.RLock()
+	reconnecting := s.reconnecting
+	s.mu.RUnlock()
+	if !reconnecting {
+		return
+	}
+	select {
+	case s.reconnectResult <- err:
+	default:
+	}
+}
+
+func (s *Session) drainReconnect() {
+	select {
+	case <-s.reconnectResult:
+	default:
+	}
+}
+
+// reconnect brings the client back after the connection dropped, waiting a
+// jittered exponential delay between attempts. Only one loop runs per session,
+// triggers arriving while it runs fail the attempt in progress instead
+func (mycli *MyClient) reconnect(reason string) {
+	session := mycli.session
+	if session.Stopping() {
+		return
+	}
+	if !session.beginReconnect() {
+		session.reportReconnect(errors.New(reason))
+		return
+	}
+	defer session.endReconnect()
+
+	recordDisconnect(mycli.db, mycli.userID)
+	policy := loadReconnectPolicy()
+
+	for attempt := 1; attempt <= policy.maxAttempts; attempt++ {
+		delay := backoffDelay(attempt, policy.baseDelay, policy.maxDelay)
+		session.SetState(SessionReconnecting, reason)
+		log.Info().Str("userid", mycli.userID).Int("attempt", attempt).Dur("delay", delay).Str("reason", reason).Msg("Reconnecting to Whatsapp")
+		sendReconnectEvent(mycli, "Reconnecting", map[string]interface{}{
+			"attempt":     attempt,
+			"maxAttempts": policy.maxAttempts,
+			"delay":       int(delay.Seconds()),
+			"reason":      reason,
+		})
+
+		select {
+		case <-session.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+
+		err := mycli.connectAttempt(policy.connectTimeout)
+		if err == nil {
+			log.Info().Str("userid", mycli.userID).Int("attempt", attempt).Msg("Reconnected to Whatsapp")
+			sendReconnectEvent(mycli, "ReconnectSucceeded", map[string]interface{}{
+				"attempt": attempt,
+			})
+			return
+		}
+		if session.Stopping() {
+			return
+		}
+		log.Warn().Err(err).Str("userid", mycli.userID).Int("attempt", attempt).Msg("Reconnect attempt failed")
+		recordReconnectFailure(mycli.db, mycli.userID)
+		reason = err.Error()
+	}
+
+	log.Error().Str("userid", mycli.userID).Int("attempts", policy.maxAttempts).Str("reason", reason).Msg("Giving up reconnecting to Whatsapp")
+	sendReconnectEvent(mycli, "ReconnectGaveUp", map[string]interface{}{
+		"attempts": policy.maxAttempts,
+		"reason":   reason,
+	})
+	session.Stop("reconnect gave up")
+}
+
+// connectAttempt opens a new websocket and waits until the client logs in or fails
+func (mycli *MyClient) connectAttempt(timeout time.Duration) error {
+	session := mycli.session
+	session.drainReconnect()
+
+	// Drop whatever is left of the old socket, Connect refuses to run otherwise
+	mycli.WAClient.Disconnect()
+	if err := mycli.WAClient.Connect(); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-session.reconnectResult:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no login after %s", timeout)
+	case <-session.Context().Done():
+		return session.Context().Err()
+	}
+}
+
+func sendReconnectEvent(mycli *MyClient, eventType string, data map[string]interface{}) {
+	postmap := map[string]interface{}{
+		"type":  eventType,
+		"event": data,
+	}
+	sendEventWithWebHook(mycli, postmap, "")
+}
+
+func recordDisconnect(db *sqlx.DB, userID string) {
+	sqlStmt := `UPDATE users SET disconnect_count=disconnect_count+1, last_disconnect_at=$1 WHERE id=$2`
+	if _, err := db.Exec(sqlStmt, time.Now().Unix(), userID); err != nil {
+		log.Error().Err(err).Msg(sqlStmt)
+	}
+}
+
+func recordReconnectFailure(db *sqlx.DB, userID string) {
+	sqlStmt := `UPDATE users SET reconnect_failures=reconnect_failures+1 WHERE id=$1`
+	if _, err := db.Exec(sqlStmt, userID); err != nil {
+		log.Error().Err(err).Msg(sqlStmt)
+	}
+}
@@ -48,8 +48,13 @@ func (s *server) routes() {
 	adminRoutes.Handle("/users", s.ListUsers()).Methods("GET")
 	adminRoutes.Handle("/users/{id}", s.ListUsers()).Methods("GET")
 	adminRoutes.Handle("/users", s.AddUser()).Methods("POST")
+	adminRoutes.Handle("/users/{id}", s.UpdateUser()).Methods("PUT", "PATCH")
 	adminRoutes.Handle("/users/{id}", s.DeleteUser()).Methods("DELETE")
 	adminRoutes.Handle("/users/{id}/full", s.DeleteUserComplete()).Methods("DELETE")
+	adminRoutes.Handle("/users/{id}/expiration", s.SetUserExpiration()).Methods("POST")
+	adminRoutes.Handle("/webhooks/deadletters", s.ListWebhookDeadLetters()).Methods("GET")
+	adminRoutes.Handle("/webhooks/deadletters/{id}/retry", s.RetryWebhookDeadLetter()).Methods("POST")
+	adminRoutes.Handle("/webhooks/deadletters/{id}", s.DeleteWebhookDeadLetter()).Methods("DELETE")
 
 	c := alice.New()
 	c = c.Append(s.authalice)
@@ -71,6 +76,10 @@ func (s *server) routes() {
 	c = c.Append(hlog.RefererHandler("referer"))
 	c = c.Append(hlog.RequestIDHandler("req_id", "Request-Id"))
 
+	// Send endpoints accept SendAt or DelaySeconds to schedule the message,
+	// and go through the outbound queue when the session paces its sends
+	sc := c.Append(s.scheduleSend, s.queueSend)
+
 	s.router.Handle("/session/connect", c.Then(s.Connect())).Methods("POST")
 	s.router.Handle("/session/disconnect", c.Then(s.Disconnect())).Methods("POST")
 	s.router.Handle("/session/logout", c.Then(s.Logout())).Methods("POST")
@@ -83,29 +92,43 @@ func (s *server) routes() {
 	s.router.Handle("/webhook", c.Then(s.GetWebhook())).Methods("GET")
 	s.router.Handle("/webhook", c.Then(s.DeleteWebhook())).Methods("DELETE")
 	s.router.Handle("/webhook", c.Then(s.UpdateWebhook())).Methods("PUT")
+	// The schema is public, receivers validate payloads without a token
+	s.router.Handle("/webhook/schema", s.GetWebhookSchema()).Methods("GET")
+	s.router.Handle("/webhook/endpoints", c.Then(s.ListWebhookEndpoints())).Methods("GET")
+	s.router.Handle("/webhook/endpoints", c.Then(s.AddWebhookEndpoint())).Methods("POST")
+	s.router.Handle("/webhook/endpoints/{id}", c.Then(s.GetWebhookEndpoint())).Methods("GET")
+	s.router.Handle("/webhook/endpoints/{id}", c.Then(s.UpdateWebhookEndpoint())).Methods("PUT")
+	s.router.Handle("/webhook/endpoints/{id}", c.Then(s.DeleteWebhookEndpoint())).Methods("DELETE")
 
 	s.router.Handle("/session/proxy", c.Then(s.SetProxy())).Methods("POST")
+	s.router.Handle("/session/proxy/test", c.Then(s.TestProxy())).Methods("POST")
+
+	s.router.Handle("/session/ratelimit", c.Then(s.GetRateLimit())).Methods("GET")
+	s.router.Handle("/session/ratelimit", c.Then(s.SetRateLimit())).Methods("POST")
 
 	s.router.Handle("/session/s3/config", c.Then(s.ConfigureS3())).Methods("POST")
 	s.router.Handle("/session/s3/config", c.Then(s.GetS3Config())).Methods("GET")
 	s.router.Handle("/session/s3/config", c.Then(s.DeleteS3Config())).Methods("DELETE")
 	s.router.Handle("/session/s3/test", c.Then(s.TestS3Connection())).Methods("POST")
 
-	s.router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
+	s.router.Handle("/chat/send/text", sc.Then(s.SendMessage())).Methods("POST")
 	s.router.Handle("/chat/delete", c.Then(s.DeleteMessage())).Methods("POST")
-	s.router.Handle("/chat/send/image", c.Then(s.SendImage())).Methods("POST")
-	s.router.Handle("/chat/send/audio", c.Then(s.SendAudio())).Methods("POST")
-	s.router.Handle("/chat/send/document", c.Then(s.SendDocument())).Methods("POST")
+	s.router.Handle("/chat/send/image", sc.Then(s.SendImage())).Methods("POST")
+	s.router.Handle("/chat/send/audio", sc.Then(s.SendAudio())).Methods("POST")
+	s.router.Handle("/chat/send/document", sc.Then(s.SendDocument())).Methods("POST")
 	//	s.router.Handle("/chat/send/template", c.Then(s.SendTemplate())).Methods("POST")
-	s.router.Handle("/chat/send/video", c.Then(s.SendVideo())).Methods("POST")
-	s.router.Handle("/chat/send/sticker", c.Then(s.SendSticker())).Methods("POST")
-	s.router.Handle("/chat/send/location", c.Then(s.SendLocation())).Methods("POST")
-	s.router.Handle("/chat/send/contact", c.Then(s.SendContact())).Methods("POST")
+	s.router.Handle("/chat/send/video", sc.Then(s.SendVideo())).Methods("POST")
+	s.router.Handle("/chat/send/sticker", sc.Then(s.SendSticker())).Methods("POST")
+	s.router.Handle("/chat/send/location", sc.Then(s.SendLocation())).Methods("POST")
+	s.router.Handle("/chat/send/contact", sc.Then(s.SendContact())).Methods("POST")
 	s.router.Handle("/chat/react", c.Then(s.React())).Methods("POST")
-	s.router.Handle("/chat/send/buttons", c.Then(s.SendButtons())).Methods("POST")
-	s.router.Handle("/chat/send/list", c.Then(s.SendList())).Methods("POST")
-	s.router.Handle("/chat/send/poll", c.Then(s.SendPoll())).Methods("POST")
+	s.router.Handle("/chat/send/buttons", sc.Then(s.SendButtons())).Methods("POST")
+	s.router.Handle("/chat/send/list", sc.Then(s.SendList())).Methods("POST")
+	s.router.Handle("/chat/send/poll", sc.Then(s.SendPoll())).Methods("POST")
+	s.router.Handle("/chat/poll/results", c.Then(s.GetPollResults())).Methods("GET")
 	s.router.Handle("/chat/send/edit", c.Then(s.SendEditMessage())).Methods("POST")
+	s.router.Handle("/chat/forward", c.Then(s.ForwardMessage())).Methods("POST")
+	s.router.Handle("/chat/send/bulk", c.Then(s.SendBulk())).Methods("POST")
 
 	s.router.Handle("/user/presence", c.Then(s.SendPresence())).Methods("POST")
 	s.router.Handle("/user/info", c.Then(s.GetUser())).Methods("POST")
@@ -119,6 +142,16 @@ func (s *server) routes() {
 	s.router.Handle("/chat/downloadvideo", c.Then(s.DownloadVideo())).Methods("POST")
 	s.router.Handle("/chat/downloadaudio", c.Then(s.DownloadAudio())).Methods("POST")
 	s.router.Handle("/chat/downloaddocument", c.Then(s.DownloadDocument())).Methods("POST")
+	s.router.Handle("/chat/messages", c.Then(s.ListMessages())).Methods("GET")
+	s.router.Handle("/chat/messages/{id}", c.Then(s.GetMessage())).Methods("GET")
+	s.router.Handle("/chat/conversations", c.Then(s.ListConversations())).Methods("GET")
+	s.router.Handle("/chat/history/backfill", c.Then(s.BackfillHistory())).Methods("POST")
+	s.router.Handle("/chat/scheduled", c.Then(s.ListScheduledMessages())).Methods("GET")
+	s.router.Handle("/chat/scheduled/{id}", c.Then(s.RescheduleMessage())).Methods("PUT")
+	s.router.Handle("/chat/scheduled/{id}", c.Then(s.CancelScheduledMessage())).Methods("DELETE")
+	s.router.Handle("/chat/bulk", c.Then(s.ListBulkJobs())).Methods("GET")
+	s.router.Handle("/chat/bulk/{id}", c.Then(s.GetBulkJob())).Methods("GET")
+	s.router.Handle("/chat/bulk/{id}/{action:pause|resume|cancel}", c.Then(s.ControlBulkJob())).Methods("POST")
 
 	s.router.Handle("/group/create", c.Then(s.CreateGroup())).Methods("POST")
 	s.router.Handle("/group/list", c.Then(s.ListGroups())).Methods("GET")
@@ -136,6 +169,11 @@ func (s *server) routes() {
 	s.router.Handle("/group/inviteinfo", c.Then(s.GetGroupInviteInfo())).Methods("POST")
 	s.router.Handle("/group/updateparticipants", c.Then(s.UpdateGroupParticipants())).Methods("POST")
 
+	s.router.Handle("/call/settings", c.Then(s.GetCallSettings())).Methods("GET")
+	s.router.Handle("/call/settings", c.Then(s.SetCallSettings())).Methods("POST")
+	s.router.Handle("/call/reject", c.Then(s.RejectCall())).Methods("POST")
+	s.router.Handle("/call/log", c.Then(s.ListCallLog())).Methods("GET")
+
 	s.router.Handle("/newsletter/list", c.Then(s.ListNewsletter())).Methods("GET")
 
 	s.router.PathPrefix("/").Handler(http.FileServer(http.Dir(exPath + "/static/")))
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	scheduledPending   = "pending"
+	scheduledSending   = "sending"
+	scheduledSent      = "sent"
+	scheduledFailed    = "failed"
+	scheduledCancelled = "cancelled"
+	// Messages waiting in an outbound queue, kept until they are sent
+	scheduledQueued = "queued"
+
+	schedulerPollInterval = 1 * time.Second
+	schedulerBatchSize    = 50
+	schedulerWorkers      = 4
+)
+
+// ScheduledMessage is a send request stored to be replayed at SendAt
+type ScheduledMessage struct {
+	ID        string          `db:"id" json:"id"`
+	UserID    string          `db:"user_id" json:"-"`
+	Path      string          `db:"path" json:"path"`
+	RawBody   string          `db:"payload" json:"-"`
+	Payload   json.RawMessage `db:"-" json:"payload"`
+	SendAt    int64           `db:"send_at" json:"sendAt"`
+	Status    string          `db:"status" json:"status"`
+	MessageID string          `db:"message_id" json:"messageId,omitempty"`
+	LastError string          `db:"last_error" json:"error,omitempty"`
+	CreatedAt int64           `db:"created_at" json:"createdAt"`
+	SentAt    int64           `db:"sent_at" json:"sentAt,omitempty"`
+}
+
+const scheduledMessageColumns = "id, user_id, path, payload, send_at, status, message_id, last_error, created_at, sent_at"
+
+var errScheduledNotFound = errors.New("scheduled message not found")
+var errScheduledNotPending = errors.New("scheduled message is no longer pending")
+
+// parseSchedule reads SendAt (RFC3339 or unix seconds) or DelaySeconds from a
+// send payload. ok is false when the request should be sent right away
+func parseSchedule(sendAt json.RawMessage, delay json.RawMessage) (at time.Time, ok bool, err error) {
+	if len(sendAt) > 0 && string(sendAt) != "null" {
+		var unix int64
+		if err := json.Unmarshal(sendAt, &unix); err == nil {
+			return time.Unix(unix, 0), true, nil
+		}
+		var text string
+		if err := json.Unmarshal(sendAt, &text); err != nil {
+			return at, false, errors.New("SendAt must be a RFC3339 date or a unix timestamp")
+		}
+		at, err := parseTimeValue(text)
+		if err != nil {
+			return at, false, errors.New("SendAt must be a RFC3339 date or a unix timestamp")
+		}
+		return at, true, nil
+	}
+	if len(delay) > 0 && string(delay) != "null" {
+		var seconds int64
+		if err := json.Unmarshal(delay, &seconds); err != nil || seconds < 0 {
+			return at, false, errors.New("DelaySeconds must be a positive number")
+		}
+		return time.Now().Add(time.Duration(seconds) * time.Second), true, nil
+	}
+	return at, false, nil
+}
+
+// parseTimeValue reads a time given as unix seconds or RFC3339
+func parseTimeValue(text string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, text)
+}
+
+// splitSchedule removes the scheduling fields from a send payload
+func splitSchedule(body []byte) (payload []byte, at time.Time, ok bool, err error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		// Not an object, let the handler report it
+		return body, at, false, nil
+	}
+	var sendAt, delay json.RawMessage
+	for key, value := range fields {
+		switch strings.ToLower(key) {
+		case "sendat":
+			sendAt = value
+			delete(fields, key)
+		case "delayseconds":
+			delay = value
+			delete(fields, key)
+		}
+	}
+	at, ok, err = parseSchedule(sendAt, delay)
+	if err != nil || !ok {
+		return body, at, false, err
+	}
+	payload, err = json.Marshal(fields)
+	return payload, at, true, err
+}
+
+// scheduleSend stores send requests carrying SendAt or DelaySeconds instead of
+// sending them, the scheduler replays them through the same handler later
+func (s *server) scheduleSend(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Uploads are streamed to the handler, they cannot be stored for later
+		if isReplayed(r) || isMultipartRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not read payload"))
+			return
+		}
+		payload, at, ok, err := splitSchedule(body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if !ok {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id, err := GenerateRandomID()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		m := ScheduledMessage{
+			ID:        id,
+			UserID:    txtid,
+			Path:      r.URL.Path,
+			RawBody:   string(payload),
+			SendAt:    at.Unix(),
+			Status:    scheduledPending,
+			CreatedAt: time.Now().Unix(),
+		}
+		if err := storeScheduledMessage(s.db, m); err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to store scheduled message")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to schedule message"))
+			return
+		}
+		messageScheduler.Wake()
+		log.Info().Str("id", id).Str("path", m.Path).Time("sendAt", at).Msg("Message scheduled")
+
+		response := map[string]interface{}{"Details": "Scheduled", "Id": id, "SendAt": m.SendAt}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	})
+}
+
+func storeScheduledMessage(db *sqlx.DB, m ScheduledMessage) error {
+	_, err := db.Exec("INSERT INTO scheduled_messages ("+scheduledMessageColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		m.ID, m.UserID, m.Path, m.RawBody, m.SendAt, m.Status, m.MessageID, m.LastError, m.CreatedAt, m.SentAt)
+	return err
+}
+
+// listScheduledMessages lists the messages scheduled by a user, the ones
+// waiting in the outbound queue are not part of them
+func listScheduledMessages(db *sqlx.DB, userID string, status string) ([]ScheduledMessage, error) {
+	messages := []ScheduledMessage{}
+	query := "SELECT " + scheduledMessageColumns + " FROM scheduled_messages WHERE user_id=$1"
+	args := []interface{}{userID}
+	if status != "" {
+		query += " AND status=$2"
+		args = append(args, status)
+	} else {
+		query += " AND status<>$2"
+		args = append(args, scheduledQueued)
+	}
+	if err := db.Select(&messages, query+" ORDER BY send_at", args...); err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].Payload = json.RawMessage(messages[i].RawBody)
+	}
+	return messages, nil
+}
+
+// rescheduleMessage moves a pending message to a new send time
+func rescheduleMessage(db *sqlx.DB, userID string, id string, at time.Time) error {
+	return updatePendingMessage(db, userID, id, "UPDATE scheduled_messages SET send_at=$1 WHERE user_id=$2 AND id=$3 AND status=$4", at.Unix(), userID, id, scheduledPending)
+}
+
+// cancelScheduledMessage stops a pending message from being sent
+func cancelScheduledMessage(db *sqlx.DB, userID string, id string) error {
+	return updatePendingMessage(db, userID, id, "UPDATE scheduled_messages SET status=$1 WHERE user_id=$2 AND id=$3 AND status=$4", scheduledCancelled, userID, id, scheduledPending)
+}
+
+func updatePendingMessage(db *sqlx.DB, userID string, id string, query string, args ...interface{}) error {
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	var exists bool
+	if err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM scheduled_messages WHERE user_id=$1 AND id=$2)", userID, id); err != nil {
+		return err
+	}
+	if !exists {
+		return errScheduledNotFound
+	}
+	return errScheduledNotPending
+}
+
+// MessageScheduler dispatches due scheduled messages
+type MessageScheduler struct {
+	s    *server
+	wake chan struct{}
+	sem  chan struct{}
+}
+
+var messageScheduler *MessageScheduler
+
+// StartMessageScheduler starts the dispatcher for scheduled messages
+func (s *server) StartMessageScheduler() {
+	messageScheduler = &MessageScheduler{
+		s:    s,
+		wake: make(chan struct{}, 1),
+		sem:  make(chan struct{}, schedulerWorkers),
+	}
+	messageScheduler.failInterrupted()
+	go messageScheduler.run()
+}
+
+// failInterrupted reports the messages a restart caught mid send or waiting
+// in the outbound queue. They may or may not have gone out, they are failed
+// instead of risking a duplicate
+func (ms *MessageScheduler) failInterrupted() {
+	var interrupted []struct {
+		ScheduledMessage
+		Token string `db:"token"`
+	}
+	err := ms.s.db.Select(&interrupted, `
+		SELECT m.id, m.user_id, m.path, m.send_at, u.token
+		FROM scheduled_messages m JOIN users u ON u.id = m.user_id
+		WHERE m.status=$1`, scheduledSending)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to recover scheduled messages")
+		return
+	}
+	for _, m := range interrupted {
+		ms.finish(m.ScheduledMessage, m.Token, "", errors.New("interrupted by restart"))
+	}
+}
+
+// Wake makes the scheduler look for due messages right away
+func (ms *MessageScheduler) Wake() {
+	if ms == nil {
+		return
+	}
+	select {
+	case ms.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (ms *MessageScheduler) run() {
+	ticker := time.NewTicker(schedulerPollInterval)
+	defer ticker.Stop()
+	for {
+		ms.dispatchDue()
+		select {
+		case <-ticker.C:
+		case <-ms.wake:
+		}
+	}
+}
+
+func (ms *MessageScheduler) dispatchDue() {
+	due := []ScheduledMessage{}
+	err := ms.s.db.Select(&due, "SELECT "+scheduledMessageColumns+" FROM scheduled_messages WHERE status=$1 AND send_at<=$2 ORDER BY send_at LIMIT $3",
+		scheduledPending, time.Now().Unix(), schedulerBatchSize)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load due scheduled messages")
+		return
+	}
+	for _, m := range due {
+		// Claim the message so a concurrent cancel or tick cannot race the send
+		res, err := ms.s.db.Exec("UPDATE scheduled_messages SET status=$1 WHERE id=$2 AND status=$3", scheduledSending, m.ID, scheduledPending)
+		if err != nil {
+			log.Error().Err(err).Str("id", m.ID).Msg("Failed to claim scheduled message")
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		ms.sem <- struct{}{}
+		go func(m ScheduledMessage) {
+			defer func() {
+				<-ms.sem
+			}()
+			ms.send(m)
+		}(m)
+	}
+}
+
+// send replays the stored request through the router as the owning user.
+// Sessions with rate limiting get it through their outbound queue, so the
+// dispatcher never waits on the pace of one session
+func (ms *MessageScheduler) send(m ScheduledMessage) {
+	var token string
+	if err := ms.s.db.Get(&token, "SELECT token FROM users WHERE id=$1", m.UserID); err != nil {
+		ms.finish(m, "", "", fmt.Errorf("user not found: %w", err))
+		return
+	}
+
+	q, err := outboundQueues.Get(m.UserID)
+	if err != nil {
+		ms.finish(m, token, "", fmt.Errorf("failed to load rate limit settings: %w", err))
+		return
+	}
+	if !q.Settings().Enabled {
+		data, err := ms.s.replaySend(token, m.Path, []byte(m.RawBody), m.ID)
+		ms.sent(m, token, data, err)
+		return
+	}
+
+	job := outboundJob{
+		id:       m.ID,
+		path:     m.Path,
+		phone:    payloadPhone([]byte(m.RawBody)),
+		body:     []byte(m.RawBody),
+		token:    token,
+		queuedAt: time.Now(),
+		done: func(data map[string]interface{}, err error) {
+			ms.sent(m, token, data, err)
+		},
+	}
+	if !q.enqueue(job) {
+		// Tried again on the next poll
+		log.Warn().Str("id", m.ID).Str("userID", m.UserID).Msg("Outbound queue is full, scheduled message postponed")
+		if _, err := ms.s.db.Exec("UPDATE scheduled_messages SET status=$1 WHERE id=$2 AND status=$3", scheduledPending, m.ID, scheduledSending); err != nil {
+			log.Error().Err(err).Str("id", m.ID).Msg("Failed to postpone scheduled message")
+		}
+	}
+}
+
+func (ms *MessageScheduler) sent(m ScheduledMessage, token string, data map[string]interface{}, err error) {
+	if err != nil {
+		ms.finish(m, token, "", err)
+		return
+	}
+	messageID, _ := data["Id"].(string)
+	ms.finish(m, token, messageID, nil)
+}
+
+func (ms *MessageScheduler) finish(m ScheduledMessage, token string, messageID string, sendErr error) {
+	status := scheduledSent
+	lastError := ""
+	eventType := "ScheduledMessageSent"
+	if sendErr != nil {
+		status = scheduledFailed
+		lastError = sendErr.Error()
+		eventType = "ScheduledMessageFailed"
+		log.Warn().Err(sendErr).Str("id", m.ID).Str("userID", m.UserID).Msg("Scheduled message failed")
+	} else {
+		log.Info().Str("id", m.ID).Str("messageId", messageID).Msg("Scheduled message sent")
+	}
+
+	var sentAt int64
+	if sendErr == nil {
+		sentAt = time.Now().Unix()
+	}
+	_, err := ms.s.db.Exec("UPDATE scheduled_messages SET status=$1, message_id=$2, last_error=$3, sent_at=$4 WHERE id=$5",
+		status, messageID, lastError, sentAt, m.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", m.ID).Msg("Failed to update scheduled message")
+	}
+	if token == "" {
+		return
+	}
+
+	event := map[string]interface{}{
+		"id":     m.ID,
+		"path":   m.Path,
+		"sendAt": m.SendAt,
+	}
+	if sendErr != nil {
+		event["error"] = lastError
+	} else {
+		event["messageId"] = messageID
+		event["sentAt"] = sentAt
+	}
+	postmap := map[string]interface{}{
+		"type":  eventType,
+		"event": event,
+	}
+	sendEventWithWebHook(userEventClient(ms.s, m.UserID, token), postmap, "")
+}
+
+// userEventClient returns the client used to emit events for a user. Events
+// about failed sends are often caused by the session being down, so a bare
+// client is used when none is running
+func userEventClient(s *server, userID string, token string) *MyClient {
+	if mycli := clientManager.GetMyClient(userID); mycli != nil {
+		return mycli
+	}
+	return &MyClient{userID: userID, token: token, db: s.db}
+}
+
+// replayedKey marks requests made by replaySend in their context. Unlike a
+// header it cannot be set by clients
+type replayedKey struct{}
+
+// isReplayed reports whether the request is an internal replay, which is sent
+// right away instead of being scheduled or queued again
+func isReplayed(r *http.Request) bool {
+	return r.Context().Value(replayedKey{}) != nil
+}
+
+// replaySend runs a stored send request through the router as the given user
+// and returns the data of the response, or its error. The caller is
+// responsible for pacing it, it skips the outbound queue
+func (s *server) replaySend(token string, path string, body []byte, id string) (map[string]interface{}, error) {
+	ctx := context.WithValue(context.Background(), replayedKey{}, id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("token", token)
+
+	rec := newCaptureWriter()
+	s.router.ServeHTTP(rec, req)
+
+	var envelope struct {
+		Data  map[string]interface{} `json:"data"`
+		Error string                 `json:"error"`
+	}
+	_ = json.Unmarshal(rec.body.Bytes(), &envelope)
+	if rec.status != http.StatusOK {
+		if envelope.Error == "" {
+			envelope.Error = fmt.Sprintf("send failed with status %d", rec.status)
+		}
+		return nil, errors.New(envelope.Error)
+	}
+	return envelope.Data, nil
+}
+
+// captureWriter collects the response of a replayed request
+type captureWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newCaptureWriter() *captureWriter {
+	return &captureWriter{header: http.Header{}, status: http.StatusOK}
+}
+
+func (c *captureWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	return c.body.Write(b)
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	c.status = status
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SessionState is the lifecycle state of a WhatsApp session
+type SessionState string
+
+const (
+	SessionIdle         SessionState = "idle"
+	SessionPairing      SessionState = "pairing"
+	SessionConnecting   SessionState = "connecting"
+	SessionConnected    SessionState = "connected"
+	SessionReconnecting SessionState = "reconnecting"
+	SessionLoggedOut    SessionState = "logged_out"
+	SessionStopped      SessionState = "stopped"
+)
+
+// Number of transitions kept per user, older ones are dropped
+const sessionHistoryLimit = 50
+
+// Allowed transitions, anything else is logged and ignored
+var sessionTransitions = map[SessionState][]SessionState{
+	SessionIdle:         {SessionConnecting, SessionPairing, SessionStopped},
+	SessionConnecting:   {SessionPairing, SessionConnected, SessionReconnecting, SessionLoggedOut, SessionStopped},
+	SessionPairing:      {SessionConnecting, SessionConnected, SessionReconnecting, SessionLoggedOut, SessionStopped},
+	SessionConnected:    {SessionReconnecting, SessionLoggedOut, SessionStopped},
+	SessionReconnecting: {SessionConnecting, SessionConnected, SessionLoggedOut, SessionStopped},
+	SessionLoggedOut:    {SessionStopped},
+	SessionStopped:      {},
+}
+
+// SessionTransition records a state change of a session
+type SessionTransition struct {
+	From   SessionState `json:"from"`
+	To     SessionState `json:"to"`
+	Reason string       `json:"reason,omitempty"`
+	At     time.Time    `json:"at"`
+}
+
+// Session supervises the lifetime of one user's client. It is stopped by
+// cancelling its context, and done is closed once the client is torn down
+type Session struct {
+	mu      sync.RWMutex
+	userID  string
+	state   SessionState
+	reason  string
+	history []SessionTransition
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// Reconnect loop bookkeeping, see reconnect.go
+	reconnecting    bool
+	reconnectResult chan error
+}
+
+func newSession(userID string, history []SessionTransition) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		userID:  userID,
+		state:   SessionIdle,
+		history: history,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+
+		reconnectResult: make(chan error, 1),
+	}
+}
+
+// State returns the current state
+func (s *Session) State() SessionState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// History returns a copy of the recorded transitions, oldest first
+func (s *Session) History() []SessionTransition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history := make([]SessionTransition, len(s.history))
+	copy(history, s.history)
+	return history
+}
+
+// Context is cancelled when the session is asked to stop
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// Done is closed when the session has been fully torn down
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Stopping reports whether a stop was requested
+func (s *Session) Stopping() bool {
+	return s.ctx.Err() != nil
+}
+
+// SetState moves the session to a new state if the transition is allowed
+func (s *Session) SetState(to SessionState, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from := s.state
+	if from == to {
+		return false
+	}
+	allowed := false
+	for _, next := range sessionTransitions[from] {
+		if next == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		log.Warn().Str("userid", s.userID).Str("from", string(from)).Str("to", string(to)).Msg("Ignoring invalid session transition")
+		return false
+	}
+
+	s.state = to
+	s.history = append(s.history, SessionTransition{From: from, To: to, Reason: reason, At: time.Now()})
+	if len(s.history) > sessionHistoryLimit {
+		s.history = s.history[len(s.history)-sessionHistoryLimit:]
+	}
+	log.Info().Str("userid", s.userID).Str("from", string(from)).Str("to", string(to)).Str("reason", reason).Msg("Session state changed")
+	return true
+}
+
+// Stop asks the session to shut down, it is safe to call more than once
+func (s *Session) Stop(reason string) {
+	s.mu.Lock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.mu.Unlock()
+	s.cancel()
+}
+
+// StopReason returns the reason given to the first Stop call
+func (s *Session) StopReason() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reason
+}
+
+// Wait blocks until the session is torn down or the timeout expires
+func (s *Session) Wait(timeout time.Duration) bool {
+	select {
+	case <-s.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// finish marks the session as stopped and releases anyone waiting on it
+func (s *Session) finish() {
+	s.SetState(SessionStopped, s.StopReason())
+	close(s.done)
+}
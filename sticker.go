@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/gif"
+	"net/http"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	stickerSize = 512
+	// Animations are cut to this length, WhatsApp does not loop longer ones
+	stickerMaxSeconds = 10
+
+	// Sizes WhatsApp keeps stickers under, conversions lower the quality to fit
+	stickerMaxStaticSize   = 100 << 10
+	stickerMaxAnimatedSize = 500 << 10
+)
+
+// WebP qualities tried in turn until a converted sticker is small enough
+var stickerQualities = []int{80, 60, 40, 20}
+
+// stickerMetadata is the sticker pack a sticker shows as part of, WhatsApp
+// reads it from the EXIF of the WebP
+type stickerMetadata struct {
+	PackId        string
+	PackName      string
+	PackPublisher string
+	Emojis        []string
+}
+
+func (m stickerMetadata) empty() bool {
+	return m.PackId == "" && m.PackName == "" && m.PackPublisher == "" && len(m.Emojis) == 0
+}
+
+// exif encodes the metadata as a TIFF holding the JSON of the pack in the
+// private tag 0x5741, the layout WhatsApp clients write
+func (m stickerMetadata) exif() []byte {
+	packID := m.PackId
+	if packID == "" {
+		// Stickers of the same pack share an id without callers keeping one
+		sum := sha256.Sum256([]byte(m.PackName + "\x00" + m.PackPublisher))
+		packID = hex.EncodeToString(sum[:16])
+	}
+	payload, _ := json.Marshal(struct {
+		PackID        string   `json:"sticker-pack-id"`
+		PackName      string   `json:"sticker-pack-name"`
+		PackPublisher string   `json:"sticker-pack-publisher"`
+		Emojis        []string `json:"emojis,omitempty"`
+	}{packID, m.PackName, m.PackPublisher, m.Emojis})
+
+	exif := []byte{
+		'I', 'I', 0x2a, 0x00, // little endian TIFF
+		0x08, 0x00, 0x00, 0x00, // offset of the first IFD
+		0x01, 0x00, // one entry
+		0x41, 0x57, // tag 0x5741
+		0x07, 0x00, // type UNDEFINED
+		0, 0, 0, 0, // length of the JSON
+		0x16, 0x00, 0x00, 0x00, // offset of the JSON, right after the entry
+	}
+	binary.LittleEndian.PutUint32(exif[14:], uint32(len(payload)))
+	return append(exif, payload...)
+}
+
+// webpChunk is a chunk of the RIFF container of a WebP file
+type webpChunk struct {
+	fourCC string
+	data   []byte
+}
+
+func parseWebP(data []byte) ([]webpChunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP file")
+	}
+	var chunks []webpChunk
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 0 || pos+8+size > len(data) {
+			return nil, errors.New("truncated WebP file")
+		}
+		chunks = append(chunks, webpChunk{fourCC: string(data[pos : pos+4]), data: data[pos+8 : pos+8+size]})
+		pos += 8 + size + size%2
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("empty WebP file")
+	}
+	return chunks, nil
+}
+
+func encodeWebP(chunks []webpChunk) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		body.WriteString(chunk.fourCC)
+		binary.Write(&body, binary.LittleEndian, uint32(len(chunk.data)))
+		body.Write(chunk.data)
+		if len(chunk.data)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+	out := make([]byte, 8, 8+body.Len())
+	copy(out, "RIFF")
+	binary.LittleEndian.PutUint32(out[4:], uint32(body.Len()))
+	return append(out, body.Bytes()...)
+}
+
+// Flags of the VP8X chunk
+const (
+	webpFlagAnimation = 0x02
+	webpFlagEXIF      = 0x08
+	webpFlagAlpha     = 0x10
+)
+
+// stickerInfo is what a sticker message tells about its image
+type stickerInfo struct {
+	Width    uint32
+	Height   uint32
+	Animated bool
+}
+
+// webpHeader reads the canvas of a WebP from its first chunk, as the VP8X
+// chunk of extended files or the frame header of simple ones
+func webpHeader(chunks []webpChunk) (info stickerInfo, flags byte, err error) {
+	first := chunks[0]
+	switch first.fourCC {
+	case "VP8X":
+		if len(first.data) < 10 {
+			break
+		}
+		flags = first.data[0]
+		info.Width = 1 + (uint32(first.data[4]) | uint32(first.data[5])<<8 | uint32(first.data[6])<<16)
+		info.Height = 1 + (uint32(first.data[7]) | uint32(first.data[8])<<8 | uint32(first.data[9])<<16)
+		info.Animated = flags&webpFlagAnimation != 0
+		return info, flags, nil
+	case "VP8 ":
+		if len(first.data) < 10 || !bytes.Equal(first.data[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			break
+		}
+		info.Width = uint32(binary.LittleEndian.Uint16(first.data[6:]) & 0x3fff)
+		info.Height = uint32(binary.LittleEndian.Uint16(first.data[8:]) & 0x3fff)
+		return info, 0, nil
+	case "VP8L":
+		if len(first.data) < 5 || first.data[0] != 0x2f {
+			break
+		}
+		bits := binary.LittleEndian.Uint32(first.data[1:])
+		info.Width = bits&0x3fff + 1
+		info.Height = (bits>>14)&0x3fff + 1
+		if bits>>28&1 != 0 {
+			flags = webpFlagAlpha
+		}
+		return info, flags, nil
+	}
+	return info, 0, fmt.Errorf("unsupported WebP chunk %q", first.fourCC)
+}
+
+// setWebPExif replaces the EXIF of a WebP, turning simple files into the
+// extended format that can carry it
+func setWebPExif(data []byte, exif []byte) ([]byte, error) {
+	chunks, err := parseWebP(data)
+	if err != nil {
+		return nil, err
+	}
+	info, flags, err := webpHeader(chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	if chunks[0].fourCC != "VP8X" {
+		vp8x := make([]byte, 10)
+		vp8x[4], vp8x[5], vp8x[6] = byte(info.Width-1), byte((info.Width-1)>>8), byte((info.Width-1)>>16)
+		vp8x[7], vp8x[8], vp8x[9] = byte(info.Height-1), byte((info.Height-1)>>8), byte((info.Height-1)>>16)
+		chunks = append([]webpChunk{{fourCC: "VP8X", data: vp8x}}, chunks...)
+	} else {
+		chunks[0].data = append([]byte(nil), chunks[0].data...)
+	}
+	chunks[0].data[0] = flags | webpFlagEXIF
+
+	// EXIF goes after the image data and before XMP
+	kept := make([]webpChunk, 0, len(chunks)+1)
+	xmp := []webpChunk{}
+	for _, chunk := range chunks {
+		switch chunk.fourCC {
+		case "EXIF":
+		case "XMP ":
+			xmp = append(xmp, chunk)
+		default:
+			kept = append(kept, chunk)
+		}
+	}
+	kept = append(kept, webpChunk{fourCC: "EXIF", data: exif})
+	return encodeWebP(append(kept, xmp...)), nil
+}
+
+// isAnimatedGIF tells if a GIF has more than one frame
+func isAnimatedGIF(data []byte) bool {
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	return err == nil && len(anim.Image) > 1
+}
+
+// prepareSticker turns an image into a WebP sticker carrying the pack
+// metadata. WebP images are sent as they are, PNG, JPEG and GIF are
+// converted to 512x512 by the media transcoder, animated GIF to animated WebP
+func prepareSticker(media *sendMedia, meta stickerMetadata) ([]byte, stickerInfo, error) {
+	var info stickerInfo
+	data, err := media.Bytes()
+	if err != nil {
+		return nil, info, err
+	}
+
+	switch kind := http.DetectContentType(data); kind {
+	case "image/webp":
+	case "image/png", "image/jpeg", "image/gif":
+		if mediaTranscoder == nil {
+			return nil, info, errors.New("sticker should be WebP, no transcoder is available to convert it")
+		}
+		animated := kind == "image/gif" && isAnimatedGIF(data)
+		if data, err = convertSticker(media.file.Name(), animated); err != nil {
+			return nil, info, err
+		}
+	default:
+		return nil, info, fmt.Errorf("sticker should be a WebP, PNG, JPEG or GIF image, not %s", kind)
+	}
+
+	chunks, err := parseWebP(data)
+	if err == nil {
+		info, _, err = webpHeader(chunks)
+	}
+	if err != nil {
+		return nil, info, fmt.Errorf("invalid sticker: %w", err)
+	}
+	if !meta.empty() {
+		if data, err = setWebPExif(data, meta.exif()); err != nil {
+			return nil, info, err
+		}
+	}
+	return data, info, nil
+}
+
+// convertSticker encodes an image as WebP sticker, lowering the quality
+// until it fits the size WhatsApp allows
+func convertSticker(in string, animated bool) ([]byte, error) {
+	ctx, cancel := transcodeContext()
+	defer cancel()
+
+	f, err := os.CreateTemp("", "wuzapi-media-*.webp")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	limit := stickerMaxStaticSize
+	if animated {
+		limit = stickerMaxAnimatedSize
+	}
+	var data []byte
+	for _, quality := range stickerQualities {
+		if err := mediaTranscoder.ImageToWebP(ctx, in, f.Name(), stickerSize, animated, quality); err != nil {
+			return nil, fmt.Errorf("could not convert sticker: %w", err)
+		}
+		if data, err = os.ReadFile(f.Name()); err != nil {
+			return nil, err
+		}
+		if len(data) <= limit {
+			return data, nil
+		}
+		log.Debug().Int("quality", quality).Int("size", len(data)).Msg("Sticker too large, lowering quality")
+	}
+	return nil, fmt.Errorf("%w, the sticker is %d KB after conversion and the limit is %d KB", errMediaTooLarge, len(data)>>10, limit>>10)
+}
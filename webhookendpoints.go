@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// WebhookEndpoint is an additional webhook registered by a user, with its own
+// event filter, format and headers
+type WebhookEndpoint struct {
+	ID        string            `db:"id" json:"id"`
+	UserID    string            `db:"user_id" json:"-"`
+	URL       string            `db:"url" json:"url"`
+	EventsCSV string            `db:"events" json:"-"`
+	Events    []string          `db:"-" json:"events"`
+	Format    string            `db:"format" json:"format"`
+	RawHeader string            `db:"headers" json:"-"`
+	Headers   map[string]string `db:"-" json:"headers"`
+	Active    bool              `db:"active" json:"active"`
+	CreatedAt int64             `db:"created_at" json:"created_at"`
+}
+
+const webhookEndpointColumns = "id, user_id, url, events, format, headers, active, created_at"
+
+// Endpoints per user, refreshed from the database when the user changes them
+var webhookEndpointCache = cache.New(5*time.Minute, 10*time.Minute)
+
+func (e *WebhookEndpoint) decode() {
+	e.Events = []string{}
+	for _, ev := range strings.Split(e.EventsCSV, ",") {
+		if ev = strings.TrimSpace(ev); ev != "" {
+			e.Events = append(e.Events, ev)
+		}
+	}
+	e.Headers = map[string]string{}
+	if e.RawHeader != "" {
+		if err := json.Unmarshal([]byte(e.RawHeader), &e.Headers); err != nil {
+			log.Warn().Err(err).Str("id", e.ID).Msg("Invalid headers stored for webhook endpoint")
+		}
+	}
+}
+
+func (e *WebhookEndpoint) encode() error {
+	e.EventsCSV = strings.Join(e.Events, ",")
+	if e.Headers == nil {
+		e.Headers = map[string]string{}
+	}
+	raw, err := json.Marshal(e.Headers)
+	if err != nil {
+		return err
+	}
+	e.RawHeader = string(raw)
+	return nil
+}
+
+// subscribedTo reports whether the endpoint wants the given event type
+func (e *WebhookEndpoint) subscribedTo(eventType string) bool {
+	return e.Active && subscribedToEvent(e.Events, eventType)
+}
+
+func listWebhookEndpoints(db *sqlx.DB, userID string) ([]WebhookEndpoint, error) {
+	endpoints := []WebhookEndpoint{}
+	if err := db.Select(&endpoints, "SELECT "+webhookEndpointColumns+" FROM webhooks WHERE user_id=$1 ORDER BY created_at", userID); err != nil {
+		return nil, err
+	}
+	for i := range endpoints {
+		endpoints[i].decode()
+	}
+	return endpoints, nil
+}
+
+func getWebhookEndpoint(db *sqlx.DB, userID string, id string) (*WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	if err := db.Get(&e, "SELECT "+webhookEndpointColumns+" FROM webhooks WHERE user_id=$1 AND id=$2", userID, id); err != nil {
+		return nil, err
+	}
+	e.decode()
+	return &e, nil
+}
+
+func saveWebhookEndpoint(db *sqlx.DB, e *WebhookEndpoint) error {
+	if err := e.encode(); err != nil {
+		return err
+	}
+	_, err := db.Exec(`
+		INSERT INTO webhooks (`+webhookEndpointColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET url=excluded.url, events=excluded.events, format=excluded.format, headers=excluded.headers, active=excluded.active`,
+		e.ID, e.UserID, e.URL, e.EventsCSV, e.Format, e.RawHeader, e.Active, e.CreatedAt)
+	webhookEndpointCache.Delete(e.UserID)
+	return err
+}
+
+func deleteWebhookEndpoint(db *sqlx.DB, userID string, id string) (bool, error) {
+	res, err := db.Exec("DELETE FROM webhooks WHERE user_id=$1 AND id=$2", userID, id)
+	webhookEndpointCache.Delete(userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// cachedWebhookEndpoints returns the endpoints of a user, loading them on first use
+func cachedWebhookEndpoints(db *sqlx.DB, userID string) []WebhookEndpoint {
+	if endpoints, found := webhookEndpointCache.Get(userID); found {
+		return endpoints.([]WebhookEndpoint)
+	}
+	endpoints, err := listWebhookEndpoints(db, userID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Could not load webhook endpoints")
+		return nil
+	}
+	webhookEndpointCache.Set(userID, endpoints, cache.DefaultExpiration)
+	return endpoints
+}
+
+// sendToWebhookEndpoints queues the event for every active endpoint subscribed to it
+func sendToWebhookEndpoints(mycli *MyClient, eventType string, data map[string]string) {
+	for _, e := range cachedWebhookEndpoints(mycli.db, mycli.userID) {
+		if !e.subscribedTo(eventType) {
+			continue
+		}
+		log.Info().Str("url", e.URL).Str("endpoint", e.ID).Msg("Calling webhook endpoint")
+		if _, err := webhookQueue.Enqueue(webhookSourceUser, mycli.userID, e.URL, e.Format, e.Headers, data, ""); err != nil {
+			log.Error().Err(err).Str("url", e.URL).Msg("Failed to queue webhook delivery")
+		}
+	}
+}
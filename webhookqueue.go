@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	webhookSourceUser   = "user"
+	webhookSourceGlobal = "global"
+)
+
+const (
+	webhookWorkers      = 8
+	webhookPollInterval = 2 * time.Second
+	webhookBatchSize    = 100
+)
+
+// webhookDelivery is a row of the webhook_outbox table
+type webhookDelivery struct {
+	ID            string `db:"id" json:"id"`
+	UserID        string `db:"user_id" json:"user_id"`
+	URL           string `db:"url" json:"url"`
+	Format        string `db:"format" json:"format"`
+	Payload       string `db:"payload" json:"payload"`
+	FilePath      string `db:"file_path" json:"file_path"`
+	Attempts      int    `db:"attempts" json:"attempts"`
+	NextAttemptAt int64  `db:"next_attempt_at" json:"next_attempt_at"`
+	LastError     string `db:"last_error" json:"last_error"`
+	CreatedAt     int64  `db:"created_at" json:"created_at"`
+	Source        string `db:"source" json:"source"`
+	Headers       string `db:"headers" json:"headers"`
+}
+
+// webhookDeadLetter is a delivery that exhausted all of its attempts
+type webhookDeadLetter struct {
+	webhookDelivery
+	FailedAt int64 `db:"failed_at" json:"failed_at"`
+}
+
+const webhookDeliveryColumns = "id, user_id, url, format, payload, file_path, attempts, next_attempt_at, last_error, created_at, source, headers"
+
+// WebhookQueue persists webhook deliveries and retries them until they succeed
+// or run out of attempts
+type WebhookQueue struct {
+	db          *sqlx.DB
+	wake        chan struct{}
+	sem         chan struct{}
+	mu          sync.Mutex
+	inflight    map[string]struct{}
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	fallback    *resty.Client
+}
+
+var webhookQueue *WebhookQueue
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// InitWebhookQueue reads the retry settings and starts the dispatcher
+func InitWebhookQueue(db *sqlx.DB) {
+	q := &WebhookQueue{
+		db:          db,
+		wake:        make(chan struct{}, 1),
+		sem:         make(chan struct{}, webhookWorkers),
+		inflight:    make(map[string]struct{}),
+		maxAttempts: envInt("WEBHOOK_MAX_ATTEMPTS", 10),
+		baseDelay:   time.Duration(envInt("WEBHOOK_RETRY_BASE_SECONDS", 5)) * time.Second,
+		maxDelay:    time.Duration(envInt("WEBHOOK_RETRY_MAX_SECONDS", 600)) * time.Second,
+	}
+
+	q.fallback = resty.New()
+	q.fallback.SetTimeout(30 * time.Second)
+	q.fallback.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+
+	webhookQueue = q
+	go q.run()
+
+	log.Info().
+		Int("max_attempts", q.maxAttempts).
+		Dur("base_delay", q.baseDelay).
+		Dur("max_delay", q.maxDelay).
+		Msg("Webhook delivery queue started")
+}
+
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+		log.Warn().Str(name, v).Msg("Invalid value, using default")
+	}
+	return def
+}
+
+func envBool(name string, def bool) bool {
+	if v := os.Getenv(name); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+		log.Warn().Str(name, v).Msg("Invalid value, using default")
+	}
+	return def
+}
+
+// Enqueue stores a delivery in the outbox and wakes up the dispatcher
+func (q *WebhookQueue) Enqueue(source string, userID string, target string, format string, headers map[string]string, payload map[string]string, file string) (string, error) {
+	id, err := GenerateRandomID()
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+	extraHeaders := ""
+	if len(headers) > 0 {
+		raw, err := json.Marshal(headers)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode webhook headers: %w", err)
+		}
+		extraHeaders = string(raw)
+	}
+
+	now := time.Now().Unix()
+	_, err = q.db.Exec(`
+		INSERT INTO webhook_outbox (`+webhookDeliveryColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, 0, $7, '', $8, $9, $10)`,
+		id, userID, target, format, string(body), file, now, now, source, extraHeaders)
+	if err != nil {
+		return "", fmt.Errorf("failed to store webhook delivery: %w", err)
+	}
+
+	q.notify()
+	return id, nil
+}
+
+func (q *WebhookQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *WebhookQueue) run() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		q.dispatchDue()
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *WebhookQueue) dispatchDue() {
+	var due []webhookDelivery
+	err := q.db.Select(&due, "SELECT "+webhookDeliveryColumns+" FROM webhook_outbox WHERE next_attempt_at <= $1 ORDER BY next_attempt_at LIMIT $2",
+		time.Now().Unix(), webhookBatchSize)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load pending webhook deliveries")
+		return
+	}
+
+	for _, d := range due {
+		q.mu.Lock()
+		if _, busy := q.inflight[d.ID]; busy {
+			q.mu.Unlock()
+			continue
+		}
+		q.inflight[d.ID] = struct{}{}
+		q.mu.Unlock()
+
+		q.sem <- struct{}{}
+		go func(d webhookDelivery) {
+			defer func() {
+				<-q.sem
+				q.mu.Lock()
+				delete(q.inflight, d.ID)
+				q.mu.Unlock()
+			}()
+			q.process(d)
+		}(d)
+	}
+}
+
+func (q *WebhookQueue) process(d webhookDelivery) {
+	d.Attempts++
+	err := q.deliver(&d)
+	if err == nil {
+		if _, err := q.db.Exec("DELETE FROM webhook_outbox WHERE id=$1", d.ID); err != nil {
+			log.Error().Err(err).Str("id", d.ID).Msg("Failed to remove delivered webhook from outbox")
+		}
+		log.Info().Str("id", d.ID).Str("url", d.URL).Int("attempt", d.Attempts).Msg("Webhook delivered")
+		return
+	}
+
+	if d.Attempts >= q.maxAttempts {
+		log.Error().Err(err).Str("id", d.ID).Str("url", d.URL).Int("attempts", d.Attempts).Msg("Webhook delivery failed permanently, moving to dead letters")
+		if err := q.moveToDeadLetters(d, err.Error()); err != nil {
+			log.Error().Err(err).Str("id", d.ID).Msg("Failed to move webhook to dead letters")
+		}
+		return
+	}
+
+	delay := backoffDelay(d.Attempts, q.baseDelay, q.maxDelay)
+	log.Warn().Err(err).Str("id", d.ID).Str("url", d.URL).Int("attempt", d.Attempts).Dur("retry_in", delay).Msg("Webhook delivery failed, will retry")
+
+	_, dbErr := q.db.Exec("UPDATE webhook_outbox SET attempts=$1, next_attempt_at=$2, last_error=$3 WHERE id=$4",
+		d.Attempts, time.Now().Add(delay).Unix(), err.Error(), d.ID)
+	if dbErr != nil {
+		log.Error().Err(dbErr).Str("id", d.ID).Msg("Failed to reschedule webhook delivery")
+	}
+}
+
+func (q *WebhookQueue) moveToDeadLetters(d webhookDelivery, lastError string) error {
+	tx, err := q.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO webhook_dead_letters (`+webhookDeliveryColumns+`, failed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		d.ID, d.UserID, d.URL, d.Format, d.Payload, d.FilePath, d.Attempts, d.NextAttemptAt, lastError, d.CreatedAt, d.Source, d.Headers, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM webhook_outbox WHERE id=$1", d.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Requeue moves a dead letter back to the outbox with a fresh attempt counter
+func (q *WebhookQueue) Requeue(id string) error {
+	tx, err := q.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO webhook_outbox (`+webhookDeliveryColumns+`)
+		SELECT id, user_id, url, format, payload, file_path, 0, $1, last_error, created_at, source, headers
+		FROM webhook_dead_letters WHERE id=$2`, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errDeadLetterNotFound
+	}
+	if _, err = tx.Exec("DELETE FROM webhook_dead_letters WHERE id=$1", id); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	q.notify()
+	return nil
+}
+
+// deliver performs a single POST of the delivery, non 2xx responses count as failures
+func (q *WebhookQueue) deliver(d *webhookDelivery) error {
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(d.Payload), &payload); err != nil {
+		return fmt.Errorf("invalid stored payload: %w", err)
+	}
+
+	client := clientManager.GetHTTPClient(d.UserID)
+	if client == nil {
+		client = q.fallback
+	}
+
+	req := client.R()
+	var signed []byte
+	switch {
+	case d.FilePath != "":
+		fileHash, err := fileSHA256(d.FilePath)
+		if err != nil {
+			return fmt.Errorf("attachment unavailable: %w", err)
+		}
+		payload["file"] = d.FilePath
+		req.SetFiles(map[string]string{"file": d.FilePath}).SetFormData(payload)
+		req.SetHeader("X-Wuzapi-File-Sha256", fileHash)
+		// Multipart boundaries are random, so the event and the digest of
+		// the file are signed instead of the body
+		signed = []byte(payload["jsonData"] + "." + fileHash)
+	case d.Format == "json":
+		// The original payload is a map[string]string, but we want to send the postmap (map[string]interface{})
+		// So we try to decode the jsonData field if it exists, otherwise we send the original payload
+		var body interface{} = payload
+		if jsonStr, ok := payload["jsonData"]; ok {
+			var postmap map[string]interface{}
+			if err := json.Unmarshal([]byte(jsonStr), &postmap); err == nil {
+				if token, ok := payload["token"]; ok {
+					postmap["token"] = token
+				}
+				body = postmap
+			}
+		}
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode webhook body: %w", err)
+		}
+		signed = raw
+		req.SetHeader("Content-Type", "application/json").SetBody(raw)
+	default:
+		form := url.Values{}
+		for k, v := range payload {
+			form.Set(k, v)
+		}
+		signed = []byte(form.Encode())
+		req.SetHeader("Content-Type", "application/x-www-form-urlencoded").SetBody(signed)
+	}
+
+	if d.Headers != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(d.Headers), &headers); err != nil {
+			return fmt.Errorf("invalid stored headers: %w", err)
+		}
+		req.SetHeaders(headers)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.SetHeader("X-Wuzapi-Delivery", d.ID)
+	req.SetHeader("X-Wuzapi-Timestamp", timestamp)
+	if secret := q.secretFor(d); secret != "" {
+		req.SetHeader("X-Wuzapi-Signature", "sha256="+signWebhook(secret, timestamp, signed))
+	}
+
+	resp, err := req.Post(d.URL)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode())
+	}
+	return nil
+}
+
+// secretFor resolves the signing secret when the delivery is attempted, so
+// rotating a secret also applies to deliveries still waiting for a retry
+func (q *WebhookQueue) secretFor(d *webhookDelivery) string {
+	if d.Source == webhookSourceGlobal {
+		return os.Getenv("WUZAPI_GLOBAL_WEBHOOK_SECRET")
+	}
+	var secret string
+	if err := q.db.Get(&secret, "SELECT COALESCE(webhook_secret, '') FROM users WHERE id=$1", d.UserID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Warn().Err(err).Str("userID", d.UserID).Msg("Could not load webhook secret")
+	}
+	return secret
+}
+
+// fileSHA256 returns the hex SHA-256 of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.body"
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Webhook payload formats a user can pick. v1 is the event as emitted by
+// whatsmeow, v2 the typed payload below, stable across whatsmeow upgrades
+const (
+	webhookSchemaV1 = "v1"
+	webhookSchemaV2 = "v2"
+)
+
+// Bumped on incompatible changes to the v2 payload
+const webhookSchemaVersion = 2
+
+// WebhookEvent is the v2 webhook payload. One of the typed sections is set
+// depending on the event, other events carry their v1 payload in Data
+type WebhookEvent struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	ID            string             `json:"id" doc:"Unique id of the event"`
+	Type          string             `json:"type" doc:"Event type, the name used to subscribe to it. Receipts are always Receipt, whether subscribed as ReadReceipt or Receipt"`
+	Timestamp     string             `json:"timestamp" format:"date-time" doc:"When the event was emitted"`
+	UserID        string             `json:"userId"`
+	InstanceName  string             `json:"instanceName,omitempty"`
+	Message       *WebhookMessage    `json:"message,omitempty"`
+	Receipt       *WebhookReceipt    `json:"receipt,omitempty"`
+	Presence      *WebhookPresence   `json:"presence,omitempty"`
+	Group         *WebhookGroup      `json:"group,omitempty"`
+	Call          *WebhookCall       `json:"call,omitempty"`
+	Connection    *WebhookConnection `json:"connection,omitempty"`
+	Data          json.RawMessage    `json:"data,omitempty" doc:"Payload of events without a typed section, as in v1"`
+}
+
+// WebhookMessage is a message received or sent from another device
+type WebhookMessage struct {
+	ID        string        `json:"id"`
+	Chat      string        `json:"chat"`
+	Sender    string        `json:"sender"`
+	SenderAlt string        `json:"senderAlt,omitempty" doc:"Phone number JID of a LID sender, or the other way around"`
+	PushName  string        `json:"pushName,omitempty"`
+	FromMe    bool          `json:"fromMe"`
+	IsGroup   bool          `json:"isGroup"`
+	Timestamp string        `json:"timestamp" format:"date-time"`
+	Kind      string        `json:"kind" doc:"text, image, video, audio, document, sticker, location, contact, reaction, edit, revoke, poll, poll_update, interactive, protocol or unknown"`
+	Text      string        `json:"text,omitempty" doc:"Text of the message, new text of an edit or emoji of a reaction, empty when a reaction is removed"`
+	Caption   string        `json:"caption,omitempty"`
+	Media     *WebhookMedia `json:"media,omitempty"`
+
+	QuotedID     string           `json:"quotedId,omitempty" doc:"Id of the message replied to"`
+	QuotedSender string           `json:"quotedSender,omitempty"`
+	Mentions     []string         `json:"mentions,omitempty"`
+	Forwarded    bool             `json:"forwarded,omitempty"`
+	ViewOnce     bool             `json:"viewOnce,omitempty"`
+	Target       *ContentTarget   `json:"target,omitempty" doc:"Message a reaction, edit, revoke or poll vote applies to"`
+	Location     *ContentLocation `json:"location,omitempty"`
+	Contacts     []ContentContact `json:"contacts,omitempty"`
+	Poll         *ContentPoll     `json:"poll,omitempty"`
+}
+
+// WebhookMedia is the media of a message, downloaded as base64 or to S3
+// depending on the media delivery settings of the user
+type WebhookMedia struct {
+	MimeType   string     `json:"mimeType,omitempty"`
+	FileName   string     `json:"fileName,omitempty"`
+	FileLength int64      `json:"fileLength,omitempty"`
+	Seconds    uint32     `json:"seconds,omitempty"`
+	Width      uint32     `json:"width,omitempty"`
+	Height     uint32     `json:"height,omitempty"`
+	VoiceNote  bool       `json:"voiceNote,omitempty"`
+	Animated   bool       `json:"animated,omitempty"`
+	Base64     string     `json:"base64,omitempty"`
+	S3         *WebhookS3 `json:"s3,omitempty"`
+}
+
+// WebhookS3 is where the media of a message was uploaded
+type WebhookS3 struct {
+	URL    string `json:"url"`
+	Key    string `json:"key"`
+	Bucket string `json:"bucket"`
+	Size   int64  `json:"size"`
+}
+
+// WebhookReceipt is a delivery, read or other receipt of sent messages
+type WebhookReceipt struct {
+	MessageIDs []string `json:"messageIds"`
+	Chat       string   `json:"chat"`
+	Sender     string   `json:"sender"`
+	IsGroup    bool     `json:"isGroup"`
+	State      string   `json:"state" doc:"delivered, read, read_self, played, sender, retry, server_error or inactive"`
+	Timestamp  string   `json:"timestamp" format:"date-time"`
+}
+
+// WebhookPresence is the online state of a contact or their activity in a chat
+type WebhookPresence struct {
+	From     string `json:"from"`
+	Chat     string `json:"chat,omitempty"`
+	State    string `json:"state" enum:"online,offline,composing,paused"`
+	Media    string `json:"media,omitempty" doc:"audio while recording a voice message"`
+	LastSeen string `json:"lastSeen,omitempty" format:"date-time"`
+}
+
+// WebhookGroup is a change to a group or the session joining one. Only the
+// fields that changed are set
+type WebhookGroup struct {
+	JID       string   `json:"jid"`
+	Change    string   `json:"change" enum:"info,joined"`
+	Sender    string   `json:"sender,omitempty"`
+	Timestamp string   `json:"timestamp,omitempty" format:"date-time"`
+	Name      *string  `json:"name,omitempty"`
+	Topic     *string  `json:"topic,omitempty"`
+	Locked    *bool    `json:"locked,omitempty"`
+	Announce  *bool    `json:"announce,omitempty"`
+	Ephemeral *uint32  `json:"ephemeral,omitempty" doc:"Disappearing messages timer in seconds, 0 when turned off"`
+	Joined    []string `json:"joined,omitempty"`
+	Left      []string `json:"left,omitempty"`
+	Promoted  []string `json:"promoted,omitempty"`
+	Demoted   []string `json:"demoted,omitempty"`
+	Reason    string   `json:"reason,omitempty" doc:"invite when joined through an invite link"`
+}
+
+// WebhookCall is an incoming call and what happened to it
+type WebhookCall struct {
+	CallID         string `json:"callId"`
+	From           string `json:"from"`
+	Creator        string `json:"creator"`
+	GroupJID       string `json:"groupJid,omitempty"`
+	IsGroup        bool   `json:"isGroup"`
+	IsVideo        bool   `json:"isVideo"`
+	Timestamp      string `json:"timestamp" format:"date-time"`
+	RemotePlatform string `json:"remotePlatform,omitempty"`
+	RemoteVersion  string `json:"remoteVersion,omitempty"`
+	Action         string `json:"action,omitempty" doc:"rejected when the call policy rejected the call"`
+	Reason         string `json:"reason,omitempty" doc:"Why the call ended, on CallTerminate"`
+}
+
+// WebhookConnection is a change of the connection of the session
+type WebhookConnection struct {
+	State        string `json:"state" enum:"connected,disconnected,connect_failure,logged_out,keepalive_timeout,keepalive_restored,stream_error,stream_replaced,client_outdated,temporary_ban,paired,pair_error,qr,reconnecting,reconnected,reconnect_gave_up"`
+	Reason       string `json:"reason,omitempty"`
+	JID          string `json:"jid,omitempty"`
+	Attempt      int    `json:"attempt,omitempty"`
+	MaxAttempts  int    `json:"maxAttempts,omitempty"`
+	DelaySeconds int    `json:"delaySeconds,omitempty"`
+	ExpiresAt    string `json:"expiresAt,omitempty" format:"date-time" doc:"End of a temporary ban"`
+	QRCode       string `json:"qrCode,omitempty" doc:"QR code to scan as PNG data URL"`
+}
+
+// isoTime formats a time for the v2 payload, empty when unknown
+func isoTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func jidString(jid types.JID) string {
+	if jid.IsEmpty() {
+		return ""
+	}
+	return jid.ToNonAD().String()
+}
+
+func jidStrings(jids []types.JID) []string {
+	if len(jids) == 0 {
+		return nil
+	}
+	out := make([]string, len(jids))
+	for i, jid := range jids {
+		out[i] = jidString(jid)
+	}
+	return out
+}
+
+// userWebhookSchema returns the payload format the user picked for their webhooks
+func userWebhookSchema(token string) string {
+	if userinfo, found := userinfocache.Get(token); found && userinfo.(Values).Get("WebhookSchema") == webhookSchemaV2 {
+		return webhookSchemaV2
+	}
+	return webhookSchemaV1
+}
+
+// newWebhookEvent builds the v2 payload of an event. raw is the whatsmeow
+// event when there is one, postmap the v1 payload with the extra fields
+func newWebhookEvent(mycli *MyClient, eventType string, raw interface{}, postmap map[string]interface{}) *WebhookEvent {
+	id, _ := GenerateRandomID()
+	event := &WebhookEvent{
+		SchemaVersion: webhookSchemaVersion,
+		ID:            id,
+		Type:          eventType,
+		Timestamp:     isoTime(time.Now()),
+		UserID:        mycli.userID,
+	}
+	if userinfo, found := userinfocache.Get(mycli.token); found {
+		event.InstanceName = userinfo.(Values).Get("Name")
+	}
+
+	switch evt := raw.(type) {
+	case *events.Message:
+		event.Message = webhookMessage(evt, postmap)
+	case *events.Receipt:
+		// v1 splits receipts in ReadReceipt and Receipt, v2 gives the kind
+		// in receipt.state
+		event.Type = "Receipt"
+		event.Receipt = webhookReceipt(evt)
+	case *events.Presence:
+		event.Presence = &WebhookPresence{From: jidString(evt.From), State: "online", LastSeen: isoTime(evt.LastSeen)}
+		if evt.Unavailable {
+			event.Presence.State = "offline"
+		}
+	case *events.ChatPresence:
+		event.Presence = &WebhookPresence{
+			From:  jidString(evt.Sender),
+			Chat:  jidString(evt.Chat),
+			State: string(evt.State),
+			Media: string(evt.Media),
+		}
+	case *events.GroupInfo:
+		event.Group = webhookGroupInfo(evt)
+	case *events.JoinedGroup:
+		event.Group = &WebhookGroup{JID: jidString(evt.JID), Change: "joined", Name: &evt.Name, Reason: evt.Reason}
+		if evt.Sender != nil {
+			event.Group.Sender = jidString(*evt.Sender)
+		}
+	case *events.CallOffer:
+		event.Call = webhookCall(evt.BasicCallMeta, postmap)
+		event.Call.RemotePlatform, event.Call.RemoteVersion = evt.RemotePlatform, evt.RemoteVersion
+	case *events.CallOfferNotice:
+		event.Call = webhookCall(evt.BasicCallMeta, postmap)
+	case *events.CallAccept:
+		event.Call = webhookCall(evt.BasicCallMeta, postmap)
+		event.Call.RemotePlatform, event.Call.RemoteVersion = evt.RemotePlatform, evt.RemoteVersion
+	case *events.CallTerminate:
+		event.Call = webhookCall(evt.BasicCallMeta, postmap)
+		event.Call.Reason = evt.Reason
+	case *events.CallRelayLatency:
+		event.Call = webhookCall(evt.BasicCallMeta, postmap)
+	default:
+		event.Connection = webhookConnection(eventType, raw, postmap)
+	}
+
+	if event.Message == nil && event.Receipt == nil && event.Presence == nil && event.Group == nil && event.Call == nil && event.Connection == nil {
+		if data, err := json.Marshal(postmap["event"]); err == nil {
+			event.Data = data
+		}
+	}
+	return event
+}
+
+func webhookMessage(evt *events.Message, postmap map[string]interface{}) *WebhookMessage {
+	content := normalizeMessage(evt)
+	msg := &WebhookMessage{
+		ID:           evt.Info.ID,
+		Chat:         jidString(evt.Info.Chat),
+		Sender:       jidString(evt.Info.Sender),
+		SenderAlt:    jidString(evt.Info.SenderAlt),
+		PushName:     evt.Info.PushName,
+		FromMe:       evt.Info.IsFromMe,
+		IsGroup:      evt.Info.IsGroup,
+		Timestamp:    isoTime(evt.Info.Timestamp),
+		Kind:         content.Kind,
+		Text:         content.Text,
+		Caption:      content.Caption,
+		QuotedID:     content.QuotedID,
+		QuotedSender: content.QuotedSender,
+		Mentions:     content.Mentions,
+		Forwarded:    content.Forwarded,
+		ViewOnce:     content.ViewOnce,
+		Target:       content.Target,
+		Location:     content.Location,
+		Contacts:     content.Contacts,
+		Poll:         content.Poll,
+	}
+	if media := content.Media; media != nil {
+		msg.Media = &WebhookMedia{
+			MimeType:   media.MimeType,
+			FileName:   media.FileName,
+			FileLength: media.FileLength,
+			Seconds:    media.Seconds,
+			Width:      media.Width,
+			Height:     media.Height,
+			VoiceNote:  media.VoiceNote,
+			Animated:   media.Animated,
+		}
+		if data, ok := postmap["base64"].(string); ok {
+			msg.Media.Base64 = data
+		}
+		if name, ok := postmap["fileName"].(string); ok && msg.Media.FileName == "" {
+			msg.Media.FileName = name
+		}
+		if s3, ok := postmap["s3"].(map[string]interface{}); ok {
+			msg.Media.S3 = &WebhookS3{}
+			msg.Media.S3.URL, _ = s3["url"].(string)
+			msg.Media.S3.Key, _ = s3["key"].(string)
+			msg.Media.S3.Bucket, _ = s3["bucket"].(string)
+			if size, ok := s3["size"].(int); ok {
+				msg.Media.S3.Size = int64(size)
+			}
+		}
+	}
+	return msg
+}
+
+func webhookReceipt(evt *events.Receipt) *WebhookReceipt {
+	state := strings.ReplaceAll(string(evt.Type), "-", "_")
+	if evt.Type == types.ReceiptTypeDelivered {
+		state = "delivered"
+	}
+	return &WebhookReceipt{
+		MessageIDs: evt.MessageIDs,
+		Chat:       jidString(evt.Chat),
+		Sender:     jidString(evt.Sender),
+		IsGroup:    evt.IsGroup,
+		State:      state,
+		Timestamp:  isoTime(evt.Timestamp),
+	}
+}
+
+func webhookGroupInfo(evt *events.GroupInfo) *WebhookGroup {
+	group := &WebhookGroup{
+		JID:       jidString(evt.JID),
+		Change:    "info",
+		Timestamp: isoTime(evt.Timestamp),
+		Joined:    jidStrings(evt.Join),
+		Left:      jidStrings(evt.Leave),
+		Promoted:  jidStrings(evt.Promote),
+		Demoted:   jidStrings(evt.Demote),
+		Reason:    evt.JoinReason,
+	}
+	if evt.Sender != nil {
+		group.Sender = jidString(*evt.Sender)
+	}
+	if evt.Name != nil {
+		group.Name = &evt.Name.Name
+	}
+	if evt.Topic != nil {
+		group.Topic = &evt.Topic.Topic
+	}
+	if evt.Locked != nil {
+		group.Locked = &evt.Locked.IsLocked
+	}
+	if evt.Announce != nil {
+		group.Announce = &evt.Announce.IsAnnounce
+	}
+	if evt.Ephemeral != nil {
+		timer := evt.Ephemeral.DisappearingTimer
+		if !evt.Ephemeral.IsEphemeral {
+			timer = 0
+		}
+		group.Ephemeral = &timer
+	}
+	return group
+}
+
+func webhookCall(meta types.BasicCallMeta, postmap map[string]interface{}) *WebhookCall {
+	call := &WebhookCall{
+		CallID:    meta.CallID,
+		From:      jidString(meta.From),
+		Creator:   jidString(meta.CallCreator),
+		GroupJID:  jidString(meta.GroupJID),
+		IsGroup:   !meta.GroupJID.IsEmpty(),
+		Timestamp: isoTime(meta.Timestamp),
+	}
+	// Video and the action taken were worked out for the v1 payload
+	if v1, ok := postmap["event"].(map[string]interface{}); ok {
+		call.IsVideo, _ = v1["IsVideo"].(bool)
+		call.Action, _ = v1["Action"].(string)
+	}
+	return call
+}
+
+// webhookConnection builds the connection section of session events, nil
+// for events that are not about the connection
+func webhookConnection(eventType string, raw interface{}, postmap map[string]interface{}) *WebhookConnection {
+	data, _ := raw.(map[string]interface{})
+	number := func(key string) int {
+		n, _ := data[key].(int)
+		return n
+	}
+	text := func(key string) string {
+		s, _ := data[key].(string)
+		return s
+	}
+
+	switch evt := raw.(type) {
+	case *events.Connected:
+		return &WebhookConnection{State: "connected"}
+	case *events.Disconnected:
+		return &WebhookConnection{State: "disconnected"}
+	case *events.ConnectFailure:
+		return &WebhookConnection{State: "connect_failure", Reason: evt.Reason.String()}
+	case *events.LoggedOut:
+		return &WebhookConnection{State: "logged_out", Reason: evt.Reason.String()}
+	case *events.KeepAliveTimeout:
+		return &WebhookConnection{State: "keepalive_timeout", Reason: fmt.Sprintf("%d errors", evt.ErrorCount)}
+	case *events.KeepAliveRestored:
+		return &WebhookConnection{State: "keepalive_restored"}
+	case *events.StreamError:
+		return &WebhookConnection{State: "stream_error", Reason: evt.Code}
+	case *events.StreamReplaced:
+		return &WebhookConnection{State: "stream_replaced"}
+	case *events.ClientOutdated:
+		return &WebhookConnection{State: "client_outdated"}
+	case *events.TemporaryBan:
+		return &WebhookConnection{State: "temporary_ban", Reason: evt.Code.String(), ExpiresAt: isoTime(time.Now().Add(evt.Expire))}
+	case *events.PairSuccess:
+		return &WebhookConnection{State: "paired", JID: jidString(evt.ID)}
+	case *events.PairError:
+		return &WebhookConnection{State: "pair_error", JID: jidString(evt.ID), Reason: fmt.Sprintf("%v", evt.Error)}
+	}
+
+	switch eventType {
+	case "QR":
+		code, _ := postmap["qrCodeBase64"].(string)
+		return &WebhookConnection{State: "qr", QRCode: code}
+	case "Reconnecting":
+		return &WebhookConnection{State: "reconnecting", Reason: text("reason"), Attempt: number("attempt"), MaxAttempts: number("maxAttempts"), DelaySeconds: number("delay")}
+	case "ReconnectSucceeded":
+		return &WebhookConnection{State: "reconnected", Attempt: number("attempt")}
+	case "ReconnectGaveUp":
+		return &WebhookConnection{State: "reconnect_gave_up", Reason: text("reason"), MaxAttempts: number("attempts")}
+	}
+	return nil
+}
+
+// webhookEventSchema is the JSON Schema of the v2 payload, built from its types
+func webhookEventSchema() map[string]interface{} {
+	defs := map[string]interface{}{}
+	schema := jsonSchemaStruct(reflect.TypeOf(WebhookEvent{}), defs)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "WebhookEvent"
+	schema["$defs"] = defs
+	return schema
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// jsonSchemaType maps a Go type to JSON Schema. Named structs go to defs and
+// are referenced, the tags doc, format and enum add to the field schema
+func jsonSchemaType(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	if t == rawMessageType {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchemaType(t.Elem(), defs)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchemaType(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchemaType(t.Elem(), defs)}
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			defs[t.Name()] = true // placeholder against recursion
+			defs[t.Name()] = jsonSchemaStruct(t, defs)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func jsonSchemaStruct(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		prop := jsonSchemaType(field.Type, defs)
+		if doc := field.Tag.Get("doc"); doc != "" {
+			prop["description"] = doc
+		}
+		if format := field.Tag.Get("format"); format != "" {
+			prop["format"] = format
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			prop["enum"] = strings.Split(enum, ",")
+		}
+		if name == "schemaVersion" {
+			prop["const"] = webhookSchemaVersion
+		}
+		properties[name] = prop
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": true,
+	}
+}
+
+// marshalUserWebhookEvent encodes an event in the format the user picked
+func marshalUserWebhookEvent(mycli *MyClient, eventType string, raw interface{}, postmap map[string]interface{}, v1 []byte) []byte {
+	if userWebhookSchema(mycli.token) != webhookSchemaV2 {
+		return v1
+	}
+	data, err := json.Marshal(newWebhookEvent(mycli, eventType, raw, postmap))
+	if err != nil {
+		log.Error().Err(err).Str("type", eventType).Msg("Failed to marshal v2 webhook event, sending v1")
+		return v1
+	}
+	return data
+}
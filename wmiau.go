@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -37,6 +38,7 @@ type MyClient struct {
 	token          string
 	subscriptions  []string
 	db             *sqlx.DB
+	session        *Session
 }
 
 func sendToGlobalWebHook(jsonData []byte, token string, userID string) {
@@ -57,29 +59,40 @@ func sendToGlobalWebHook(jsonData []byte, token string, userID string) {
 			"userID":       userID,
 			"instanceName": instance_name,
 		}
-		callHook(*globalWebhook, globalData, userID)
+		callHook(*globalWebhook, globalData, userID, webhookSourceGlobal)
 	}
 }
 
-func sendToUserWebHook(webhookurl string, path string, jsonData []byte, userID string, token string) {
-
+// userWebhookData builds the form fields sent to the webhooks of a user
+func userWebhookData(jsonData []byte, token string) map[string]string {
 	instance_name := ""
+	omitToken := false
 	userinfo, found := userinfocache.Get(token)
 	if found {
 		instance_name = userinfo.(Values).Get("Name")
+		omitToken = userinfo.(Values).Get("WebhookOmitToken") == "true"
 	}
 	data := map[string]string{
 		"jsonData":     string(jsonData),
 		"token":        token,
 		"instanceName": instance_name,
 	}
+	if omitToken {
+		delete(data, "token")
+	}
+	return data
+}
+
+func sendToUserWebHook(webhookurl string, path string, jsonData []byte, userID string, token string) {
+
+	data := userWebhookData(jsonData, token)
 
 	log.Debug().Interface("webhookData", data).Msg("Data being sent to webhook")
 
 	if webhookurl != "" {
 		log.Info().Str("url", webhookurl).Msg("Calling user webhook")
 		if path == "" {
-			go callHook(webhookurl, data, userID)
+			go callHook(webhookurl, data, userID, webhookSourceUser)
 		} else {
 			// Create a channel to capture the error from the goroutine
 			errChan := make(chan error, 1)
@@ -144,6 +157,12 @@ func getUserWebhookUrl(token string) string {
 }
 
 func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path string) {
+	sendWebhookEvent(mycli, postmap["event"], postmap, path)
+}
+
+// sendWebhookEvent delivers an event to the webhooks of the user. raw is the
+// whatsmeow event the v2 payload is built from, when there is one
+func sendWebhookEvent(mycli *MyClient, raw interface{}, postmap map[string]interface{}, path string) {
 	webhookurl := getUserWebhookUrl(mycli.token)
 
 	// Get updated events from cache/database
@@ -157,6 +176,9 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 		log.Error().Msg("Event type is not a string in postmap")
 		return
 	}
+	if name, ok := legacyEventTypes[eventType]; ok {
+		eventType = name
+	}
 
 	// Log subscription details for debugging
 	log.Debug().
@@ -165,12 +187,6 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 		Strs("subscribedEvents", subscribedEvents).
 		Msg("Checking event subscription")
 
-	// Check if the current event is in the subscriptions
-	checkIfSubscribedInEvent := checkIfSubscribedToEvent(subscribedEvents, postmap["type"].(string), mycli.userID)
-	if !checkIfSubscribedInEvent {
-		return
-	}
-
 	// Prepare webhook data
 	jsonData, err := json.Marshal(postmap)
 	if err != nil {
@@ -178,8 +194,20 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 		return
 	}
 
+	// Webhooks of the user get the format they picked, global ones always v1
+	userData := marshalUserWebhookEvent(mycli, eventType, raw, postmap, jsonData)
+
+	// Additional endpoints filter events on their own
+	sendToWebhookEndpoints(mycli, eventType, userWebhookData(userData, mycli.token))
+
+	// Check if the current event is in the subscriptions
+	checkIfSubscribedInEvent := checkIfSubscribedToEvent(subscribedEvents, eventType, mycli.userID)
+	if !checkIfSubscribedInEvent {
+		return
+	}
+
 	// Call user webhook if configured
-	sendToUserWebHook(webhookurl, path, jsonData, mycli.userID, mycli.token)
+	sendToUserWebHook(webhookurl, path, userData, mycli.userID, mycli.token)
 
 	// Get global webhook if configured
 	go sendToGlobalWebHook(jsonData, mycli.token, mycli.userID)
@@ -188,7 +216,7 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 }
 
 func checkIfSubscribedToEvent(subscribedEvents []string, eventType string, userId string) bool {
-	if !Find(subscribedEvents, eventType) && !Find(subscribedEvents, "All") {
+	if !subscribedToEvent(subscribedEvents, eventType) {
 		log.Warn().
 			Str("type", eventType).
 			Strs("subscribedEvents", subscribedEvents).
@@ -201,7 +229,7 @@ func checkIfSubscribedToEvent(subscribedEvents []string, eventType string, userI
 
 // Connects to Whatsapp Websocket on server startup if last state was connected
 func (s *server) connectOnStartup() {
-	rows, err := s.db.Queryx("SELECT id,name,token,jid,webhook,events,proxy_url,CASE WHEN s3_enabled THEN 'true' ELSE 'false' END AS s3_enabled,media_delivery FROM users WHERE connected=1")
+	rows, err := s.db.Queryx("SELECT id,name,token,jid,webhook,events,proxy_url,CASE WHEN s3_enabled THEN 'true' ELSE 'false' END AS s3_enabled,media_delivery,CASE WHEN webhook_omit_token THEN 'true' ELSE 'false' END AS webhook_omit_token,COALESCE(webhook_schema,'v1') AS webhook_schema,COALESCE(expiration,0) AS expiration FROM users WHERE connected=1 AND (expiration IS NULL OR expiration=0 OR expiration>$1)", time.Now().Unix())
 	if err != nil {
 		log.Error().Err(err).Msg("DB Problem")
 		return
@@ -217,22 +245,28 @@ func (s *server) connectOnStartup() {
 		proxy_url := ""
 		s3_enabled := ""
 		media_delivery := ""
-		err = rows.Scan(&txtid, &name, &token, &jid, &webhook, &events, &proxy_url, &s3_enabled, &media_delivery)
+		webhook_omit_token := ""
+		webhook_schema := ""
+		expiration := ""
+		err = rows.Scan(&txtid, &name, &token, &jid, &webhook, &events, &proxy_url, &s3_enabled, &media_delivery, &webhook_omit_token, &webhook_schema, &expiration)
 		if err != nil {
 			log.Error().Err(err).Msg("DB Problem")
 			return
 		} else {
 			log.Info().Str("token", token).Msg("Connect to Whatsapp on startup")
 			v := Values{map[string]string{
-				"Id":            txtid,
-				"Name":          name,
-				"Jid":           jid,
-				"Webhook":       webhook,
-				"Token":         token,
-				"Proxy":         proxy_url,
-				"Events":        events,
-				"S3Enabled":     s3_enabled,
-				"MediaDelivery": media_delivery,
+				"Id":               txtid,
+				"Name":             name,
+				"Jid":              jid,
+				"Webhook":          webhook,
+				"Token":            token,
+				"Proxy":            proxy_url,
+				"Events":           events,
+				"S3Enabled":        s3_enabled,
+				"MediaDelivery":    media_delivery,
+				"WebhookOmitToken": webhook_omit_token,
+				"WebhookSchema":    webhook_schema,
+				"Expiration":       expiration,
 			}}
 			userinfocache.Set(token, v, cache.NoExpiration)
 			// Gets and set subscription to webhook events
@@ -255,8 +289,12 @@ func (s *server) connectOnStartup() {
 			}
 			eventstring := strings.Join(subscribedEvents, ",")
 			log.Info().Str("events", eventstring).Str("jid", jid).Msg("Attempt to connect")
-			killchannel[txtid] = make(chan bool)
-			go s.startClient(txtid, jid, token, subscribedEvents)
+			session, started := clientManager.StartSession(txtid)
+			if !started {
+				log.Warn().Str("userid", txtid).Msg("Session already running, skipping")
+				continue
+			}
+			go s.startClient(session, txtid, jid, token, subscribedEvents)
 
 			// Initialize S3 client if configured
 			go func(userID string) {
@@ -331,7 +369,7 @@ func parseJID(arg string) (types.JID, bool) {
 	}
 }
 
-func (s *server) startClient(userID string, textjid string, token string, subscriptions []string) {
+func (s *server) startClient(session *Session, userID string, textjid string, token string, subscriptions []string) {
 	log.Info().Str("userid", userID).Str("jid", textjid).Msg("Starting websocket connection to Whatsapp")
 
 	var deviceStore *store.Device
@@ -364,14 +402,22 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 	} else {
 		client = whatsmeow.NewClient(deviceStore, nil)
 	}
+	// Reconnects are driven by the session, see reconnect.go
+	client.EnableAutoReconnect = false
 
 	// Now we can use the client with the manager
 	clientManager.SetWhatsmeowClient(userID, client)
+
+	// Tear the client down once the session stops, however startClient returns
+	defer s.teardownSession(session, client)
+
 	if textjid != "" {
 		jid, _ := parseJID(textjid)
 		deviceStore, err = container.GetDevice(context.Background(), jid)
 		if err != nil {
-			panic(err)
+			log.Error().Err(err).Msg("Failed to get device")
+			session.Stop("failed to get device")
+			return
 		}
 	} else {
 		log.Warn().Msg("No jid found. Creating new device")
@@ -382,7 +428,7 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 	store.DeviceProps.Os = osName
 
 	clientManager.SetWhatsmeowClient(userID, client)
-	mycli := MyClient{client, 1, userID, token, subscriptions, s.db}
+	mycli := MyClient{client, 1, userID, token, subscriptions, s.db, session}
 	mycli.eventHandlerID = mycli.WAClient.AddEventHandler(mycli.myEventHandler)
 
 	// CORREÇÃO: Armazenar o MyClient no clientManager
@@ -404,27 +450,37 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 		}
 	})
 
-	// NEW: set proxy if defined in DB (assumes users table contains proxy_url column)
-	var proxyURL string
+	// Route the websocket, media transfers and webhook calls through the session proxy
+	var proxyURL sql.NullString
 	err = s.db.Get(&proxyURL, "SELECT proxy_url FROM users WHERE id=$1", userID)
-	if err == nil && proxyURL != "" {
-		httpClient.SetProxy(proxyURL)
+	if err == nil && proxyURL.String != "" {
+		if err := client.SetProxyAddress(proxyURL.String); err != nil {
+			// Never fall back to a direct connection, the session would leak the server IP
+			log.Error().Err(err).Str("userid", userID).Msg("Could not apply proxy, not connecting")
+			session.Stop("invalid proxy")
+			return
+		}
+		httpClient.SetProxy(proxyURL.String)
+		log.Info().Str("userid", userID).Msg("Using proxy for websocket, media and webhooks")
 	}
 	clientManager.SetHTTPClient(userID, httpClient)
 
 	if client.Store.ID == nil {
 		// No ID stored, new login
-		qrChan, err := client.GetQRChannel(context.Background())
+		qrChan, err := client.GetQRChannel(session.Context())
 		if err != nil {
 			// This error means that we're already logged in, so ignore it.
 			if !errors.Is(err, whatsmeow.ErrQRStoreContainsID) {
 				log.Error().Err(err).Msg("Failed to get QR channel")
+				session.Stop("failed to get QR channel")
 				return
 			}
 		} else {
+			session.SetState(SessionConnecting, "pairing new device")
 			err = client.Connect() // Si no conectamos no se puede generar QR
 			if err != nil {
 				log.Error().Err(err).Msg("Failed to connect client")
+				session.Stop("failed to connect")
 				return
 			}
 
@@ -432,6 +488,7 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 
 			for evt := range qrChan {
 				if evt.Event == "code" {
+					session.SetState(SessionPairing, "waiting for QR scan")
 					// Display QR code in terminal (useful for testing/developing)
 					if *logType != "json" {
 						qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
@@ -472,11 +529,8 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 							userinfocache.Set(token, v, cache.NoExpiration)
 						}
 					}
-					log.Warn().Msg("QR timeout killing channel")
-					clientManager.DeleteWhatsmeowClient(userID)
-					clientManager.DeleteMyClient(userID)
-					clientManager.DeleteHTTPClient(userID)
-					killchannel[userID] <- true
+					log.Warn().Msg("QR timeout, stopping session")
+					session.Stop("QR timeout")
 				} else if evt.Event == "success" {
 					log.Info().Msg("QR pairing ok!")
 					// Clear QR code after pairing
@@ -499,32 +553,37 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 	} else {
 		// Already logged in, just connect
 		log.Info().Msg("Already logged in, just connect")
+		session.SetState(SessionConnecting, "restoring session")
 		err = client.Connect()
 		if err != nil {
-			panic(err)
+			log.Error().Err(err).Msg("Failed to connect client")
+			session.Stop("failed to connect")
+			return
 		}
 	}
 
-	// Keep connected client live until disconnected/killed
-	for {
-		select {
-		case <-killchannel[userID]:
-			log.Info().Str("userid", userID).Msg("Received kill signal")
-			client.Disconnect()
-			clientManager.DeleteWhatsmeowClient(userID)
-			clientManager.DeleteMyClient(userID)
-			clientManager.DeleteHTTPClient(userID)
-			sqlStmt := `UPDATE users SET qrcode='', connected=0 WHERE id=$1`
-			_, err := s.db.Exec(sqlStmt, "", userID)
-			if err != nil {
-				log.Error().Err(err).Msg(sqlStmt)
-			}
-			return
-		default:
-			time.Sleep(1000 * time.Millisecond)
-			//log.Info().Str("jid",textjid).Msg("Loop the loop")
-		}
+	// Keep connected client live until the session is stopped
+	<-session.Context().Done()
+	log.Info().Str("userid", userID).Str("reason", session.StopReason()).Msg("Received stop signal")
+}
+
+// teardownSession disconnects the client of a stopped session and releases it
+func (s *server) teardownSession(session *Session, client *whatsmeow.Client) {
+	userID := session.userID
+	session.Stop("client exited")
+
+	client.Disconnect()
+	if clientManager.GetWhatsmeowClient(userID) == client {
+		clientManager.DeleteWhatsmeowClient(userID)
+		clientManager.DeleteMyClient(userID)
+		clientManager.DeleteHTTPClient(userID)
 	}
+	sqlStmt := `UPDATE users SET qrcode='', connected=0 WHERE id=$1`
+	_, err := s.db.Exec(sqlStmt, userID)
+	if err != nil {
+		log.Error().Err(err).Msg(sqlStmt)
+	}
+	session.finish()
 }
 
 func fileToBase64(filepath string) (string, string, error) {
@@ -545,6 +604,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 
 	switch evt := rawEvt.(type) {
 	case *events.AppStateSyncComplete:
+		postmap["type"] = "AppStateSyncComplete"
+		dowebhook = 1
 		if len(mycli.WAClient.Store.PushName) > 0 && evt.Name == appstate.WAPatchCriticalBlock {
 			err := mycli.WAClient.SendPresence(types.PresenceAvailable)
 			if err != nil {
@@ -554,8 +615,14 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			}
 		}
 	case *events.Connected, *events.PushNameSetting:
-		postmap["type"] = "Connected"
 		dowebhook = 1
+		if _, ok := evt.(*events.Connected); ok {
+			postmap["type"] = "Connected"
+			mycli.session.SetState(SessionConnected, "connected")
+			mycli.session.reportReconnect(nil)
+		} else {
+			postmap["type"] = "PushNameSetting"
+		}
 		if len(mycli.WAClient.Store.PushName) == 0 {
 			break
 		}
@@ -574,6 +641,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			return
 		}
 	case *events.PairSuccess:
+		postmap["type"] = "PairSuccess"
+		dowebhook = 1
 		log.Info().Str("userid", mycli.userID).Str("token", mycli.token).Str("ID", evt.ID.String()).Str("BusinessName", evt.BusinessName).Str("Platform", evt.Platform).Msg("QR Pair Success")
 		jid := evt.ID
 		sqlStmt := `UPDATE users SET jid=$1 WHERE id=$2`
@@ -593,9 +662,27 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			userinfocache.Set(token, v, cache.NoExpiration)
 			log.Info().Str("jid", jid.String()).Str("userid", txtid).Str("token", token).Msg("User information set")
 		}
+	case *events.PairError:
+		postmap["type"] = "PairError"
+		dowebhook = 1
+		log.Error().Err(evt.Error).Str("ID", evt.ID.String()).Msg("QR Pair Error")
+		postmap["event"] = map[string]interface{}{
+			"ID":           evt.ID,
+			"LID":          evt.LID,
+			"BusinessName": evt.BusinessName,
+			"Platform":     evt.Platform,
+			"Error":        fmt.Sprintf("%v", evt.Error),
+		}
+	case *events.QRScannedWithoutMultidevice:
+		postmap["type"] = "QRScannedWithoutMultidevice"
+		dowebhook = 1
+		log.Warn().Msg("QR code scanned without multidevice enabled")
 	case *events.StreamReplaced:
+		postmap["type"] = "StreamReplaced"
+		dowebhook = 1
 		log.Info().Msg("Received StreamReplaced event")
-		return
+		// whatsmeow does not reconnect after this, another client took over the session
+		mycli.session.Stop("stream replaced")
 	case *events.Message:
 
 		var s3Config struct {
@@ -604,6 +691,10 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		}
 
 		lastMessageCache.Set(mycli.userID, &evt.Info, cache.DefaultExpiration)
+		storeIncomingMessage(mycli.db, mycli.userID, evt)
+		if evt.Message.GetPollUpdateMessage() != nil {
+			mycli.handlePollVote(evt)
+		}
 		myuserinfo, found := userinfocache.Get(mycli.token)
 		if !found {
 			err := mycli.db.Get(&s3Config, "SELECT CASE WHEN s3_enabled = 1 THEN 'true' ELSE 'false' END AS s3_enabled, media_delivery FROM users WHERE id = $1", txtid)
@@ -618,6 +709,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		}
 
 		postmap["type"] = "Message"
+		postmap["content"] = normalizeMessage(evt)
 		dowebhook = 1
 		metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", evt.Info.Timestamp)}
 		if evt.Info.Type != "" {
@@ -999,8 +1091,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			postmap["state"] = "Delivered"
 			log.Info().Str("id", evt.MessageIDs[0]).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%v", evt.Timestamp)).Msg("Message delivered")
 		} else {
-			// Discard webhooks for inactive or other delivery types
-			return
+			// Played, retry, server error and other receipts
+			postmap["state"] = string(evt.Type)
 		}
 	case *events.Presence:
 		postmap["type"] = "Presence"
@@ -1017,15 +1109,18 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			log.Info().Str("from", evt.From.String()).Msg("User is now online")
 		}
 	case *events.HistorySync:
-		postmap["type"] = "HistorySync"
-		dowebhook = 1
+		// The chunk is archived, its progress is emitted instead
+		mycli.handleHistorySync(evt)
 	case *events.AppState:
+		postmap["type"] = "AppState"
+		dowebhook = 1
 		log.Info().Str("index", fmt.Sprintf("%+v", evt.Index)).Str("actionValue", fmt.Sprintf("%+v", evt.SyncActionValue)).Msg("App state event received")
 	case *events.LoggedOut:
 		postmap["type"] = "Logged Out"
 		dowebhook = 1
 		log.Info().Str("reason", evt.Reason.String()).Msg("Logged out")
-		killchannel[mycli.userID] <- true
+		mycli.session.SetState(SessionLoggedOut, evt.Reason.String())
+		mycli.session.Stop("logged out")
 		sqlStmt := `UPDATE users SET connected=0 WHERE id=$1`
 		_, err := mycli.db.Exec(sqlStmt, mycli.userID)
 		if err != nil {
@@ -1037,28 +1132,181 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		dowebhook = 1
 		log.Info().Str("state", fmt.Sprintf("%s", evt.State)).Str("media", fmt.Sprintf("%s", evt.Media)).Str("chat", evt.MessageSource.Chat.String()).Str("sender", evt.MessageSource.Sender.String()).Msg("Chat Presence received")
 	case *events.CallOffer:
-		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call offer")
+		postmap["type"] = "CallOffer"
+		dowebhook = 1
+		log.Info().Str("from", evt.From.String()).Str("call", evt.CallID).Msg("Got call offer")
+		isVideo := callIsVideo(evt.Data)
+		event := callEvent(evt.BasicCallMeta)
+		event["IsVideo"] = isVideo
+		event["RemotePlatform"] = evt.RemotePlatform
+		event["RemoteVersion"] = evt.RemoteVersion
+		event["Action"] = mycli.handleIncomingCall(evt.BasicCallMeta, isVideo)
+		postmap["event"] = event
+	case *events.CallOfferNotice:
+		postmap["type"] = "CallOfferNotice"
+		dowebhook = 1
+		log.Info().Str("from", evt.From.String()).Str("call", evt.CallID).Msg("Got call offer notice")
+		isVideo := evt.Media == "video"
+		event := callEvent(evt.BasicCallMeta)
+		event["IsVideo"] = isVideo
+		event["Media"] = evt.Media
+		event["Action"] = mycli.handleIncomingCall(evt.BasicCallMeta, isVideo)
+		postmap["event"] = event
 	case *events.CallAccept:
-		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call accept")
+		postmap["type"] = "CallAccept"
+		dowebhook = 1
+		log.Info().Str("from", evt.From.String()).Str("call", evt.CallID).Msg("Got call accept")
+		if err := setCallStatus(mycli.db, mycli.userID, evt.CallID, callAccepted, ""); err != nil {
+			log.Error().Err(err).Str("call", evt.CallID).Msg("Failed to update call log")
+		}
+		event := callEvent(evt.BasicCallMeta)
+		event["RemotePlatform"] = evt.RemotePlatform
+		event["RemoteVersion"] = evt.RemoteVersion
+		postmap["event"] = event
 	case *events.CallTerminate:
-		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call terminate")
-	case *events.CallOfferNotice:
-		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call offer notice")
+		postmap["type"] = "CallTerminate"
+		dowebhook = 1
+		log.Info().Str("from", evt.From.String()).Str("call", evt.CallID).Str("reason", evt.Reason).Msg("Got call terminate")
+		if err := endCall(mycli.db, mycli.userID, evt.CallID, evt.Reason, evt.Timestamp); err != nil {
+			log.Error().Err(err).Str("call", evt.CallID).Msg("Failed to update call log")
+		}
+		event := callEvent(evt.BasicCallMeta)
+		event["Reason"] = evt.Reason
+		postmap["event"] = event
 	case *events.CallRelayLatency:
-		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call relay latency")
+		postmap["type"] = "CallRelayLatency"
+		dowebhook = 1
+		log.Debug().Str("from", evt.From.String()).Str("call", evt.CallID).Msg("Got call relay latency")
+		postmap["event"] = callEvent(evt.BasicCallMeta)
 	case *events.Disconnected:
 		postmap["type"] = "Disconnected"
 		dowebhook = 1
 		log.Info().Str("reason", fmt.Sprintf("%+v", evt)).Msg("Disconnected from Whatsapp")
+		go mycli.reconnect("connection lost")
 	case *events.ConnectFailure:
 		postmap["type"] = "ConnectFailure"
 		dowebhook = 1
 		log.Error().Str("reason", fmt.Sprintf("%+v", evt)).Msg("Failed to connect to Whatsapp")
+		if connectFailureRetryable(evt.Reason) {
+			go mycli.reconnect(fmt.Sprintf("connect failure: %s", evt.Reason))
+		} else {
+			log.Warn().Str("reason", evt.Reason.String()).Msg("Connect failure is not retryable, not reconnecting")
+		}
+	case *events.KeepAliveTimeout:
+		postmap["type"] = "KeepAliveTimeout"
+		dowebhook = 1
+		log.Warn().Int("errors", evt.ErrorCount).Time("lastSuccess", evt.LastSuccess).Msg("Keepalive timeout")
+		// whatsmeow only forces a reconnect itself when auto reconnect is on
+		if time.Since(evt.LastSuccess) > whatsmeow.KeepAliveMaxFailTime {
+			// Disconnecting waits on the connection, not in the event handler
+			go func() {
+				mycli.WAClient.Disconnect()
+				mycli.reconnect("keepalive timeout")
+			}()
+		}
+	case *events.StreamError:
+		postmap["type"] = "StreamError"
+		dowebhook = 1
+		log.Error().Str("code", evt.Code).Msg("Stream error")
+		go mycli.reconnect("stream error " + evt.Code)
+	case *events.KeepAliveRestored:
+		postmap["type"] = "KeepAliveRestored"
+		dowebhook = 1
+		log.Info().Msg("Keepalive restored")
+	case *events.ClientOutdated:
+		postmap["type"] = "ClientOutdated"
+		dowebhook = 1
+		log.Error().Msg("Client outdated, WhatsApp rejected the connection")
+	case *events.TemporaryBan:
+		postmap["type"] = "TemporaryBan"
+		dowebhook = 1
+		log.Error().Str("ban", evt.String()).Msg("Temporary ban")
+		postmap["event"] = map[string]interface{}{
+			"Code":          int(evt.Code),
+			"Reason":        evt.Code.String(),
+			"ExpireSeconds": int64(evt.Expire.Seconds()),
+		}
+	case *events.CATRefreshError:
+		postmap["type"] = "CATRefreshError"
+		dowebhook = 1
+		log.Error().Err(evt.Error).Msg("CAT refresh error")
+		postmap["event"] = map[string]interface{}{"Error": fmt.Sprintf("%v", evt.Error)}
+	case *events.UndecryptableMessage:
+		postmap["type"] = "UndecryptableMessage"
+		dowebhook = 1
+		log.Warn().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Bool("unavailable", evt.IsUnavailable).Msg("Undecryptable message")
+	case *events.MediaRetry:
+		postmap["type"] = "MediaRetry"
+		dowebhook = 1
+		log.Info().Str("id", evt.MessageID).Str("chat", evt.ChatID.String()).Msg("Media retry")
+	case *events.GroupInfo:
+		postmap["type"] = "GroupInfo"
+		dowebhook = 1
+		log.Info().Str("group", evt.JID.String()).Int("join", len(evt.Join)).Int("leave", len(evt.Leave)).Int("promote", len(evt.Promote)).Int("demote", len(evt.Demote)).Msg("Group info changed")
+	case *events.JoinedGroup:
+		postmap["type"] = "JoinedGroup"
+		dowebhook = 1
+		log.Info().Str("group", evt.JID.String()).Str("reason", evt.Reason).Msg("Joined group")
+	case *events.Picture:
+		postmap["type"] = "Picture"
+		dowebhook = 1
+		log.Info().Str("jid", evt.JID.String()).Bool("removed", evt.Remove).Msg("Picture changed")
+	case *events.Blocklist:
+		postmap["type"] = "Blocklist"
+		dowebhook = 1
+		log.Info().Str("action", string(evt.Action)).Int("changes", len(evt.Changes)).Msg("Blocklist changed")
+		// Each change is also delivered on its own
+		for _, change := range evt.Changes {
+			sendEventWithWebHook(mycli, map[string]interface{}{
+				"type":  "BlocklistChange",
+				"event": map[string]interface{}{"JID": change.JID, "Action": change.Action},
+			}, "")
+		}
+	case *events.IdentityChange:
+		postmap["type"] = "IdentityChange"
+		dowebhook = 1
+		log.Info().Str("jid", evt.JID.String()).Bool("implicit", evt.Implicit).Msg("Identity changed")
+	case *events.PrivacySettings:
+		postmap["type"] = "PrivacySettings"
+		dowebhook = 1
+		log.Info().Msg("Privacy settings changed")
+	case *events.UserAbout:
+		postmap["type"] = "UserAbout"
+		dowebhook = 1
+		log.Info().Str("jid", evt.JID.String()).Msg("User about changed")
+	case *events.OfflineSyncPreview:
+		postmap["type"] = "OfflineSyncPreview"
+		dowebhook = 1
+		log.Info().Int("total", evt.Total).Int("messages", evt.Messages).Msg("Offline sync preview")
+	case *events.OfflineSyncCompleted:
+		postmap["type"] = "OfflineSyncCompleted"
+		dowebhook = 1
+		log.Info().Int("count", evt.Count).Msg("Offline sync completed")
+	case *events.NewsletterJoin:
+		postmap["type"] = "NewsletterJoin"
+		dowebhook = 1
+		log.Info().Str("newsletter", evt.ID.String()).Msg("Joined newsletter")
+	case *events.NewsletterLeave:
+		postmap["type"] = "NewsletterLeave"
+		dowebhook = 1
+		log.Info().Str("newsletter", evt.ID.String()).Msg("Left newsletter")
+	case *events.NewsletterMuteChange:
+		postmap["type"] = "NewsletterMuteChange"
+		dowebhook = 1
+		log.Info().Str("newsletter", evt.ID.String()).Str("mute", string(evt.Mute)).Msg("Newsletter mute changed")
+	case *events.NewsletterLiveUpdate:
+		postmap["type"] = "NewsletterLiveUpdate"
+		dowebhook = 1
+		log.Debug().Str("newsletter", evt.JID.String()).Int("messages", len(evt.Messages)).Msg("Newsletter live update")
+	case *events.FBMessage:
+		postmap["type"] = "FBMessage"
+		dowebhook = 1
+		log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Msg("Got FB message")
 	default:
 		log.Warn().Str("event", fmt.Sprintf("%+v", evt)).Msg("Unhandled event")
 	}
 
 	if dowebhook == 1 {
-		sendEventWithWebHook(mycli, postmap, path)
+		sendWebhookEvent(mycli, rawEvt, postmap, path)
 	}
 }
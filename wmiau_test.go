@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// The init of main parses the command line, the test flags have to be
+// registered before it runs
+var _ = func() bool {
+	testing.Init()
+	return true
+}()
+
+const (
+	testUserID = "test-user"
+	testToken  = "test-token"
+)
+
+// newTestClient returns a client for a user with a webhook, backed by a fresh
+// database. Deliveries stay in the outbox, no dispatcher sends them
+func newTestClient(t *testing.T) *MyClient {
+	t.Helper()
+	db, err := initializeSQLite(DatabaseConfig{Type: "sqlite", Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := initializeSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO users (id, name, token, webhook, events) VALUES ($1, $2, $3, $4, $5)",
+		testUserID, "test", testToken, "http://127.0.0.1:9/webhook", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	previousQueue := webhookQueue
+	webhookQueue = &WebhookQueue{db: db, wake: make(chan struct{}, 1)}
+	t.Cleanup(func() {
+		webhookQueue = previousQueue
+		userinfocache.Delete(testToken)
+	})
+
+	// Reconnects triggered by the connection events are no-ops on a stopped session
+	session := newSession(testUserID, nil)
+	session.Stop("test")
+	return &MyClient{
+		WAClient: whatsmeow.NewClient(&store.Device{}, nil),
+		userID:   testUserID,
+		token:    testToken,
+		db:       db,
+		session:  session,
+	}
+}
+
+// subscribe caches the user as subscribed to a single event type, with
+// payloads in the given schema
+func subscribe(eventType string, schema string) {
+	userinfocache.Set(testToken, Values{map[string]string{
+		"Id":            testUserID,
+		"Token":         testToken,
+		"Name":          "test",
+		"Webhook":       "http://127.0.0.1:9/webhook",
+		"Events":        eventType,
+		"WebhookSchema": schema,
+	}}, cache.NoExpiration)
+}
+
+func clearOutbox(t *testing.T, mycli *MyClient) {
+	t.Helper()
+	if _, err := mycli.db.Exec("DELETE FROM webhook_outbox"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForWebhook waits for a delivery of the given event type to be queued
+// for the user webhook. Deliveries are queued from goroutines
+func waitForWebhook(t *testing.T, mycli *MyClient, eventType string) bool {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		var payloads []string
+		if err := mycli.db.Select(&payloads, "SELECT payload FROM webhook_outbox WHERE user_id=$1 AND source=$2", testUserID, webhookSourceUser); err != nil {
+			t.Fatal(err)
+		}
+		for _, payload := range payloads {
+			var data map[string]string
+			if err := json.Unmarshal([]byte(payload), &data); err != nil {
+				t.Fatal(err)
+			}
+			var event struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal([]byte(data["jsonData"]), &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type == eventType {
+				return true
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+// Every event type myEventHandler emits reaches a user subscribed to it. The
+// other supported types come from the scheduler, queues and reconnects
+func TestEventHandlerEmitsSubscribedEvents(t *testing.T) {
+	mycli := newTestClient(t)
+
+	contact := types.NewJID("5491155553934", types.DefaultUserServer)
+	group := types.NewJID("120363025246125486", types.GroupServer)
+	newsletter := types.NewJID("120363144038483540", types.NewsletterServer)
+	source := types.MessageSource{Chat: contact, Sender: contact}
+	info := types.MessageInfo{MessageSource: source, ID: "3EB0C767D097B7C7C030", Timestamp: time.Now()}
+	call := types.BasicCallMeta{From: contact, Timestamp: time.Now(), CallCreator: contact, CallID: "CALL1"}
+
+	cases := []struct {
+		eventType string
+		event     interface{}
+	}{
+		{"AppStateSyncComplete", &events.AppStateSyncComplete{Name: appstate.WAPatchRegular}},
+		{"Connected", &events.Connected{}},
+		{"PushNameSetting", &events.PushNameSetting{}},
+		{"PairSuccess", &events.PairSuccess{ID: contact, Platform: "android"}},
+		{"PairError", &events.PairError{ID: contact, Error: errors.New("pairing rejected")}},
+		{"QRScannedWithoutMultidevice", &events.QRScannedWithoutMultidevice{}},
+		{"StreamReplaced", &events.StreamReplaced{}},
+		{"Message", &events.Message{Info: info, Message: &waE2E.Message{Conversation: proto.String("hello")}}},
+		{"ReadReceipt", &events.Receipt{MessageSource: source, MessageIDs: []string{info.ID}, Timestamp: time.Now(), Type: types.ReceiptTypeRead}},
+		{"Presence", &events.Presence{From: contact, Unavailable: true, LastSeen: time.Now()}},
+		{"HistorySync", &events.HistorySync{Data: &waHistorySync.HistorySync{SyncType: waHistorySync.HistorySync_RECENT.Enum()}}},
+		{"AppState", &events.AppState{Index: []string{"mute", contact.String()}}},
+		{"ChatPresence", &events.ChatPresence{MessageSource: source, State: types.ChatPresenceComposing}},
+		{"CallOffer", &events.CallOffer{BasicCallMeta: call}},
+		{"CallOfferNotice", &events.CallOfferNotice{BasicCallMeta: call, Media: "audio"}},
+		{"CallAccept", &events.CallAccept{BasicCallMeta: call}},
+		{"CallTerminate", &events.CallTerminate{BasicCallMeta: call, Reason: "timeout"}},
+		{"CallRelayLatency", &events.CallRelayLatency{BasicCallMeta: call}},
+		{"Disconnected", &events.Disconnected{}},
+		{"ConnectFailure", &events.ConnectFailure{Reason: events.ConnectFailureServiceUnavailable}},
+		{"KeepAliveTimeout", &events.KeepAliveTimeout{ErrorCount: 1, LastSuccess: time.Now()}},
+		{"StreamError", &events.StreamError{Code: "515"}},
+		{"KeepAliveRestored", &events.KeepAliveRestored{}},
+		{"ClientOutdated", &events.ClientOutdated{}},
+		{"TemporaryBan", &events.TemporaryBan{Code: events.TempBanSentToTooManyPeople, Expire: time.Hour}},
+		{"CATRefreshError", &events.CATRefreshError{Error: errors.New("refresh failed")}},
+		{"UndecryptableMessage", &events.UndecryptableMessage{Info: info, IsUnavailable: true}},
+		{"MediaRetry", &events.MediaRetry{MessageID: info.ID, ChatID: contact, Timestamp: time.Now()}},
+		{"GroupInfo", &events.GroupInfo{JID: group, Join: []types.JID{contact}, Timestamp: time.Now()}},
+		{"JoinedGroup", &events.JoinedGroup{Reason: "invite", GroupInfo: types.GroupInfo{JID: group}}},
+		{"Picture", &events.Picture{JID: contact, Author: contact, Timestamp: time.Now()}},
+		{"Blocklist", &events.Blocklist{Action: events.BlocklistActionDefault, Changes: []events.BlocklistChange{{JID: contact, Action: events.BlocklistChangeActionBlock}}}},
+		{"BlocklistChange", &events.Blocklist{Action: events.BlocklistActionDefault, Changes: []events.BlocklistChange{{JID: contact, Action: events.BlocklistChangeActionBlock}}}},
+		{"IdentityChange", &events.IdentityChange{JID: contact, Timestamp: time.Now()}},
+		{"PrivacySettings", &events.PrivacySettings{GroupAddChanged: true}},
+		{"UserAbout", &events.UserAbout{JID: contact, Status: "Available", Timestamp: time.Now()}},
+		{"OfflineSyncPreview", &events.OfflineSyncPreview{Total: 3, Messages: 2, Receipts: 1}},
+		{"OfflineSyncCompleted", &events.OfflineSyncCompleted{Count: 3}},
+		{"NewsletterJoin", &events.NewsletterJoin{NewsletterMetadata: types.NewsletterMetadata{ID: newsletter}}},
+		{"NewsletterLeave", &events.NewsletterLeave{ID: newsletter, Role: types.NewsletterRoleSubscriber}},
+		{"NewsletterMuteChange", &events.NewsletterMuteChange{ID: newsletter, Mute: types.NewsletterMuteOn}},
+		{"NewsletterLiveUpdate", &events.NewsletterLiveUpdate{JID: newsletter, Time: time.Now()}},
+		{"FBMessage", &events.FBMessage{Info: info}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.eventType, func(t *testing.T) {
+			if !Find(supportedEventTypes, tc.eventType) {
+				t.Fatalf("%s is not a supported event type", tc.eventType)
+			}
+			clearOutbox(t, mycli)
+			subscribe(tc.eventType, webhookSchemaV1)
+			mycli.myEventHandler(tc.event)
+			if !waitForWebhook(t, mycli, tc.eventType) {
+				t.Errorf("no %s webhook was queued", tc.eventType)
+			}
+		})
+	}
+}
+
+// Events whose v1 type predates the name they are subscribed with keep it in
+// v1, v2 payloads use the normalized name. Every receipt goes out as one type
+func TestEventHandlerKeepsV1Types(t *testing.T) {
+	mycli := newTestClient(t)
+
+	contact := types.NewJID("5491155553934", types.DefaultUserServer)
+	loggedOut := &events.LoggedOut{Reason: events.ConnectFailureLoggedOut}
+	played := &events.Receipt{
+		MessageSource: types.MessageSource{Chat: contact, Sender: contact},
+		MessageIDs:    []string{"3EB0C767D097B7C7C030"},
+		Timestamp:     time.Now(),
+		Type:          types.ReceiptTypePlayed,
+	}
+
+	cases := []struct {
+		name         string
+		subscription string
+		schema       string
+		event        interface{}
+		sentAs       string
+	}{
+		{"LoggedOut v1", "LoggedOut", webhookSchemaV1, loggedOut, "Logged Out"},
+		{"LoggedOut v2", "LoggedOut", webhookSchemaV2, loggedOut, "LoggedOut"},
+		{"played receipt", "ReadReceipt", webhookSchemaV1, played, "ReadReceipt"},
+		{"played receipt to Receipt", "Receipt", webhookSchemaV1, played, "ReadReceipt"},
+		{"played receipt v2", "ReadReceipt", webhookSchemaV2, played, "Receipt"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clearOutbox(t, mycli)
+			subscribe(tc.subscription, tc.schema)
+			mycli.myEventHandler(tc.event)
+			if !waitForWebhook(t, mycli, tc.sentAs) {
+				t.Errorf("no %s webhook was queued", tc.sentAs)
+			}
+		})
+	}
+}